@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"9fans.net/go/acme"
+)
+
+// fmtAll formats each open window whose name matches re,
+// writing a one-line summary for each to standard error.
+// It returns the number of windows that failed to format.
+func fmtAll(re *regexp.Regexp, j job) (int, error) {
+	wins, err := acme.Windows()
+	if err != nil {
+		return 0, err
+	}
+	var t tally
+	for _, wi := range wins {
+		if !nameMatch(re, wi.Name) {
+			continue
+		}
+		j.id, j.dir = wi.ID, filepath.Dir(wi.Name)
+		changed, err := fmtOpen(wi.ID, j)
+		t.add(wi.ID, wi.Name, changed, err)
+	}
+	t.finish()
+	return t.nfailed, nil
+}
+
+// A tally counts the results of formatting several windows or files.
+type tally struct {
+	nchanged, nsame, nfailed int
+	// Visits are the windows to visit with Fmt -next.
+	visits []visit
+	// W receives the results.
+	// If nil, they go to standard error.
+	w io.Writer
+}
+
+// printf writes a translated message to t.w.
+func (t *tally) printf(format string, args ...interface{}) {
+	fmt.Fprintf(t.out(), tr(format), args...)
+}
+
+// out returns the writer of the results.
+func (t *tally) out() io.Writer {
+	if t.w == nil {
+		return os.Stderr
+	}
+	return t.w
+}
+
+// add counts the result of formatting the window with the given ID
+// and name, or if id is 0, the file on disk with the name,
+// and writes a line describing it.
+func (t *tally) add(id int, name string, changed bool, err error) {
+	out := resultOutput{Name: name, Err: err}
+	switch {
+	case err != nil:
+		t.nfailed++
+		if id != 0 {
+			t.visits = append(t.visits, visit{ID: id, Name: name, Failed: true})
+		}
+		if out.Status = "failed"; !render(t.out(), "result", out) {
+			t.printf("%s: %s\n", name, err)
+		}
+	case changed:
+		t.nchanged++
+		if id != 0 {
+			t.visits = append(t.visits, visit{ID: id, Name: name})
+		}
+		if out.Status = "formatted"; !render(t.out(), "result", out) {
+			t.printf("%s: formatted\n", name)
+		}
+	default:
+		t.nsame++
+		if out.Status = "unchanged"; !render(t.out(), "result", out) {
+			t.printf("%s: unchanged\n", name)
+		}
+	}
+}
+
+// finish saves the windows to visit with Fmt -next
+// and writes the summary.
+func (t *tally) finish() {
+	if err := saveTour(t.visits); err != nil {
+		eprintf("failed to save the windows for -next: %s\n", err)
+	}
+	switch {
+	case render(t.out(), "summary", summaryOutput{t.nchanged, t.nsame, t.nfailed}):
+	case plain:
+		t.printf("formatted: %d\n", t.nchanged)
+		t.printf("unchanged: %d\n", t.nsame)
+		t.printf("failed: %d\n", t.nfailed)
+	default:
+		t.printf("%d formatted, %d unchanged, %d failed\n", t.nchanged, t.nsame, t.nfailed)
+	}
+}
+
+// fmtOpen opens the window with the given ID and formats it.
+func fmtOpen(id int, j job) (bool, error) {
+	win, err := acme.Open(id, nil)
+	if err != nil {
+		return false, errorf("failed to open win: %s", err)
+	}
+	defer win.CloseFiles()
+	return fmtWin(wrapped(win), j)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// defaultBackupMax is the default size of the largest body backed up.
+const defaultBackupMax = 16 << 20
+
+// A backup is the body and selection of a window before its most recent format.
+type backup struct {
+	// Name is the window name at the time of the format.
+	Name   string
+	Q0, Q1 int
+	Body   string
+}
+
+// backupPath returns the path of the backup of the window with the given ID.
+func backupPath(id int) (string, error) {
+	return stateFile(fmt.Sprintf("backup-%d", id))
+}
+
+// saveBackup saves the body and selection of win from before the format res,
+// unless the body is larger than j.backupMax bytes, in which case
+// any older backup is removed, as it no longer precedes the latest format.
+func saveBackup(win fmtharness.Window, j job, res *fmtharness.Result) error {
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	path, err := backupPath(j.id)
+	if err != nil {
+		return err
+	}
+	if int64(len(res.Body)) > j.backupMax {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(backup{Name: name, Q0: res.Q0, Q1: res.Q1, Body: string(res.Body)})
+	if err != nil {
+		return err
+	}
+	return writePrivate(path, data)
+}
+
+// restore puts back the body and selection of win from before its most recent format.
+func restore(win fmtharness.Window, id int) error {
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	path, err := backupPath(id)
+	if err != nil {
+		return errorf("failed to read the backup: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errorf("no backup of %s", name)
+	}
+	if err != nil {
+		return errorf("failed to read the backup: %s", err)
+	}
+	var b backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return errorf("failed to read the backup: %s", err)
+	}
+	if b.Name != name {
+		return errorf("no backup of %s", name)
+	}
+	if err := fmtharness.WriteBody(win, strings.NewReader(b.Body)); err != nil {
+		return errorf("failed to write the body: %s", err)
+	}
+	if err := fmtharness.ShowAddr(win, b.Q0, b.Q1); err != nil {
+		return errorf("failed to restore the selection: %s", err)
+	}
+	return os.Remove(path)
+}
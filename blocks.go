@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A blockFormatter is a Formatter of a document, such as a Markdown file,
+// that formats each fenced code block in it, as in
+//
+//	```go
+//	func main() {}
+//	```
+//
+// and each shell here-document with a quoted delimiter
+// that is redirected to a file, as in
+//
+//	cat >main.go <<'EOF'
+//	func main() {}
+//	EOF
+//
+// with the command that the configuration chooses for the block's language,
+// or for the file's name extension,
+// and leaves the rest of the document unchanged.
+// Blocks without a language, or whose language has no formatter,
+// are left unchanged, as are blocks whose formatter fails,
+// whose errors are written to the job's standard error.
+// Here-documents with unquoted delimiters are left unchanged,
+// since the shell expands $ and ` in them.
+type blockFormatter struct {
+	j job
+}
+
+// Format formats the code blocks of the document read from src.
+func (f blockFormatter) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	stderr := f.j.stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	lines := fmtharness.SplitLines(string(text))
+	var out bytes.Buffer
+	for i := 0; i < len(lines); i++ {
+		out.WriteString(lines[i])
+		var indent, ext string
+		var closes func(string) bool
+		if in, fence, lang, ok := openFence(lines[i]); ok {
+			indent, ext = in, langExt(lang)
+			closes = func(l string) bool { return closesFence(l, fence) }
+		} else if delim, e, ok := openHereDoc(lines[i]); ok {
+			ext = e
+			closes = func(l string) bool { return strings.TrimRight(l, "\r\n") == delim }
+		} else {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && !closes(lines[end]) {
+			end++
+		}
+		if end == len(lines) {
+			// An unclosed block runs to the end of the document;
+			// leave it be.
+			continue
+		}
+		block := strings.Join(lines[i+1:end], "")
+		// The name is never created; it only chooses the rule.
+		name := filepath.Join(filepath.Dir(f.j.file), "block"+ext)
+		if ext != "" && f.configured(name) {
+			formatted, err := f.formatBlock(name, indent, lines[i+1:end])
+			if err != nil {
+				fmt.Fprintf(stderr, tr("%s:%d: code block not formatted: %s\n"), f.j.file, i+2, err)
+			} else {
+				block = formatted
+			}
+		}
+		out.WriteString(block)
+		out.WriteString(lines[end])
+		i = end
+	}
+	_, err = dst.Write(out.Bytes())
+	return err
+}
+
+// configured returns whether the configuration chooses a command
+// for the file name.
+func (f blockFormatter) configured(name string) bool {
+	conf, err := f.j.conf.forFile(name)
+	if err != nil {
+		return false
+	}
+	r := conf.match(name)
+	return r != nil && !r.exclude || r == nil && conf.fallback(name) != nil
+}
+
+// formatBlock returns the lines of a code block,
+// each beginning with indent, formatted with the command
+// that the configuration chooses for the file name.
+func (f blockFormatter) formatBlock(name, indent string, block []string) (string, error) {
+	var code strings.Builder
+	for _, l := range block {
+		code.WriteString(strings.TrimPrefix(l, indent))
+	}
+	k := f.j
+	// With -trim, resolved would just trim, so trim after the block's command.
+	trim := k.trim
+	k.blocks, k.changed, k.trim = false, false, false
+	k, err := k.resolved(name)
+	if err != nil {
+		return "", err
+	}
+	k.trim = k.trim || trim
+	var out bytes.Buffer
+	if err := k.formatter().Format(&out, strings.NewReader(code.String())); err != nil {
+		return "", err
+	}
+	if out.Len() == 0 && code.Len() > 0 {
+		return "", errorf("the formatter output is empty")
+	}
+	var b strings.Builder
+	for _, l := range fmtharness.SplitLines(out.String()) {
+		if l != "\n" {
+			b.WriteString(indent)
+		}
+		b.WriteString(l)
+	}
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// openFence returns the indentation, the fence, such as ```, and the language
+// of the line opening a fenced code block, and whether the line opens one.
+func openFence(line string) (indent, fence, lang string, ok bool) {
+	trimmed := strings.TrimLeft(line, " \t")
+	indent = line[:len(line)-len(trimmed)]
+	for _, c := range []string{"`", "~"} {
+		n := len(trimmed) - len(strings.TrimLeft(trimmed, c))
+		if n >= 3 {
+			fence = trimmed[:n]
+			info := strings.Fields(trimmed[n:])
+			if len(info) > 0 {
+				lang = strings.ToLower(strings.Trim(info[0], "{}."))
+			}
+			return indent, fence, lang, true
+		}
+	}
+	return "", "", "", false
+}
+
+// closesFence returns whether the line closes a block opened by fence.
+func closesFence(line, fence string) bool {
+	l := strings.TrimSpace(line)
+	return strings.HasPrefix(l, fence) && strings.Trim(l, fence[:1]) == ""
+}
+
+// openHereDoc returns the delimiter of the shell here-document
+// opened by the line, and the name extension of the file
+// that it is redirected to, as in cat >x.go <<'EOF',
+// and whether the line opens a here-document with a quoted delimiter
+// redirected to a file with a name extension.
+// Here-strings, <<<, and here-documents with leading tabs stripped, <<-,
+// are not opened.
+func openHereDoc(line string) (delim, ext string, ok bool) {
+	i := strings.Index(line, "<<")
+	if i < 0 || strings.HasPrefix(line[i+2:], "<") || strings.HasPrefix(line[i+2:], "-") {
+		return "", "", false
+	}
+	rest := strings.TrimLeft(line[i+2:], " \t")
+	if rest == "" || rest[0] != '\'' && rest[0] != '"' {
+		return "", "", false
+	}
+	n := strings.IndexByte(rest[1:], rest[0])
+	if n <= 0 {
+		return "", "", false
+	}
+	delim = rest[1 : n+1]
+	fields := strings.Fields(line[:i] + " " + rest[n+2:])
+	for j, f := range fields {
+		if !strings.HasPrefix(f, ">") || strings.HasPrefix(f, ">&") {
+			continue
+		}
+		if f = strings.TrimLeft(f, ">"); f == "" && j+1 < len(fields) {
+			f = fields[j+1]
+		}
+		ext = strings.ToLower(filepath.Ext(strings.Trim(f, "'\"")))
+	}
+	if ext == "" {
+		return "", "", false
+	}
+	return delim, ext, true
+}
+
+// langExt returns the file name extension of the language
+// named by the info string of a code block.
+func langExt(lang string) string {
+	switch lang {
+	case "":
+		return ""
+	case "golang":
+		return ".go"
+	case "python", "python3":
+		return ".py"
+	case "javascript", "node":
+		return ".js"
+	case "typescript":
+		return ".ts"
+	case "bash", "shell", "zsh":
+		return ".sh"
+	case "c++":
+		return ".cpp"
+	case "rust":
+		return ".rs"
+	case "yml":
+		return ".yaml"
+	case "markdown":
+		return ".md"
+	}
+	return "." + lang
+}
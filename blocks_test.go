@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenHereDoc(t *testing.T) {
+	tests := []struct {
+		line  string
+		delim string
+		ext   string
+		ok    bool
+	}{
+		{"cat >main.go <<'EOF'\n", "EOF", ".go", true},
+		{"cat > main.go <<'EOF'\n", "EOF", ".go", true},
+		{"cat <<\"END\" >x.PY\n", "END", ".py", true},
+		{"cat >>'x.c' <<'EOF'\n", "EOF", ".c", true},
+		// Expanded by the shell.
+		{"cat >main.go <<EOF\n", "", "", false},
+		{"cat >main.go <<-'EOF'\n", "", "", false},
+		{"cat >main.go <<<'x'\n", "", "", false},
+		// Not to a file with an extension.
+		{"cat <<'EOF'\n", "", "", false},
+		{"cat >Makefile <<'EOF'\n", "", "", false},
+		{"cat <<'EOF' 2>&1\n", "", "", false},
+		{"x << 'EOF\n", "", "", false},
+		{"a := b << 2\n", "", "", false},
+	}
+	for _, test := range tests {
+		delim, ext, ok := openHereDoc(test.line)
+		if delim != test.delim || ext != test.ext || ok != test.ok {
+			t.Errorf("openHereDoc(%q)=%q, %q, %v, want %q, %q, %v",
+				test.line, delim, ext, ok, test.delim, test.ext, test.ok)
+		}
+	}
+}
+
+func TestBlockFormatter(t *testing.T) {
+	dir := canonical(t.TempDir())
+	path := filepath.Join(dir, "config")
+	writeConfig(t, path, "[*.go]\ncmd = tr a-z A-Z\n[*.c]\ncmd = cat\n")
+	var c config
+	if err := c.read(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		trim bool
+		text string
+		want string
+	}{
+		{
+			name: "fenced",
+			text: "a\n```go\nx\n```\nb\n",
+			want: "a\n```go\nX\n```\nb\n",
+		},
+		{
+			name: "indented fence",
+			text: "- a\n  ```go\n  x\n\n  y\n  ```\n",
+			want: "- a\n  ```go\n  X\n\n  Y\n  ```\n",
+		},
+		{
+			name: "no formatter",
+			text: "```py\nx\n```\n```\ny\n```\n",
+			want: "```py\nx\n```\n```\ny\n```\n",
+		},
+		{
+			name: "unclosed",
+			text: "```go\nx\n",
+			want: "```go\nx\n",
+		},
+		{
+			name: "here-document",
+			text: "cat >x.go <<'EOF'\nx\nEOF\ncat >y.go <<EOF\n$y\nEOF\n",
+			want: "cat >x.go <<'EOF'\nX\nEOF\ncat >y.go <<EOF\n$y\nEOF\n",
+		},
+		{
+			name: "trim",
+			trim: true,
+			text: "a  \n```c\nx  \n\n```\n",
+			want: "a  \n```c\nx\n```\n",
+		},
+	}
+	for _, test := range tests {
+		j := job{blocks: true, trim: test.trim, conf: &c, file: filepath.Join(dir, "README.md")}
+		got, err := format(blockFormatter{j}, test.text)
+		if err != nil || got != test.want {
+			t.Errorf("%s: Format(%q)=%q, %v, want %q, nil", test.name, test.text, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+)
+
+// A fmtCache remembers the bodies that are already formatted,
+// so that formatting them again with the same command can be skipped
+// without running the formatter.
+// It is kept by the modes in which Fmt stays resident,
+// where the same windows are formatted again and again.
+type fmtCache struct {
+	// Sums are the hashes of the formatted bodies,
+	// keyed by cacheKey, with one entry for each window and job.
+	sums map[string][sha256.Size]byte
+}
+
+// cacheKey returns the key of the cache entry
+// for formatting the window named name as described by j,
+// which is resolved for the window.
+// It covers everything about the job that can change the formatted text,
+// and the user's configuration file and the project configuration files
+// of the window, which choose the commands of code blocks,
+// by their modification times and sizes.
+func cacheKey(name string, j job) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%q\x00%q\x00%q\x00", name, j.run, j.wrapper, j.file)
+	fmt.Fprintf(h, "%t %t %d %t %q %q\x00", j.lsp, j.imports, j.fixpoint, j.trim, j.eol, j.encoding)
+	fmt.Fprintf(h, "%t %t %q %x\x00", j.blocks, j.changed, j.base, sha256.Sum256(j.baseText))
+	fmt.Fprintf(h, "%q %q %q\x00", j.guardOff, j.guardOn, j.suffix)
+	fmt.Fprintf(h, "%d %q %d %d %d\x00", j.jobs, j.jobsFlag, j.cpuLimit, j.memLimit, j.maxStdin)
+	for _, p := range append([]string{configPath()}, projectFiles(name)...) {
+		if fi, err := os.Stat(p); err == nil {
+			fmt.Fprintf(h, "%s %d %d\x00", p, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return string(h.Sum(nil))
+}
+
+// formatted returns whether body is already formatted
+// as described by j for the window named name.
+// A nil cache remembers nothing.
+func (c *fmtCache) formatted(name string, j job, body []byte) bool {
+	if c == nil {
+		return false
+	}
+	sum, ok := c.sums[cacheKey(name, j)]
+	return ok && sum == sha256.Sum256(body)
+}
+
+// add remembers that body is formatted as described by j
+// for the window named name.
+func (c *fmtCache) add(name string, j job, body []byte) {
+	if c == nil {
+		return
+	}
+	if c.sums == nil {
+		c.sums = make(map[string][sha256.Size]byte)
+	}
+	c.sums[cacheKey(name, j)] = sha256.Sum256(body)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheKeyConfig(t *testing.T) {
+	dir := canonical(t.TempDir())
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+	name := filepath.Join(dir, "x.go")
+	j := job{run: []string{"gofmt"}}
+	empty := cacheKey(name, j)
+	writeConfig(t, configPath(), "[*.go]\ncmd = gofmt\n")
+	global := cacheKey(name, j)
+	if global == empty {
+		t.Errorf("cacheKey() is unchanged by writing %s", configPath())
+	}
+	writeConfig(t, filepath.Join(dir, projectFile), "[*.md]\ncmd = prettier\n")
+	if cacheKey(name, j) == global {
+		t.Errorf("cacheKey() is unchanged by writing %s", projectFile)
+	}
+
+	var c fmtCache
+	c.add(name, j, []byte("x\n"))
+	if !c.formatted(name, j, []byte("x\n")) {
+		t.Errorf("formatted()=false after add, want true")
+	}
+	if c.formatted(name, j, []byte("y\n")) {
+		t.Errorf("formatted() of a different body=true, want false")
+	}
+	writeConfig(t, configPath(), "[*.go]\ncmd = gofumpt\n")
+	if c.formatted(name, j, []byte("x\n")) {
+		t.Errorf("formatted() after changing the configuration=true, want false")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A changedOnly is a Formatter that applies only the changes
+// of its Formatter to the lines that differ from base,
+// the text of the file as committed,
+// so that formatting does not touch the lines that the user left alone.
+type changedOnly struct {
+	fmtharness.Formatter
+	base []byte
+}
+
+// Format formats the text read from src with c.Formatter,
+// and writes the text with only those changes of the formatter
+// that touch lines changed since c.base.
+func (c changedOnly) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := c.Formatter.Format(&out, bytes.NewReader(text)); err != nil {
+		return err
+	}
+	base := fmtharness.SplitLines(string(c.base))
+	lines := fmtharness.SplitLines(string(text))
+	formatted := fmtharness.SplitLines(out.String())
+	// Touched[i] is whether line i of the text changed since base.
+	touched := make([]bool, len(lines)+1)
+	for _, h := range fmtharness.Diff(base, lines) {
+		for i := h.B0; i < h.B1; i++ {
+			touched[i] = true
+		}
+		if h.B0 == h.B1 {
+			// A deletion touches the line after it.
+			touched[h.B0] = true
+		}
+	}
+	var b strings.Builder
+	prev := 0
+	for _, h := range lineHunks(fmtharness.Diff(lines, formatted)) {
+		if !touches(touched, h) {
+			continue
+		}
+		b.WriteString(strings.Join(lines[prev:h.A0], ""))
+		b.WriteString(strings.Join(formatted[h.B0:h.B1], ""))
+		prev = h.A1
+	}
+	b.WriteString(strings.Join(lines[prev:], ""))
+	_, err = io.WriteString(dst, b.String())
+	return err
+}
+
+// lineHunks returns hs with each hunk that replaces lines one for one
+// split into a hunk for each line, so that only the touched lines are changed.
+func lineHunks(hs []fmtharness.Hunk) []fmtharness.Hunk {
+	var split []fmtharness.Hunk
+	for _, h := range hs {
+		if h.A1-h.A0 != h.B1-h.B0 {
+			split = append(split, h)
+			continue
+		}
+		for i := 0; i < h.A1-h.A0; i++ {
+			split = append(split, fmtharness.Hunk{A0: h.A0 + i, A1: h.A0 + i + 1, B0: h.B0 + i, B1: h.B0 + i + 1})
+		}
+	}
+	return split
+}
+
+// touches returns whether the hunk changes any of the touched lines.
+// An insertion touches the lines on either side of it.
+func touches(touched []bool, h fmtharness.Hunk) bool {
+	if h.A0 == h.A1 {
+		return touched[h.A0] || h.A0 > 0 && touched[h.A0-1]
+	}
+	for i := h.A0; i < h.A1; i++ {
+		if touched[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// gitBase returns the text of the file name as of the git revision rev,
+// or in the index if rev is empty.
+// A file that is not in the revision has an empty base,
+// so that all of its lines count as changed.
+func gitBase(name, rev string) ([]byte, error) {
+	cmd := exec.Command("git", "show", rev+":./"+filepath.Base(name))
+	cmd.Dir = filepath.Dir(name)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	switch {
+	case err == nil:
+		return out, nil
+	case bytes.Contains(stderr.Bytes(), []byte("exists on disk, but not in")),
+		bytes.Contains(stderr.Bytes(), []byte("does not exist in")):
+		return nil, nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return nil, errorf("git show: %s", msg)
+	}
+	return nil, errorf("git show: %s", err)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// subcommands are the subcommands that take the flags of a format,
+// given after the subcommand name, as in Fmt check -lsp gopls.
+var subcommands = map[string]bool{
+	"run":     true,
+	"check":   true,
+	"diff":    true,
+	"daemon":  true,
+	"restore": true,
+}
+
+// checkWin formats the body of win as described by j, leaving it unchanged,
+// and reports whether the formatting would change it.
+// If diff is set, it prints the diff of the change to standard output,
+// otherwise, if the body would change, the window's name.
+func checkWin(win fmtharness.Window, j job, diff bool) (bool, error) {
+	name, err := winName(win)
+	if err != nil {
+		return false, errorf("failed to read the window name: %s", err)
+	}
+	if j, err = j.resolved(name); err != nil {
+		return false, err
+	}
+	body, formatted, err := fmtharness.Formatted(win, j.formatter())
+	if err != nil || bytes.Equal(body, formatted) {
+		return false, err
+	}
+	if !diff {
+		os.Stdout.WriteString(name + "\n")
+		return true, nil
+	}
+	a, b := fmtharness.SplitLines(string(body)), fmtharness.SplitLines(string(formatted))
+	fmtharness.Unified(os.Stdout, name, name+" (formatted)", a, b, fmtharness.Diff(a, b), 3, nil)
+	return true, nil
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A rule says how to format files whose names match a pattern.
+type rule struct {
+	// Pattern is a filepath.Match pattern.
+	// If it contains a slash, it is matched against the whole file name,
+	// otherwise against the base name.
+	pattern string
+	// Cmd is the formatting command and its arguments.
+	cmd []string
+	// MaxStdin, if positive, is the size in bytes of the largest text
+	// given to the command on standard input.
+	// Larger text is given in a temporary file named by a final argument.
+	maxStdin int64
+	// JobsFlag, if non-empty, is the argument that sets the number
+	// of parallel jobs of the command, with %d for the number, such as -j%d.
+	jobsFlag string
+	// Nice, if non-zero, is the niceness with which to run the command.
+	nice int
+	// IONice, if non-empty, is the I/O scheduling of the command:
+	// idle, or a best-effort priority from 0, highest, to 7.
+	ionice string
+	// GuardOff and GuardOn, if non-empty, are the markers
+	// of the regions of the text to leave as they are.
+	guardOff, guardOn string
+	// Wrap, if non-empty, is a command and arguments, such as a sandbox,
+	// that run cmd given as their final arguments.
+	wrap []string
+	// CPU, if positive, is the limit in seconds on the CPU time of the command.
+	cpu int
+	// Mem, if positive, is the limit in bytes on the address space of the command.
+	mem int64
+	// Trim, if true, tidies the trailing white space and blank lines of the output.
+	trim bool
+	// Encoding, if non-empty, is the encoding of files that are not UTF-8.
+	encoding string
+	// Hosts are the host names to which the rule is restricted.
+	// If empty, the rule applies on all hosts.
+	hosts []string
+	// Source is the file and line defining the rule.
+	source string
+	// Dir, for a rule of a project configuration file,
+	// is the directory of the file.
+	// Patterns containing a slash are matched against names relative to it.
+	dir string
+	// Exclude is whether matching files are not to be formatted.
+	exclude bool
+	// GoLocal is whether to give goimports the module path as -local.
+	goLocal bool
+	// LSP is whether cmd is a language server,
+	// asked to format by the Language Server Protocol.
+	lsp bool
+	// Pre and Post, if non-empty, are the commands run
+	// before formatting and after a successful format.
+	pre, post []string
+}
+
+// A config is the formatting rules from the configuration files.
+type config struct {
+	// Rules are in order of precedence, highest first.
+	rules []*rule
+	// Files are the configuration files that were read.
+	files []string
+	// Aliases are the commands that are run for the names of aliases.
+	aliases map[string][]string
+	// Profiles are the profiles by name.
+	profiles map[string]*profile
+	// Profile is the profile in use, if any.
+	profile *profile
+}
+
+// configPath returns the path of the user's configuration file.
+func configPath() string {
+	return filepath.Join(os.Getenv("HOME"), "lib", "fmt", "config")
+}
+
+// loadConfig returns the configuration from the configuration file.
+// A missing configuration file is an empty configuration.
+func loadConfig() (*config, error) {
+	c := &config{}
+	if err := c.read(configPath()); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// read adds the rules of the configuration file at path,
+// with precedence over the rules already in the config.
+//
+// A configuration file is a sequence of sections, each headed by a pattern
+// in square brackets and followed by key = value settings for that pattern.
+// Blank lines and lines beginning with # are ignored.
+// Commands are split into arguments at white space,
+// except within single quotes, as in rc(1).
+// The cmd key gives the formatting command for matching files.
+// The exclude key, if true, says that matching files are not to be formatted;
+// such sections take precedence over the others of the file.
+// The host key restricts the section to the named hosts, by full or short host name.
+// Sections for the current host take precedence over unrestricted sections,
+// so that a home directory shared by several machines can override
+// the shared rules with the formatters installed on each.
+// Sections for other hosts are ignored.
+// The maxstdin key gives the size in bytes of the largest text
+// to give the command on standard input; larger text is instead written
+// to a temporary file, whose name is given to the command as a final argument.
+// The jobs key is the argument that tells the command how many parallel jobs to run,
+// with %d for the number, such as --jobs=%d;
+// Fmt files uses it to share the CPUs among the formatters that it runs at once.
+// The nice key runs the command with the given niceness, using nice(1),
+// and the ionice key with the given I/O scheduling, using ionice(1):
+// idle, or a best-effort priority from 0 to 7,
+// so that heavy formatters do not slow the rest of the machine.
+// The offmarker and onmarker keys replace the markers, fmt:off and fmt:on,
+// of the regions of the text that Fmt keeps as they were.
+// The wrapper key gives a command that runs cmd, given as its final arguments,
+// such as firejail --quiet --net=none,
+// so that untrusted formatters, such as those named by project files, can be sandboxed.
+// The cpu key limits the CPU time of the command to the given number of seconds,
+// and the mem key its address space to the given number of bytes,
+// using prlimit(1), so that a pathological run cannot take over the machine.
+// The trim key, if true, tidies the output of cmd as the -trim flag does.
+// The encoding key names the encoding, such as shift_jis,
+// of the files that are not valid UTF-8, as does the -encoding flag.
+// The lsp key, if true, says that cmd runs a language server,
+// such as gopls -remote=auto, which Fmt asks to format the text
+// by the Language Server Protocol instead of piping the text through cmd.
+// The golocal key, if true, gives goimports the module path
+// of the file's go.mod as its -local argument.
+// The pre key gives a command to run before formatting a window,
+// such as a code generator, and the post key a command to run
+// after formatting it successfully, such as a build.
+// They are run in the file's directory with $fmtfile set to the file name,
+// and the post command with $fmtchanged set to 1 if the format changed the body,
+// and to 0 if not. If the pre command fails, the window is not formatted.
+//
+//	# Go
+//	[*.go]
+//	cmd = goimports -local=example.com
+//
+//	[*.go]
+//	host = laptop
+//	cmd = /usr/local/go/bin/gofmt
+//
+// The section headed [alias] instead defines aliases,
+// each a name = command setting, so that the name can be given
+// to Fmt in place of the longer command:
+//
+//	[alias]
+//	go = goimports -local=example.com
+//	py = black -q - | isort -
+func (c *config) read(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rules []*rule
+	var cur *rule
+	var alias bool
+	var prof *profile
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		source := path + ":" + strconv.Itoa(n)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			pat := strings.TrimSpace(line[1 : len(line)-1])
+			if _, err := filepath.Match(pat, ""); err != nil {
+				return errorf("%s: bad pattern %s: %s", source, pat, err)
+			}
+			prof = nil
+			if alias = pat == "alias"; alias {
+				continue
+			}
+			if name := strings.TrimPrefix(pat, "profile "); name != pat {
+				name = strings.TrimSpace(name)
+				prof, cur = &profile{name: name, source: source}, nil
+				if c.profiles == nil {
+					c.profiles = make(map[string]*profile)
+				}
+				c.profiles[name] = prof
+				continue
+			}
+			cur = &rule{pattern: pat, source: source}
+			rules = append(rules, cur)
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return errorf("%s: expected key = value", source)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if alias {
+			cmd, err := splitArgs(val)
+			switch {
+			case err != nil:
+				return errorf("%s: %s", source, err)
+			case strings.ContainsAny(key, " \t"):
+				return errorf("%s: bad alias name %s", source, key)
+			case len(cmd) == 0:
+				return errorf("%s: empty alias %s", source, key)
+			}
+			if c.aliases == nil {
+				c.aliases = make(map[string][]string)
+			}
+			c.aliases[key] = cmd
+			continue
+		}
+		if prof != nil {
+			if err := prof.set(key, val, source); err != nil {
+				return err
+			}
+			continue
+		}
+		if cur == nil {
+			return errorf("%s: %s outside of a [pattern] section", source, key)
+		}
+		switch key {
+		case "cmd":
+			cmd, err := splitArgs(val)
+			if err != nil {
+				return errorf("%s: %s", source, err)
+			}
+			if len(cmd) == 0 {
+				return errorf("%s: empty cmd", source)
+			}
+			// Each further cmd is a further step.
+			if cur.cmd != nil {
+				cur.cmd = append(cur.cmd, "&&")
+			}
+			cur.cmd = append(cur.cmd, cmd...)
+		case "exclude":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return errorf("%s: bad exclude %s", source, val)
+			}
+			cur.exclude = b
+		case "lsp":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return errorf("%s: bad lsp %s", source, val)
+			}
+			cur.lsp = b
+		case "pre":
+			if cur.pre, err = splitArgs(val); err != nil {
+				return errorf("%s: %s", source, err)
+			}
+			if len(cur.pre) == 0 {
+				return errorf("%s: empty pre", source)
+			}
+		case "post":
+			if cur.post, err = splitArgs(val); err != nil {
+				return errorf("%s: %s", source, err)
+			}
+			if len(cur.post) == 0 {
+				return errorf("%s: empty post", source)
+			}
+		case "golocal":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return errorf("%s: bad golocal %s", source, val)
+			}
+			cur.goLocal = b
+		case "maxstdin":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n <= 0 {
+				return errorf("%s: bad maxstdin %s", source, val)
+			}
+			cur.maxStdin = n
+		case "jobs":
+			if strings.Count(val, "%d") != 1 || strings.Count(val, "%") != 1 || strings.ContainsAny(val, " \t") {
+				return errorf("%s: bad jobs %s: want one argument containing %%d", source, val)
+			}
+			cur.jobsFlag = val
+		case "nice":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < -20 || n > 19 {
+				return errorf("%s: bad nice %s", source, val)
+			}
+			cur.nice = n
+		case "ionice":
+			if n, err := strconv.Atoi(val); val != "idle" && (err != nil || n < 0 || n > 7) {
+				return errorf("%s: bad ionice %s", source, val)
+			}
+			cur.ionice = val
+		case "offmarker":
+			cur.guardOff = val
+		case "onmarker":
+			cur.guardOn = val
+		case "wrapper":
+			if cur.wrap, err = splitArgs(val); err != nil {
+				return errorf("%s: %s", source, err)
+			}
+			if len(cur.wrap) == 0 {
+				return errorf("%s: empty wrapper", source)
+			}
+		case "cpu":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return errorf("%s: bad cpu %s", source, val)
+			}
+			cur.cpu = n
+		case "mem":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n <= 0 {
+				return errorf("%s: bad mem %s", source, val)
+			}
+			cur.mem = n
+		case "trim":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return errorf("%s: bad trim %s", source, val)
+			}
+			cur.trim = b
+		case "encoding":
+			cur.encoding = val
+		case "host":
+			if cur.hosts = strings.Fields(val); len(cur.hosts) == 0 {
+				return errorf("%s: empty host", source)
+			}
+		default:
+			return errorf("%s: unknown key %s", source, key)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	var excl, host, shared []*rule
+	for _, r := range rules {
+		if r.cmd == nil && !r.exclude {
+			return errorf("%s: no cmd for [%s]", r.source, r.pattern)
+		}
+		switch {
+		case r.exclude && (len(r.hosts) == 0 || onHost(r.hosts)):
+			excl = append(excl, r)
+		case r.exclude:
+		case len(r.hosts) == 0:
+			shared = append(shared, r)
+		case onHost(r.hosts):
+			host = append(host, r)
+		}
+	}
+	rules = append(append(excl, host...), shared...)
+	c.rules = append(rules, c.rules...)
+	c.files = append(c.files, path)
+	return nil
+}
+
+// command returns the command to run for the arguments given to Fmt:
+// if the first is the name of an alias, its command followed by the rest,
+// otherwise the arguments themselves.
+func (c *config) command(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	if cmd, ok := c.aliases[args[0]]; ok {
+		return append(append([]string(nil), cmd...), args[1:]...)
+	}
+	return args
+}
+
+// projectFile is the name of project configuration files.
+const projectFile = ".fmtrc"
+
+// projectFiles returns the project configuration files of the file name,
+// nearest first.
+func projectFiles(name string) []string {
+	var found []string
+	for dir := filepath.Dir(canonical(name)); ; {
+		p := filepath.Join(dir, projectFile)
+		if _, err := os.Stat(p); err == nil {
+			found = append(found, p)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return found
+}
+
+// forFile returns the configuration for the file name:
+// c with the rules of the project configuration files, named .fmtrc,
+// found in the file's directory and its parents.
+// The rules of nearer files take precedence,
+// and those of all project files over those of c.
+func (c *config) forFile(name string) (*config, error) {
+	found := projectFiles(name)
+	if len(found) == 0 {
+		return c, nil
+	}
+	p := &config{
+		rules: append([]*rule(nil), c.rules...),
+		files: append([]string(nil), c.files...),
+	}
+	// Farthest first, so that nearer files take precedence.
+	for i := len(found) - 1; i >= 0; i-- {
+		n := len(p.rules)
+		if err := p.read(found[i]); err != nil {
+			return nil, err
+		}
+		for _, r := range p.rules[:len(p.rules)-n] {
+			r.dir = filepath.Dir(found[i])
+		}
+	}
+	return p, nil
+}
+
+// onHost returns whether the current host is one of hosts,
+// each of which is a full host name or the first component of one.
+func onHost(hosts []string) bool {
+	name, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	short := name
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		short = name[:i]
+	}
+	for _, h := range hosts {
+		if h == name || h == short {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the highest-precedence rule matching the file name,
+// or nil if no rule matches.
+// The rules are matched against the canonical form of the name.
+func (c *config) match(name string) *rule {
+	name = canonical(name)
+	for _, r := range c.rules {
+		n := filepath.Base(name)
+		if strings.Contains(r.pattern, "/") {
+			n = name
+			if r.dir != "" {
+				rel, err := filepath.Rel(r.dir, name)
+				if err != nil {
+					continue
+				}
+				n = rel
+			}
+		}
+		if ok, _ := filepath.Match(r.pattern, n); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// wrapper returns the command and arguments with which to run r.cmd
+// to apply r's priorities and its wrapper command, or nil if r has none.
+// The priorities are outermost, so that they apply to the wrapper too.
+func (r *rule) wrapper() []string {
+	var w []string
+	if r.nice != 0 {
+		w = append(w, "nice", "-n", strconv.Itoa(r.nice))
+	}
+	switch r.ionice {
+	case "":
+	case "idle":
+		w = append(w, "ionice", "-c", "3")
+	default:
+		w = append(w, "ionice", "-c", "2", "-n", r.ionice)
+	}
+	return append(w, r.wrap...)
+}
+
+// fileArgs returns the command of the rule r for the file name,
+// with the arguments added for it that the formatters known to Fmt need:
+// those for its EditorConfig, and those for goimports.
+// Each command of a pipeline or sequence gets its own.
+func fileArgs(r *rule, name string) ([]string, error) {
+	props, err := editorConfig(name)
+	if err != nil {
+		err = errorf("failed to read the EditorConfig: %s", err)
+	}
+	var run []string
+	for k, step := range steps(r.cmd) {
+		if k > 0 {
+			run = append(run, "&&")
+		}
+		for i, alt := range alternatives(step) {
+			if i > 0 {
+				run = append(run, "||")
+			}
+			for j, cmd := range stages(alt) {
+				if j > 0 {
+					run = append(run, "|")
+				}
+				cmd = editorArgs(cmd, props)
+				run = append(run, goimportsArgs(cmd, name, r.goLocal)...)
+			}
+		}
+	}
+	return run, err
+}
+
+// hasFlag returns whether cmd gives the flag, as flag or flag=value.
+func hasFlag(cmd []string, flag string) bool {
+	for _, c := range cmd[1:] {
+		if c == flag || strings.HasPrefix(c, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical returns the cleaned form of the file name
+// with symbolic links resolved, if the file exists,
+// so that the same file reached by different paths matches the same rules.
+func canonical(name string) string {
+	name = filepath.Clean(name)
+	if p, err := filepath.EvalSymlinks(name); err == nil {
+		return p
+	}
+	return name
+}
+
+// fallback returns the command to use for the file name
+// when there is no configuration at all, or nil if there is none.
+// Fmt is mostly used for Go, so Go files get gofmt.
+func (c *config) fallback(name string) []string {
+	if len(c.files) > 0 || filepath.Ext(name) != ".go" {
+		return nil
+	}
+	if root := os.Getenv("GOROOT"); root != "" {
+		p := filepath.Join(root, "bin", "gofmt")
+		if _, err := os.Stat(p); err == nil {
+			return []string{p}
+		}
+	}
+	if p, err := exec.LookPath("gofmt"); err == nil {
+		return []string{p}
+	}
+	return nil
+}
+
+// which writes the command of the rule that matches name to standard output.
+func which(c *config, name string) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if c, err = c.forFile(abs); err != nil {
+		return err
+	}
+	var cmd []string
+	if r := c.match(abs); r != nil && r.exclude {
+		return errorf("%s is excluded by %s", name, r.source)
+	} else if r != nil {
+		if cmd, err = fileArgs(r, abs); err != nil {
+			// Not fatal, as in resolveRule.
+			eprintf("%s\n", err)
+		}
+	} else if cmd = c.fallback(abs); cmd == nil {
+		return errorf("no formatter configured for %s", name)
+	}
+	_, err = os.Stdout.WriteString(strings.Join(cmd, " ") + "\n")
+	return err
+}
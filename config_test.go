@@ -0,0 +1,297 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes text to the file at path, creating its directory.
+func writeConfig(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigRead(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// Want are the patterns and commands of the rules, in order of precedence.
+		want [][2]string
+		// Err, if non-empty, is a substring of the expected error.
+		err string
+	}{
+		{
+			name: "empty",
+			text: "",
+			want: nil,
+		},
+		{
+			name: "comments and blank lines",
+			text: "# Go\n\n[*.go]\n  # gofmt\ncmd = gofmt -s\n",
+			want: [][2]string{{"*.go", "gofmt -s"}},
+		},
+		{
+			name: "later sections first",
+			text: "[*.go]\ncmd = gofmt\n[*.c]\ncmd = clang-format\n",
+			want: [][2]string{{"*.go", "gofmt"}, {"*.c", "clang-format"}},
+		},
+		{
+			name: "exclusions first",
+			text: "[*.go]\ncmd = gofmt\n[gen_*.go]\nexclude = true\n",
+			want: [][2]string{{"gen_*.go", ""}, {"*.go", "gofmt"}},
+		},
+		{
+			name: "quoted arguments",
+			text: "[*.c]\ncmd = clang-format '-style={BasedOnStyle: LLVM}'\n",
+			want: [][2]string{{"*.c", "clang-format -style={BasedOnStyle: LLVM}"}},
+		},
+		{
+			name: "further cmds are further steps",
+			text: "[*.py]\ncmd = isort -\ncmd = black -q -\n",
+			want: [][2]string{{"*.py", "isort - && black -q -"}},
+		},
+		{
+			name: "other hosts ignored",
+			text: "[*.go]\ncmd = gofmt\n[*.go]\nhost = no-such-host.example\ncmd = gofumpt\n",
+			want: [][2]string{{"*.go", "gofmt"}},
+		},
+		{
+			name: "bad pattern",
+			text: "[[]\ncmd = x\n",
+			err:  ":1: bad pattern",
+		},
+		{
+			name: "no equals",
+			text: "[*.go]\ngofmt\n",
+			err:  ":2: expected key = value",
+		},
+		{
+			name: "outside a section",
+			text: "cmd = gofmt\n",
+			err:  ":1: cmd outside of a [pattern] section",
+		},
+		{
+			name: "unknown key",
+			text: "[*.go]\ncommand = gofmt\n",
+			err:  ":2: unknown key command",
+		},
+		{
+			name: "no cmd",
+			text: "[*.go]\nnice = 5\n",
+			err:  ":1: no cmd for [*.go]",
+		},
+		{
+			name: "bad value",
+			text: "[*.go]\ncmd = gofmt\nnice = 99\n",
+			err:  ":3: bad nice 99",
+		},
+		{
+			name: "unclosed quote",
+			text: "[*.go]\ncmd = gofmt 'x\n",
+			err:  ":2:",
+		},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, "config"+string(rune('a'+i)))
+		writeConfig(t, path, test.text)
+		var c config
+		err := c.read(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: read()=%v, want an error containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: read()=%v, want nil", test.name, err)
+			continue
+		}
+		var got [][2]string
+		for _, r := range c.rules {
+			got = append(got, [2]string{r.pattern, strings.Join(r.cmd, " ")})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: rules=%q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConfigForFile(t *testing.T) {
+	dir := canonical(t.TempDir())
+	global := filepath.Join(dir, "config")
+	writeConfig(t, global, "[*.go]\ncmd = gofmt\n[*.c]\ncmd = clang-format\n")
+	writeConfig(t, filepath.Join(dir, "proj", projectFile), "[*.go]\ncmd = gofumpt\n[vendor/*]\nexclude = true\n")
+	writeConfig(t, filepath.Join(dir, "proj", "sub", projectFile), "[*.go]\ncmd = goimports\n")
+	var c config
+	if err := c.read(global); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// Cmd is the command of the matching rule, or exclude.
+		cmd string
+	}{
+		{filepath.Join(dir, "x.go"), "gofmt"},
+		{filepath.Join(dir, "proj", "x.go"), "gofumpt"},
+		{filepath.Join(dir, "proj", "x.c"), "clang-format"},
+		{filepath.Join(dir, "proj", "sub", "x.go"), "goimports"},
+		{filepath.Join(dir, "proj", "sub", "deeper", "x.go"), "goimports"},
+		// The pattern is relative to the directory of the .fmtrc.
+		{filepath.Join(dir, "proj", "vendor", "x.go"), "exclude"},
+		{filepath.Join(dir, "proj", "sub", "vendor", "x.go"), "goimports"},
+	}
+	for _, test := range tests {
+		p, err := c.forFile(test.name)
+		if err != nil {
+			t.Errorf("forFile(%s)=_, %v, want nil", test.name, err)
+			continue
+		}
+		var got string
+		switch r := p.match(test.name); {
+		case r == nil:
+			got = "<none>"
+		case r.exclude:
+			got = "exclude"
+		default:
+			got = strings.Join(r.cmd, " ")
+		}
+		if got != test.cmd {
+			t.Errorf("%s: matched %s, want %s", test.name, got, test.cmd)
+		}
+	}
+	// The global configuration is unchanged.
+	if len(c.rules) != 2 {
+		t.Errorf("the global configuration has %d rules, want 2", len(c.rules))
+	}
+}
+
+func TestConfigAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	writeConfig(t, path, strings.Join([]string{
+		"[alias]",
+		"go = goimports -local=example.com",
+		"py = black -q - | isort -",
+		"c = clang-format '-style={BasedOnStyle: LLVM}'",
+		"[*.go]",
+		"cmd = gofmt",
+	}, "\n"))
+	var c config
+	if err := c.read(path); err != nil {
+		t.Fatalf("read()=%v, want nil", err)
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"go"}, []string{"goimports", "-local=example.com"}},
+		{[]string{"go", "-e"}, []string{"goimports", "-local=example.com", "-e"}},
+		{[]string{"py"}, []string{"black", "-q", "-", "|", "isort", "-"}},
+		{[]string{"c"}, []string{"clang-format", "-style={BasedOnStyle: LLVM}"}},
+		{[]string{"gofmt", "go"}, []string{"gofmt", "go"}},
+	}
+	for _, test := range tests {
+		got := c.command(test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("command(%q)=%q, want %q", test.args, got, test.want)
+		}
+	}
+	// The alias is copied, not appended to.
+	c.command([]string{"go", "-x"})
+	if got := c.command([]string{"go"}); len(got) != 2 {
+		t.Errorf("command(go)=%q after expanding go -x", got)
+	}
+	// Aliases do not need a cmd.
+	if len(c.rules) != 1 {
+		t.Errorf("%d rules, want 1", len(c.rules))
+	}
+}
+
+func TestConfigAliasErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"[alias]\ngo =\n", ":2: empty alias go"},
+		{"[alias]\ngo fmt = gofmt\n", ":2: bad alias name go fmt"},
+		{"[alias]\ngo = gofmt 'x\n", ":2:"},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, "config"+string(rune('a'+i)))
+		writeConfig(t, path, test.text)
+		var c config
+		if err := c.read(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("read(%q)=%v, want an error containing %q", test.text, err, test.err)
+		}
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	run := strings.Fields("a -x | b && | c || d | e &&")
+	tests := []struct {
+		name string
+		f    func([]string) [][]string
+		run  []string
+		want [][]string
+	}{
+		{"steps", steps, run, [][]string{
+			strings.Fields("a -x | b"),
+			strings.Fields("| c || d | e"),
+		}},
+		{"alternatives", alternatives, strings.Fields("| c || d | e"), [][]string{
+			strings.Fields("| c"),
+			strings.Fields("d | e"),
+		}},
+		{"stages", stages, strings.Fields("a -x | b | | c"), [][]string{
+			strings.Fields("a -x"),
+			strings.Fields("b"),
+			strings.Fields("c"),
+		}},
+		{"stages", stages, nil, nil},
+	}
+	for _, test := range tests {
+		if got := test.f(test.run); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s(%q)=%q, want %q", test.name, test.run, got, test.want)
+		}
+	}
+}
+
+func TestResolveImports(t *testing.T) {
+	dir := canonical(t.TempDir())
+	path := filepath.Join(dir, "config")
+	writeConfig(t, path, "[*.go]\ncmd = gofmt\n[*.py]\ncmd = black -q -\n[*.rs]\ncmd = rust-analyzer\nlsp = true\n")
+	var c config
+	if err := c.read(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// Cmd is the resolved command, or error.
+		cmd string
+	}{
+		{filepath.Join(dir, "x.go"), "gopls"},
+		{filepath.Join(dir, "x.rs"), "rust-analyzer"},
+		{filepath.Join(dir, "x.py"), "error"},
+	}
+	for _, test := range tests {
+		j, err := job{imports: true, lsp: true, conf: &c}.resolveRule(test.name)
+		got := strings.Join(j.run, " ")
+		if err != nil {
+			got = "error"
+		}
+		if got != test.cmd {
+			t.Errorf("resolveRule(%s) with -imports ran %s, want %s", test.name, got, test.cmd)
+		}
+	}
+}
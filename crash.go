@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A crashReporter writes a bundle describing a panic or internal error
+// to a directory, to attach to a bug report.
+// The bundle never contains the body unless body is true.
+type crashReporter struct {
+	// Dir is the directory in which bundles are written.
+	// If dir is empty, no bundles are written.
+	dir  string
+	body bool
+	win  fmtharness.Window
+	// Legacy is whether to exit with the legacy status, as -legacy-exit.
+	legacy bool
+}
+
+// recover reports a panic, if any, and exits.
+// It must be called directly by a deferred call.
+func (c *crashReporter) recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	eprintf("panic: %v\n%s", r, debug.Stack())
+	c.report(fmt.Sprintf("panic: %v", r))
+	exit(exitStatus(false, fmt.Errorf("panic: %v", r), c.legacy))
+}
+
+// reportError reports err if it is an internal error,
+// as opposed to a failure of the formatter or a refused apply.
+func (c *crashReporter) reportError(err error) {
+	var fe *fmtharness.FormatterError
+	var re *fmtharness.RefusalError
+	if err == nil || errors.As(err, &fe) || errors.As(err, &re) {
+		return
+	}
+	c.report("error: " + err.Error())
+}
+
+func (c *crashReporter) report(what string) {
+	if c.dir == "" {
+		return
+	}
+	dir := filepath.Join(c.dir, fmt.Sprintf("Fmt-crash-%s-%d", time.Now().Format("20060102-150405"), os.Getpid()))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		eprintf("failed to write the crash report: %s\n", err)
+		return
+	}
+	var s strings.Builder
+	fmt.Fprintf(&s, "%s\n\n", what)
+	fmt.Fprintf(&s, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&s, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&s, "args: %q\n", os.Args[1:])
+	var body []byte
+	if c.win != nil {
+		if name, err := winName(c.win); err == nil {
+			fmt.Fprintf(&s, "window: *%s\n", filepath.Ext(name))
+		}
+		if q0, q1, err := c.win.ReadAddr(); err == nil {
+			fmt.Fprintf(&s, "addr: #%d,#%d\n", q0, q1)
+		}
+		var err error
+		if body, err = fmtharness.ReadBody(c.win); err == nil {
+			fmt.Fprintf(&s, "body: %d bytes, %d runes\n", len(body), utf8.RuneCount(body))
+		}
+	}
+	fmt.Fprintf(&s, "\n%s", debug.Stack())
+	if err := ioutil.WriteFile(filepath.Join(dir, "report"), []byte(s.String()), 0600); err != nil {
+		eprintf("failed to write the crash report: %s\n", err)
+		return
+	}
+	if c.body && body != nil {
+		if err := ioutil.WriteFile(filepath.Join(dir, "body"), body, 0600); err != nil {
+			eprintf("failed to write the crash report: %s\n", err)
+			return
+		}
+	}
+	eprintf("crash report written to %s\n", dir)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// diagRE matches a diagnostic of the form file:line:col: or file:line:
+// at the beginning of a line of formatter output.
+var diagRE = regexp.MustCompile(`^(.*?):([0-9]+):(?:([0-9]+):)?`)
+
+// errorPos returns the line and column of the first diagnostic
+// in the standard error of a formatter.
+// Lines and columns are 1-based, and col is 0 if the diagnostic has no column.
+func errorPos(stderr []byte) (line, col int, ok bool) {
+	s := bufio.NewScanner(bytes.NewReader(stderr))
+	for s.Scan() {
+		m := diagRE.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		line, _ = strconv.Atoi(m[2])
+		if m[3] != "" {
+			col, _ = strconv.Atoi(m[3])
+		}
+		if line > 0 {
+			return line, col, true
+		}
+	}
+	return 0, 0, false
+}
+
+// stdinNames are the names by which formatters refer to their standard input.
+var stdinNames = map[string]bool{
+	"<standard input>": true, // gofmt, goimports
+	"<stdin>":          true,
+	"[stdin]":          true, // prettier
+	"-":                true,
+}
+
+// diagnostics returns the standard error of the formatter of the window named name,
+// with the file names of its diagnostics rewritten so that they can be plumbed:
+// the name of the formatter's standard input is replaced by name,
+// and relative names are made relative to the window's directory
+// instead of that of the formatter.
+func diagnostics(name string, stderr []byte) string {
+	dir := filepath.Dir(name)
+	var b strings.Builder
+	s := bufio.NewScanner(bytes.NewReader(stderr))
+	for s.Scan() {
+		l := s.Text()
+		m := diagRE.FindStringSubmatchIndex(l)
+		if m == nil {
+			b.WriteString(l)
+			b.WriteByte('\n')
+			continue
+		}
+		switch file := l[m[2]:m[3]]; {
+		case stdinNames[file]:
+			l = name + l[m[3]:]
+		case isRelPath(file):
+			l = filepath.Join(dir, file) + l[m[3]:]
+		}
+		if m = diagRE.FindStringSubmatchIndex(l); !render(&b, "diag", parseDiag(l, m)) {
+			b.WriteString(l)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// parseDiag returns the data of the diag template for the diagnostic line l,
+// of which m is the match of diagRE.
+func parseDiag(l string, m []int) diagOutput {
+	d := diagOutput{File: l[m[2]:m[3]], Text: strings.TrimSpace(l[m[1]:])}
+	d.Line, _ = strconv.Atoi(l[m[4]:m[5]])
+	if m[6] >= 0 {
+		d.Col, _ = strconv.Atoi(l[m[6]:m[7]])
+	}
+	return d
+}
+
+// isRelPath returns whether s looks like a relative file name.
+func isRelPath(s string) bool {
+	return s != "" && !filepath.IsAbs(s) && !strings.ContainsAny(s, "<>[] \t")
+}
+
+// showDiagnostics shows the standard error of the formatter of the window named name,
+// rewritten by diagnostics.
+// It is written to w if non-nil; otherwise, for a local window,
+// to the +Errors window of the window's directory; otherwise to standard error.
+func showDiagnostics(win fmtharness.Window, w io.Writer, name string, stderr []byte) {
+	text := diagnostics(name, stderr)
+	if w == nil && isLocal(win) {
+		acme.Err(name, text)
+		return
+	}
+	if w == nil {
+		w = os.Stderr
+	}
+	io.WriteString(w, text)
+}
+
+// showError sets the selection of win to the position of the first diagnostic
+// in the standard error of a failed formatter, and shows it.
+func showError(win fmtharness.Window, stderr []byte) error {
+	if _, _, ok := errorPos(stderr); !ok {
+		return nil
+	}
+	body, err := fmtharness.ReadBody(win)
+	if err != nil {
+		return err
+	}
+	q, _ := errorAddr(string(body), stderr)
+	return fmtharness.ShowAddr(win, q, q)
+}
+
+// errorAddr returns the rune offset in body of the first diagnostic
+// in the standard error of a failed formatter.
+// The column is taken to count bytes, as gofmt's does.
+// Positions past the end of a line or of the body are clamped to it.
+func errorAddr(body string, stderr []byte) (q int, ok bool) {
+	line, col, ok := errorPos(stderr)
+	if !ok {
+		return 0, false
+	}
+	lines := fmtharness.SplitLines(body)
+	if len(lines) == 0 {
+		return 0, true
+	}
+	if line > len(lines) {
+		line = len(lines)
+	}
+	for _, l := range lines[:line-1] {
+		q += utf8.RuneCountInString(l)
+	}
+	if col > 1 {
+		l := lines[line-1]
+		if col-1 < len(l) {
+			l = l[:col-1]
+		}
+		q += utf8.RuneCountInString(l)
+	}
+	return q, true
+}
+
+// defaultMaxStderr is the default size of the largest standard error
+// of a formatter that is shown.
+const defaultMaxStderr = 64 << 10
+
+// A stderrBuffer holds the standard error of a formatter,
+// keeping only its first max bytes, so that a formatter
+// dumping megabytes of output does not flood +Errors.
+// The first lines usually hold the real error.
+type stderrBuffer struct {
+	buf bytes.Buffer
+	// Max is the most bytes kept.
+	max int
+	// Dropped is the number of bytes dropped.
+	dropped int
+}
+
+// Write keeps the bytes of p that fit under the limit.
+// It never fails, so that the formatter is not stopped by its standard error.
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.buf.Len(); len(p) > room {
+		if room < 0 {
+			room = 0
+		}
+		b.dropped += len(p) - room
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Len returns the size of the text returned by Bytes.
+func (b *stderrBuffer) Len() int { return len(b.Bytes()) }
+
+// Bytes returns the kept standard error.
+// If any was dropped, it is cut after its last whole line
+// and followed by a note of how much was dropped.
+func (b *stderrBuffer) Bytes() []byte {
+	if b.dropped == 0 {
+		return b.buf.Bytes()
+	}
+	kept := b.buf.Bytes()
+	dropped := b.dropped
+	if i := bytes.LastIndexByte(kept, '\n'); i >= 0 {
+		dropped += len(kept) - i - 1
+		kept = kept[:i+1]
+	}
+	note := tr("… standard error truncated: %d more bytes dropped\n")
+	return append(append([]byte(nil), kept...), []byte(fmt.Sprintf(note, dropped))...)
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestErrorPos(t *testing.T) {
+	tests := []struct {
+		stderr    string
+		line, col int
+		ok        bool
+	}{
+		{"", 0, 0, false},
+		{"no position here\n", 0, 0, false},
+		{"<standard input>:3:7: expected ';'\n", 3, 7, true},
+		{"x.py:12: bad indent\n", 12, 0, true},
+		{"warning\nx.c:0:1: ignored\nx.c:2:4: error\n", 2, 4, true},
+	}
+	for _, test := range tests {
+		line, col, ok := errorPos([]byte(test.stderr))
+		if line != test.line || col != test.col || ok != test.ok {
+			t.Errorf("errorPos(%q)=%d, %d, %v, want %d, %d, %v",
+				test.stderr, line, col, ok, test.line, test.col, test.ok)
+		}
+	}
+}
+
+func TestErrorAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		stderr string
+		q      int
+		ok     bool
+	}{
+		{
+			name:   "no diagnostic",
+			body:   "a\n",
+			stderr: "failed\n",
+			q:      0,
+			ok:     false,
+		},
+		{
+			name:   "empty body",
+			body:   "",
+			stderr: "<standard input>:1:1: expected 'package', found 'EOF'\n",
+			q:      0,
+			ok:     true,
+		},
+		{
+			name:   "line and column",
+			body:   "ab\ncd\n",
+			stderr: "<standard input>:2:2: error\n",
+			q:      4,
+			ok:     true,
+		},
+		{
+			name:   "line only",
+			body:   "ab\ncd\n",
+			stderr: "x:2: error\n",
+			q:      3,
+			ok:     true,
+		},
+		{
+			name:   "byte column in a multi-byte line",
+			body:   "αβγ\n",
+			stderr: "x:1:5: error\n",
+			q:      2,
+			ok:     true,
+		},
+		{
+			name:   "column past the end of the line",
+			body:   "ab\ncd\n",
+			stderr: "x:1:10: error\n",
+			q:      3,
+			ok:     true,
+		},
+		{
+			name:   "line past the end of the body",
+			body:   "ab\ncd\n",
+			stderr: "x:9:1: error\n",
+			q:      3,
+			ok:     true,
+		},
+		{
+			name:   "line and column past the end of the body",
+			body:   "ab\ncd",
+			stderr: "x:9:9: error\n",
+			q:      5,
+			ok:     true,
+		},
+	}
+	for _, test := range tests {
+		q, ok := errorAddr(test.body, []byte(test.stderr))
+		if q != test.q || ok != test.ok {
+			t.Errorf("%s: errorAddr(%q, %q)=%d, %v, want %d, %v",
+				test.name, test.body, test.stderr, q, ok, test.q, test.ok)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// fmtDir formats on disk the files listed in win, a directory window
+// named dir, whose names match the filepath.Match pattern,
+// with the commands chosen by the configuration,
+// and writes the result for each and a summary to the +Errors window of dir.
+// Files with an open window that is dirty are skipped,
+// since writing them would conflict with the unsaved edits;
+// clean windows of re-written files are reloaded from disk.
+// It returns the number of files that failed to format.
+func fmtDir(win fmtharness.Window, dir, pattern string, j job) (int, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return 0, errorf("bad -dir pattern: %s", err)
+	}
+	body, err := win.ReadAll("body")
+	if err != nil {
+		return 0, errorf("failed to read the body: %s", err)
+	}
+	wins, err := acme.Windows()
+	if err != nil {
+		return 0, errorf("failed to read the acme index: %s", err)
+	}
+	ids := make(map[string]int)
+	for _, wi := range wins {
+		ids[wi.Name] = wi.ID
+	}
+	var out bytes.Buffer
+	t := tally{w: &out}
+	for _, entry := range strings.Fields(string(body)) {
+		if strings.HasSuffix(entry, "/") {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, entry); !ok {
+			continue
+		}
+		name := filepath.Join(dir, entry)
+		id, open := ids[name]
+		if open && dirty(id) {
+			t.printf("%s: skipped: its window has unsaved changes\n", name)
+			continue
+		}
+		changed, err := fmtDisk(name, j)
+		t.add(0, name, changed, err)
+		if changed && open {
+			if err := reload(id); err != nil {
+				t.printf("%s: failed to reload the window: %s\n", name, err)
+			}
+		}
+	}
+	t.finish()
+	acme.Err(dir, out.String())
+	return t.nfailed, nil
+}
+
+// fmtDisk formats the file name on disk as described by j,
+// and returns whether it changed.
+func fmtDisk(name string, j job) (bool, error) {
+	in, err := ioutil.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	j.dir = filepath.Dir(name)
+	out, err := filterText(j, name, in)
+	if err != nil || bytes.Equal(in, out) {
+		return false, err
+	}
+	return true, writeFile(name, out, false)
+}
+
+// dirty returns whether the window with the given ID has unsaved changes.
+// A window whose state cannot be read is taken to be dirty.
+func dirty(id int) bool {
+	w, err := acme.Open(id, nil)
+	if err != nil {
+		return true
+	}
+	defer w.CloseFiles()
+	ctl, err := w.ReadAll("ctl")
+	if err != nil {
+		return true
+	}
+	f := strings.Fields(string(ctl))
+	return len(f) < 5 || f[4] != "0"
+}
+
+// reload reloads the window with the given ID from its file.
+func reload(id int) error {
+	w, err := acme.Open(id, nil)
+	if err != nil {
+		return err
+	}
+	defer w.CloseFiles()
+	return w.Ctl("get")
+}
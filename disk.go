@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// fmtOnDisk formats the file of win on disk as described by j,
+// and reloads the window from it with Get,
+// instead of reading and re-writing the body over 9P,
+// which is far faster for a large file.
+// The window must be clean, and its body the length of the file,
+// so that the file holds what the window shows.
+// The returned bool reports whether the file was re-written.
+func fmtOnDisk(win fmtharness.Window, j job) (bool, error) {
+	name, err := winName(win)
+	if err != nil {
+		return false, errorf("failed to read the window name: %s", err)
+	}
+	if err := writable(win, name); err != nil {
+		return false, err
+	}
+	ctl, err := win.ReadAll("ctl")
+	if err != nil {
+		return false, errorf("failed to read the window ctl: %s", err)
+	}
+	f := strings.Fields(string(ctl))
+	if len(f) < 5 {
+		return false, errorf("failed to read the window ctl: %q", ctl)
+	}
+	if f[4] != "0" {
+		return false, errorf("refusing to format %s on disk: the window has unsaved changes", name)
+	}
+	text, err := ioutil.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	// Comparing the body would read it all; its length is a cheap check
+	// that the file was not changed since the window was loaded.
+	if n, err := strconv.Atoi(f[2]); err != nil || n != utf8.RuneCount(text) {
+		return false, errorf("refusing to format %s on disk: the file differs from the window", name)
+	}
+	q0, q1, err := fmtharness.ReadAddr(win)
+	if err != nil {
+		return false, errorf("failed to get the current selection: %s", err)
+	}
+	j.dir = filepath.Dir(name)
+	out, err := filterText(j, name, text)
+	if err != nil || bytes.Equal(text, out) {
+		return false, err
+	}
+	if err := writeFile(name, out, false); err != nil {
+		return false, err
+	}
+	if err := win.Ctl("get"); err != nil {
+		return true, errorf("failed to reload the window: %s", err)
+	}
+	if err := fmtharness.ShowAddr(win, q0, q1); err != nil {
+		return true, errorf("failed to restore the selection: %s", err)
+	}
+	return true, nil
+}
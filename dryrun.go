@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// dryRun writes to w what formatting win as described by j would run,
+// with the configuration, aliases, and file arguments resolved:
+// the window, each command with its wrapper, the directory, the environment,
+// and the hooks. Nothing is run and the body is not read.
+// With -changed, the base revision is not read from git,
+// since that too would run a command.
+func dryRun(w io.Writer, win fmtharness.Window, j job) error {
+	name, err := winName(win)
+	if err != nil {
+		return errorf("failed to read the window name: %s", err)
+	}
+	changed := j.changed
+	j.changed = false
+	if j, err = j.resolved(name); err != nil {
+		return err
+	}
+	sep := "\t"
+	if plain {
+		sep = " "
+	}
+	fmt.Fprintf(w, tr("Window:%s%d %s\n"), sep, j.id, name)
+	if len(j.pre) > 0 {
+		fmt.Fprintf(w, tr("Pre:%s%s\n"), sep, quoteArgs(j.pre))
+	}
+	switch {
+	case j.blocks:
+		fmt.Fprintf(w, tr("Run:%seach code block with the formatter for its language\n"), sep)
+	case len(j.run) > 0:
+		f := j.command(io.Discard)
+		if len(steps(j.run)) > 1 {
+			for i, step := range f.(fmtharness.Pipeline) {
+				fmt.Fprintf(w, tr("Step %d:%s%s\n"), i+1, sep, describe(step))
+			}
+		} else {
+			fmt.Fprintf(w, tr("Run:%s%s\n"), sep, describe(f))
+		}
+	}
+	if j.trim {
+		fmt.Fprintf(w, tr("Trim:%strailing white space and blank lines\n"), sep)
+	}
+	if changed {
+		fmt.Fprintf(w, tr("Changed:%sonly the lines changed since %s\n"), sep, baseName(j.base))
+	}
+	if j.encoding != "" {
+		fmt.Fprintf(w, tr("Encoding:%s%s, converted with iconv if the text is not UTF-8\n"), sep, j.encoding)
+	}
+	if len(j.post) > 0 {
+		fmt.Fprintf(w, tr("Post:%s%s\n"), sep, quoteArgs(j.post))
+	}
+	dir := j.dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	fmt.Fprintf(w, tr("Dir:%s%s\n"), sep, dir)
+	fmt.Fprintf(w, tr("Env:%s%s\n"), sep, strings.Join(j.acmeEnv(), " "))
+	return nil
+}
+
+// describe returns the command line run by the Formatter f,
+// built by job.command: a command with its wrapper,
+// a pipeline of them separated by |, or a fallback chain separated by ||.
+func describe(f fmtharness.Formatter) string {
+	switch f := f.(type) {
+	case fmtharness.Command:
+		s := quoteArgs(append(f.Wrapper[:len(f.Wrapper):len(f.Wrapper)], f.Args...))
+		if f.MaxStdin > 0 {
+			s += fmt.Sprintf(" [file*%s if over %d bytes]", f.Suffix, f.MaxStdin)
+		}
+		return s
+	case fmtharness.Pipeline:
+		return join(f, " | ")
+	case fmtharness.Fallback:
+		return join(f, " || ")
+	case lspFormatter:
+		return quoteArgs(append(f.wrapper[:len(f.wrapper):len(f.wrapper)], f.server...)) + " (language server)"
+	default:
+		return fmt.Sprintf("%T", f)
+	}
+}
+
+// join returns the descriptions of fs separated by sep.
+func join(fs []fmtharness.Formatter, sep string) string {
+	ds := make([]string, len(fs))
+	for i, f := range fs {
+		ds[i] = describe(f)
+	}
+	return strings.Join(ds, sep)
+}
+
+// baseName returns the name of the git revision base for messages:
+// base, or if it is empty, the index.
+func baseName(base string) string {
+	if base == "" {
+		return "the index"
+	}
+	return base
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// editorConfigFile is the name of EditorConfig files.
+const editorConfigFile = ".editorconfig"
+
+// editorConfig returns the EditorConfig properties of the file name,
+// from the .editorconfig files in its directory and its parents,
+// up to the first with root = true.
+// Property names and values are lower case.
+// Nearer files take precedence over farther ones,
+// and later sections of a file over earlier ones.
+func editorConfig(name string) (map[string]string, error) {
+	name = canonical(name)
+	var files []string
+	for dir := filepath.Dir(name); ; {
+		p := filepath.Join(dir, editorConfigFile)
+		root, err := editorConfigRoot(p)
+		switch {
+		case err == nil:
+			files = append(files, p)
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if root || parent == dir {
+			break
+		}
+		dir = parent
+	}
+	props := make(map[string]string)
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := readEditorConfig(files[i], name, props); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// editorConfigRoot returns whether the EditorConfig file at path
+// has root = true in its preamble.
+func editorConfigRoot(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		key, val, ok := editorConfigPair(line)
+		if ok && key == "root" {
+			return val == "true", nil
+		}
+	}
+	return false, s.Err()
+}
+
+// readEditorConfig sets in props the properties of the sections
+// of the EditorConfig file at path whose globs match the file name.
+// As EditorConfig asks, malformed lines and globs are ignored.
+func readEditorConfig(path, name string, props map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rel, err := filepath.Rel(filepath.Dir(path), name)
+	if err != nil {
+		return nil
+	}
+	rel = filepath.ToSlash(rel)
+	var in bool
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = editorConfigMatch(line[1:len(line)-1], rel)
+			continue
+		}
+		if key, val, ok := editorConfigPair(line); ok && in {
+			props[key] = val
+		}
+	}
+	return s.Err()
+}
+
+// editorConfigPair returns the key and value of an EditorConfig line,
+// in lower case, and whether the line is a key = value pair.
+func editorConfigPair(line string) (key, val string, ok bool) {
+	if line == "" || line[0] == '#' || line[0] == ';' {
+		return "", "", false
+	}
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return "", "", false
+	}
+	key = strings.ToLower(strings.TrimSpace(line[:i]))
+	val = strings.ToLower(strings.TrimSpace(line[i+1:]))
+	return key, val, key != ""
+}
+
+// editorConfigMatch returns whether the EditorConfig glob matches
+// the slash-separated name, relative to the directory of the glob's file.
+// A glob without a slash matches the name in any directory.
+func editorConfigMatch(glob, name string) bool {
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	} else {
+		glob = strings.TrimPrefix(glob, "/")
+	}
+	re, ranges, ok := editorConfigRegexp(glob)
+	if !ok {
+		return false
+	}
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	for i, r := range ranges {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil || n < r[0] || n > r[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// numRange is a {lo..hi} glob.
+var numRange = regexp.MustCompile(`^\{(-?\d+)\.\.(-?\d+)\}`)
+
+// editorConfigRegexp returns the regular expression matching the EditorConfig glob,
+// the bounds of the numeric ranges of its groups, in order,
+// and whether the glob is well formed.
+func editorConfigRegexp(glob string) (*regexp.Regexp, [][2]int, bool) {
+	var ranges [][2]int
+	var b strings.Builder
+	b.WriteString("^")
+	depth := 0
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case c == '{':
+			if m := numRange.FindStringSubmatch(glob[i:]); m != nil {
+				lo, _ := strconv.Atoi(m[1])
+				hi, _ := strconv.Atoi(m[2])
+				ranges = append(ranges, [2]int{lo, hi})
+				b.WriteString(`([+-]?\d+)`)
+				i += len(m[0]) - 1
+				continue
+			}
+			b.WriteString("(?:")
+			depth++
+		case c == ',' && depth > 0:
+			b.WriteString("|")
+		case c == '}' && depth > 0:
+			b.WriteString(")")
+			depth--
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	if depth != 0 {
+		return nil, nil, false
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, nil, false
+	}
+	return re, ranges, true
+}
+
+// editorArgs returns cmd with arguments added for the EditorConfig
+// indent_style, indent_size, tab_width, and max_line_length properties,
+// if cmd is a formatter that Fmt knows how to tell of them.
+// Settings that cmd already gives are left alone,
+// so that the configuration can override the EditorConfig.
+func editorArgs(cmd []string, props map[string]string) []string {
+	if len(cmd) == 0 || len(props) == 0 {
+		return cmd
+	}
+	tabs := props["indent_style"] == "tab"
+	spaces := props["indent_style"] == "space"
+	indent := editorConfigInt(props["indent_size"])
+	if props["indent_size"] == "tab" || indent == 0 && tabs {
+		indent = editorConfigInt(props["tab_width"])
+	}
+	width := editorConfigInt(props["max_line_length"])
+
+	args := cmd[:len(cmd):len(cmd)]
+	add := func(flag string, a ...string) {
+		if !hasFlag(cmd, flag) {
+			args = append(args, a...)
+		}
+	}
+	switch filepath.Base(cmd[0]) {
+	case "clang-format":
+		var style []string
+		if tabs {
+			style = append(style, "UseTab: Always")
+		} else if spaces {
+			style = append(style, "UseTab: Never")
+		}
+		if indent > 0 {
+			style = append(style, "IndentWidth: "+strconv.Itoa(indent))
+			if tabs {
+				style = append(style, "TabWidth: "+strconv.Itoa(indent))
+			}
+		}
+		if width > 0 {
+			style = append(style, "ColumnLimit: "+strconv.Itoa(width))
+		}
+		if len(style) > 0 {
+			add("-style", "-style={"+strings.Join(style, ", ")+"}")
+		}
+	case "shfmt":
+		switch {
+		case tabs:
+			add("-i", "-i", "0")
+		case spaces && indent > 0:
+			add("-i", "-i", strconv.Itoa(indent))
+		}
+	case "prettier":
+		if tabs {
+			add("--use-tabs", "--use-tabs")
+		}
+		if indent > 0 {
+			add("--tab-width", "--tab-width", strconv.Itoa(indent))
+		}
+		if width > 0 {
+			add("--print-width", "--print-width", strconv.Itoa(width))
+		}
+	case "black":
+		if width > 0 {
+			add("--line-length", "--line-length", strconv.Itoa(width))
+		}
+	case "rustfmt":
+		var opts []string
+		if tabs || spaces {
+			opts = append(opts, "hard_tabs="+strconv.FormatBool(tabs))
+		}
+		if indent > 0 {
+			opts = append(opts, "tab_spaces="+strconv.Itoa(indent))
+		}
+		if width > 0 {
+			opts = append(opts, "max_width="+strconv.Itoa(width))
+		}
+		if len(opts) > 0 {
+			add("--config", "--config", strings.Join(opts, ","))
+		}
+	}
+	return args
+}
+
+// editorConfigInt returns the positive integer value of an EditorConfig property,
+// or 0 if it is unset, not a positive integer, or off.
+func editorConfigInt(val string) int {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
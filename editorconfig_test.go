@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditorConfigMatch(t *testing.T) {
+	tests := []struct {
+		glob, name string
+		want       bool
+	}{
+		{"*", "x.go", true},
+		{"*", "a/b/x.go", true},
+		{"*.go", "a/x.go", true},
+		{"*.go", "x.c", false},
+		{"*.{c,h}", "x.h", true},
+		{"*.{c,h}", "x.cc", false},
+		{"{a,b{c,d}}.txt", "bd.txt", true},
+		{"{a,b", "a", false},
+		{"?.go", "x.go", true},
+		{"?.go", "xy.go", false},
+		{"[xy].go", "y.go", true},
+		{"[!xy].go", "y.go", false},
+		{"lib/*.js", "lib/x.js", true},
+		{"lib/*.js", "src/lib/x.js", false},
+		{"/lib/*.js", "lib/x.js", true},
+		{"lib/**.js", "lib/a/b/x.js", true},
+		{"src/**/x.js", "src/x.js", true},
+		{"f{1..10}.txt", "f7.txt", true},
+		{"f{1..10}.txt", "f11.txt", false},
+		{`\*.go`, "*.go", true},
+		{`\*.go`, "x.go", false},
+	}
+	for _, test := range tests {
+		if got := editorConfigMatch(test.glob, test.name); got != test.want {
+			t.Errorf("editorConfigMatch(%q, %q)=%v, want %v", test.glob, test.name, got, test.want)
+		}
+	}
+}
+
+func TestEditorConfig(t *testing.T) {
+	dir := canonical(t.TempDir())
+	// Above the root, so ignored.
+	writeConfig(t, filepath.Join(dir, editorConfigFile), "[*]\nmax_line_length = 10\n")
+	writeConfig(t, filepath.Join(dir, "proj", editorConfigFile), strings.Join([]string{
+		"root = true",
+		"[*]",
+		"indent_style = space",
+		"indent_size = 4",
+		"; a comment",
+		"[*.go]",
+		"indent_style = Tab",
+		"malformed line",
+		"[Makefile]",
+		"indent_style = tab",
+	}, "\n"))
+	writeConfig(t, filepath.Join(dir, "proj", "sub", editorConfigFile), "[*.c]\nindent_size = 2\n")
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{
+			filepath.Join(dir, "proj", "x.go"),
+			map[string]string{"indent_style": "tab", "indent_size": "4"},
+		},
+		{
+			filepath.Join(dir, "proj", "x.c"),
+			map[string]string{"indent_style": "space", "indent_size": "4"},
+		},
+		{
+			filepath.Join(dir, "proj", "sub", "x.c"),
+			map[string]string{"indent_style": "space", "indent_size": "2"},
+		},
+		{
+			filepath.Join(dir, "x.c"),
+			map[string]string{"max_line_length": "10"},
+		},
+	}
+	for _, test := range tests {
+		got, err := editorConfig(test.name)
+		if err != nil {
+			t.Errorf("editorConfig(%s)=_, %v, want nil", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("editorConfig(%s)=%v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEditorArgs(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		props map[string]string
+		want  string
+	}{
+		{
+			cmd:   "gofmt",
+			props: map[string]string{"indent_style": "space", "indent_size": "4"},
+			want:  "gofmt",
+		},
+		{
+			cmd:   "clang-format",
+			props: nil,
+			want:  "clang-format",
+		},
+		{
+			cmd:   "clang-format",
+			props: map[string]string{"indent_style": "tab", "indent_size": "tab", "tab_width": "8", "max_line_length": "100"},
+			want:  "clang-format -style={UseTab: Always, IndentWidth: 8, TabWidth: 8, ColumnLimit: 100}",
+		},
+		{
+			cmd:   "clang-format -style=google",
+			props: map[string]string{"indent_style": "space"},
+			want:  "clang-format -style=google",
+		},
+		{
+			cmd:   "shfmt",
+			props: map[string]string{"indent_style": "space", "indent_size": "2"},
+			want:  "shfmt -i 2",
+		},
+		{
+			cmd:   "shfmt",
+			props: map[string]string{"indent_style": "tab", "indent_size": "2"},
+			want:  "shfmt -i 0",
+		},
+		{
+			cmd:   "/usr/bin/prettier --stdin-filepath x.js",
+			props: map[string]string{"indent_style": "tab", "indent_size": "4", "max_line_length": "off"},
+			want:  "/usr/bin/prettier --stdin-filepath x.js --use-tabs --tab-width 4",
+		},
+		{
+			cmd:   "black -q -",
+			props: map[string]string{"max_line_length": "88"},
+			want:  "black -q - --line-length 88",
+		},
+		{
+			cmd:   "rustfmt",
+			props: map[string]string{"indent_style": "space", "indent_size": "4", "max_line_length": "100"},
+			want:  "rustfmt --config hard_tabs=false,tab_spaces=4,max_width=100",
+		},
+	}
+	for _, test := range tests {
+		cmd := strings.Fields(test.cmd)
+		if got := strings.Join(editorArgs(cmd, test.props), " "); got != test.want {
+			t.Errorf("editorArgs(%q, %v)=%q, want %q", test.cmd, test.props, got, test.want)
+		}
+		if got := strings.Join(cmd, " "); got != test.cmd {
+			t.Errorf("editorArgs(%q, %v) changed its argument to %q", test.cmd, test.props, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// An encoded is a Formatter for text in a legacy encoding,
+// such as latin1 or shift_jis, named as iconv(1) names it.
+// Text that is not valid UTF-8 is converted to UTF-8 for its Formatter,
+// and the output converted back.
+// Valid UTF-8, such as the body of an Acme window,
+// which Acme has already decoded, is formatted as it is.
+type encoded struct {
+	fmtharness.Formatter
+	encoding string
+}
+
+// Format formats the text read from src with e.Formatter,
+// converting it from and back to e.encoding if it is not UTF-8.
+func (e encoded) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if utf8.Valid(text) {
+		return e.Formatter.Format(dst, bytes.NewReader(text))
+	}
+	in, err := iconv(text, e.encoding, "UTF-8")
+	if err != nil {
+		return errorf("failed to convert from %s: %s", e.encoding, err)
+	}
+	var out bytes.Buffer
+	if err := e.Formatter.Format(&out, bytes.NewReader(in)); err != nil {
+		return err
+	}
+	formatted, err := iconv(out.Bytes(), "UTF-8", e.encoding)
+	if err != nil {
+		return errorf("failed to convert the output to %s: %s", e.encoding, err)
+	}
+	_, err = dst.Write(formatted)
+	return err
+}
+
+// iconv returns text converted from one encoding to another by iconv(1).
+// It fails if the text is not valid in the encoding from,
+// or cannot be represented in the encoding to.
+func iconv(text []byte, from, to string) ([]byte, error) {
+	cmd := exec.Command("iconv", "-f", from, "-t", to)
+	cmd.Stdin = bytes.NewReader(text)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errorf("%s", msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A lineEndings is a Formatter that gives its Formatter text
+// with Unix line endings, and ends the lines of the output
+// as the mode says: as the text's were, with "keep",
+// or always with "lf" or "crlf".
+type lineEndings struct {
+	fmtharness.Formatter
+	mode string
+}
+
+// validEOL returns whether mode is a mode of the -crlf flag.
+func validEOL(mode string) bool {
+	return mode == "" || mode == "keep" || mode == "lf" || mode == "crlf"
+}
+
+// Format formats the text read from src with e.Formatter,
+// after stripping the carriage returns that end its lines,
+// and writes the output to dst, with its lines ended as e.mode says.
+func (e lineEndings) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	crlf := e.mode == "crlf" || e.mode == "keep" && dominantCRLF(text)
+	var out bytes.Buffer
+	if err := e.Formatter.Format(&out, bytes.NewReader(toLF(text))); err != nil {
+		return err
+	}
+	formatted := toLF(out.Bytes())
+	if crlf {
+		formatted = bytes.ReplaceAll(formatted, []byte("\n"), []byte("\r\n"))
+	}
+	_, err = dst.Write(formatted)
+	return err
+}
+
+// toLF returns text with each \r\n replaced by \n.
+func toLF(text []byte) []byte {
+	return bytes.ReplaceAll(text, []byte("\r\n"), []byte("\n"))
+}
+
+// dominantCRLF returns whether most lines of text end with \r\n.
+func dominantCRLF(text []byte) bool {
+	ncrlf := bytes.Count(text, []byte("\r\n"))
+	return ncrlf > 0 && 2*ncrlf > bytes.Count(text, []byte("\n"))
+}
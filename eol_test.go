@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A formatFunc is a Formatter that formats with a function of the whole text.
+type formatFunc func(string) string
+
+func (f formatFunc) Format(dst io.Writer, src io.Reader) error {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, f(string(b)))
+	return err
+}
+
+// format returns the output of f formatting text.
+func format(f fmtharness.Formatter, text string) (string, error) {
+	var out bytes.Buffer
+	err := f.Format(&out, strings.NewReader(text))
+	return out.String(), err
+}
+
+func TestLineEndings(t *testing.T) {
+	// Upper mangles text with carriage returns, as some Unix formatters do.
+	upper := formatFunc(func(s string) string {
+		if strings.Contains(s, "\r") {
+			return "saw a carriage return"
+		}
+		return strings.ToUpper(s)
+	})
+	tests := []struct {
+		mode string
+		text string
+		want string
+	}{
+		{"keep", "a\nb\n", "A\nB\n"},
+		{"keep", "a\r\nb\r\n", "A\r\nB\r\n"},
+		{"keep", "a\r\nb\r\nc\n", "A\r\nB\r\nC\r\n"},
+		{"keep", "a\r\nb\nc\n", "A\nB\nC\n"},
+		{"keep", "a\r\nb", "A\r\nB"},
+		{"keep", "", ""},
+		{"lf", "a\r\nb\r\n", "A\nB\n"},
+		{"crlf", "a\nb\n", "A\r\nB\r\n"},
+		{"crlf", "a\r\nb\n", "A\r\nB\r\n"},
+	}
+	for _, test := range tests {
+		got, err := format(lineEndings{Formatter: upper, mode: test.mode}, test.text)
+		if err != nil || got != test.want {
+			t.Errorf("%s: Format(%q)=%q, %v, want %q, nil", test.mode, test.text, got, err, test.want)
+		}
+	}
+}
+
+// failFormatter is a Formatter that always fails.
+type failFormatter struct{}
+
+func (failFormatter) Format(io.Writer, io.Reader) error { return errors.New("failed") }
+
+func TestLineEndingsFormatterFails(t *testing.T) {
+	if _, err := format(lineEndings{Formatter: failFormatter{}, mode: "keep"}, "a\r\n"); err == nil {
+		t.Errorf("Format()=_, nil, want an error")
+	}
+}
+
+func TestValidEOL(t *testing.T) {
+	for _, mode := range []string{"", "keep", "lf", "crlf"} {
+		if !validEOL(mode) {
+			t.Errorf("validEOL(%q)=false, want true", mode)
+		}
+	}
+	for _, mode := range []string{"cr", "CRLF", "dos"} {
+		if validEOL(mode) {
+			t.Errorf("validEOL(%q)=true, want false", mode)
+		}
+	}
+}
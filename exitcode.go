@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// The exit statuses of formatting a window.
+const (
+	// exitUnchanged is the status when the body needed no change.
+	exitUnchanged = 0
+	// exitChanged is the status when the body was reformatted.
+	exitChanged = 1
+	// exitFormatter is the status when the formatter failed.
+	exitFormatter = 2
+	// exitFailed is the status when Fmt failed for another reason,
+	// such as failing to talk to Acme or to read a file.
+	exitFailed = 3
+	// exitRefused is the status when Fmt refused to apply the format,
+	// for example because the body was edited while the formatter ran.
+	exitRefused = 4
+)
+
+// exitStatus returns the exit status of formatting a window,
+// given whether the body changed and the error, if any.
+// If legacy is set, it is 1 for any error and 0 otherwise,
+// as it was before the statuses were distinguished.
+func exitStatus(changed bool, err error, legacy bool) int {
+	var ferr *fmtharness.FormatterError
+	var rerr *fmtharness.RefusalError
+	switch {
+	case legacy && err != nil:
+		return 1
+	case legacy:
+		return 0
+	case errors.As(err, &ferr):
+		return exitFormatter
+	case errors.As(err, &rerr):
+		return exitRefused
+	case err != nil:
+		return exitFailed
+	case changed:
+		return exitChanged
+	}
+	return exitUnchanged
+}
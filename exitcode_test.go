@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+func TestExitStatus(t *testing.T) {
+	ferr := fmt.Errorf("gofmt: %w", &fmtharness.FormatterError{Err: errors.New("exit status 2")})
+	rerr := fmt.Errorf("x.go: %w", &fmtharness.RefusalError{Reason: "the body changed"})
+	other := errors.New("failed to open win")
+	tests := []struct {
+		changed bool
+		err     error
+		legacy  bool
+		want    int
+	}{
+		{false, nil, false, exitUnchanged},
+		{true, nil, false, exitChanged},
+		{false, ferr, false, exitFormatter},
+		{false, rerr, false, exitRefused},
+		{false, other, false, exitFailed},
+		// The error wins over the change.
+		{true, other, false, exitFailed},
+		{true, rerr, false, exitRefused},
+
+		{false, nil, true, 0},
+		{true, nil, true, 0},
+		{false, ferr, true, 1},
+		{false, rerr, true, 1},
+		{true, other, true, 1},
+	}
+	for _, test := range tests {
+		if got := exitStatus(test.changed, test.err, test.legacy); got != test.want {
+			t.Errorf("exitStatus(%v, %v, %v)=%d, want %d", test.changed, test.err, test.legacy, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A fileResult is the outcome of formatting a file on disk.
+type fileResult struct {
+	path      string
+	body      []byte
+	formatted []byte
+	err       error
+}
+
+// files implements Fmt files, formatting files on disk
+// with the commands chosen by the configuration,
+// and returns the exit status.
+func files(conf *config, args []string) int {
+	fs := flag.NewFlagSet("files", flag.ExitOnError)
+	check := fs.Bool("check", false, "list files that need formatting (the default)")
+	diff := fs.Bool("diff", false, "write the diff of each file that needs formatting")
+	write := fs.Bool("write", false, "write the formatted text back to the files")
+	keepMtime := fs.Bool("keepmtime", false, "with -write, keep the modification times of the files")
+	ncpu := fs.Int("j", runtime.GOMAXPROCS(0), "use at most this many CPUs, shared by the formatters run in parallel")
+	fs.Usage = func() {
+		eprintf("Usage: Fmt files [-check | -diff | -write [-keepmtime]] [-j n] <file>... | -\n\nWith -, file names are read one per line from standard input.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !*diff && !*write {
+		*check = true
+	}
+	paths := fs.Args()
+	if len(paths) == 1 && paths[0] == "-" {
+		paths = nil
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if p := strings.TrimSpace(s.Text()); p != "" {
+				paths = append(paths, p)
+			}
+		}
+		if err := s.Err(); err != nil {
+			eprintf("failed to read standard input: %s\n", err)
+			return 1
+		}
+	}
+	if len(paths) == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	if *ncpu < 1 {
+		*ncpu = 1
+	}
+	// Each of the formatters running at once gets an equal share of the CPUs,
+	// if its rule says how to tell it.
+	nworkers := *ncpu
+	if nworkers > len(paths) {
+		nworkers = len(paths)
+	}
+	jobs := *ncpu / nworkers
+	results := make([]fileResult, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < nworkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = formatFile(conf, paths[i], jobs)
+			}
+		}()
+	}
+	for i := range paths {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	status := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			eprintf("%s: %s\n", r.path, r.err)
+			status = 1
+		case bytes.Equal(r.body, r.formatted):
+			continue
+		case *write:
+			if err := writeFile(r.path, r.formatted, *keepMtime); err != nil {
+				eprintf("%s: %s\n", r.path, err)
+				status = 1
+			}
+		case *diff:
+			a, b := fmtharness.SplitLines(string(r.body)), fmtharness.SplitLines(string(r.formatted))
+			fmtharness.Unified(os.Stdout, r.path, r.path+" (formatted)", a, b, fmtharness.Diff(a, b), 3, nil)
+			status = 1
+		case *check:
+			os.Stdout.WriteString(r.path + "\n")
+			status = 1
+		}
+	}
+	return status
+}
+
+// formatFile formats the file at path with the command chosen by the configuration,
+// telling the formatter to use the given number of parallel jobs, if its rule says how.
+func formatFile(conf *config, path string, jobs int) fileResult {
+	r := fileResult{path: path}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	j, err := job{conf: conf, dir: filepath.Dir(abs), jobs: jobs}.resolved(abs)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if r.body, err = ioutil.ReadFile(path); err != nil {
+		r.err = err
+		return r
+	}
+	var out, stderr bytes.Buffer
+	j.stderr = &stderr
+	if err := j.formatter().Format(&out, bytes.NewReader(r.body)); err != nil {
+		r.err = errorf("format failed: %s\n%s", err, strings.TrimSpace(stderr.String()))
+		return r
+	}
+	if out.Len() == 0 && len(r.body) > 0 {
+		r.err = errorf("refusing to write: the formatter output is empty")
+		return r
+	}
+	r.formatted = out.Bytes()
+	return r
+}
+
+// writeFile replaces the contents of the file at path,
+// keeping its mode, owner, and, where supported, extended attributes,
+// and if keepMtime is set, its modification time.
+// The data is written to a temporary file in the same directory,
+// which is then renamed over the file,
+// so that readers never see a partly written file, even if Fmt dies.
+// But if renaming would break the file's other hard links,
+// or lose its owner, or the directory is not writable,
+// the file is re-written in place instead.
+func writeFile(path string, data []byte, keepMtime bool) error {
+	// Replace the file, not a symbolic link to it.
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		return writeInPlace(path, data, fi, keepMtime)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".Fmt")
+	if os.IsPermission(err) {
+		return writeInPlace(path, data, fi, keepMtime)
+	}
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	switch err := copyMeta(tmp, path, fi, keepMtime); {
+	case err == errNotOwner:
+		return writeInPlace(path, data, fi, keepMtime)
+	case err != nil:
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// errNotOwner is returned by copyMeta if it cannot give the file
+// the owner of the original without privileges.
+var errNotOwner = errors.New("cannot change the owner")
+
+// copyMeta gives the file at dst the metadata of the file at src, whose info is fi.
+func copyMeta(dst, src string, fi os.FileInfo, keepMtime bool) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid()) {
+		// Only possible with privileges, or for a group of the user.
+		if err := os.Chown(dst, int(st.Uid), int(st.Gid)); errors.Is(err, syscall.EPERM) {
+			return errNotOwner
+		} else if err != nil {
+			return err
+		}
+	}
+	// After chown, which clears the setuid and setgid bits.
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+	if err := copyXattrs(dst, src); err != nil {
+		// Not fatal. Few programs care about them.
+		eprintf("failed to copy the extended attributes of %s: %s\n", src, err)
+	}
+	if keepMtime {
+		if err := os.Chtimes(dst, time.Now(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInPlace re-writes the contents of the file at path, whose info is fi,
+// which keeps its owner, mode, and links,
+// but leaves it partly written if Fmt dies meanwhile.
+func writeInPlace(path string, data []byte, fi os.FileInfo, keepMtime bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if keepMtime {
+		return os.Chtimes(path, time.Now(), fi.ModTime())
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "x.go")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0640)
+	link := filepath.Join(dir, "link.go")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(link, []byte("new\n"), false); err != nil {
+		t.Fatalf("writeFile()=%v, want nil", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "new\n" {
+		t.Errorf("read %q, %v, want %q", data, err, "new\n")
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the symbolic link was replaced: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("mode=%v, %v, want 0640", fi.Mode(), err)
+	}
+}
+
+func TestWriteFileKeepsHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "x.go")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "y.go")
+	if err := os.Link(path, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, []byte("new\n"), false); err != nil {
+		t.Fatalf("writeFile()=%v, want nil", err)
+	}
+	if data, err := ioutil.ReadFile(other); err != nil || string(data) != "new\n" {
+		t.Errorf("read the other link %q, %v, want %q", data, err, "new\n")
+	}
+}
+
+func TestWriteFileInReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("the directory is writable by root")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "x.go")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+	if err := writeFile(path, []byte("new\n"), false); err != nil {
+		t.Fatalf("writeFile()=%v, want nil", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "new\n" {
+		t.Errorf("read %q, %v, want %q", data, err, "new\n")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// filter formats standard input to standard output as described by j,
+// choosing the command by the file name if j has none.
+// If formatting fails, the input is copied to the output unchanged
+// and the error is returned, so that an editor piping its text
+// through Fmt, such as sam with |Fmt, keeps the original text.
+func filter(j job, name string) error {
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return errorf("failed to read standard input: %s", err)
+	}
+	out, err := filterText(j, name, in)
+	if err != nil {
+		if _, werr := os.Stdout.Write(in); werr != nil {
+			return errorf("failed to write standard output: %s", werr)
+		}
+		return err
+	}
+	if _, err := os.Stdout.Write(out); err != nil {
+		return errorf("failed to write standard output: %s", err)
+	}
+	return nil
+}
+
+// filterFile formats the file at path as described by j,
+// choosing the command by the path if j has none.
+// The file is only re-written if formatting succeeds and changes it.
+func filterFile(j job, path string) error {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	out, err := filterText(j, abs, in)
+	if err != nil || bytes.Equal(in, out) {
+		return err
+	}
+	return writeFile(path, out, j.keepMtime)
+}
+
+// filterText returns text formatted as described by j,
+// choosing the command by the file name if j has none.
+func filterText(j job, name string, text []byte) ([]byte, error) {
+	j, err := j.resolved(name)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := j.formatter().Format(&out, bytes.NewReader(text)); err != nil {
+		return nil, &fmtharness.FormatterError{Err: err}
+	}
+	if out.Len() == 0 && len(text) > 0 {
+		return nil, &fmtharness.RefusalError{Reason: "the formatter output is empty"}
+	}
+	return out.Bytes(), nil
+}
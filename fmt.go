@@ -1,205 +1,1442 @@
 // Fmt is a source code formatting harness for Acme.
 // It is intended to replace Edit ,|myformatter for goimports and other formatters.
-// Fmt must be used from within an Acme buffer or its tag.
-// It takes a single argument: the formatting command to run over the buffer contents.
+// Fmt must be used from within an Acme buffer or its tag,
+// or be told which window to format with the -w or -name flag.
+// Its arguments, if any, are the formatting command to run over the buffer contents,
+// and its flags, described below, choose the window, the mode, and the options.
 // Fmt provides two benefits over Edit ,|myformatter:
 // 1) After formatting it doesn't leave you looking at the top of the buffer,
-// but tries to show you where you were when you clicked Fmt.
-// 2) If the formatter returns in error the buffer contents are left unchanged.
+// but re-writes only the lines that changed, which keeps the same lines on screen,
+// and restores the selection to where it was when you clicked Fmt,
+// or with the -goto-change flag, shows you the first lines that it changed.
+// With the -linecol flag, the selection is restored to the same line and column,
+// rather than the same offset, which better survives changes to earlier lines.
+// 2) If the formatter returns in error the buffer contents are left unchanged,
+// and if it reported the position of the error, as in file:line:col:,
+// the selection is moved there.
+// The formatter's errors are shown in the +Errors window of the file's directory,
+// with their file names made absolute, so that they can be plumbed,
+// even those that the formatter reports for its standard input, such as <standard input>.
+// Only the first 64KiB of the formatter's standard error are shown,
+// or as many bytes as given by the -maxstderr flag.
+// The formatting logic itself lives in package fmtharness,
+// for use by other Acme tools.
+//
+// Without the argument, the command is chosen by the rules
+// of the configuration file $HOME/lib/fmt/config, for example
+//
+//	[*.go]
+//	cmd = goimports
+//
+// A section with a host key, as in host = laptop, applies only on that host,
+// and takes precedence there over the sections without one.
+// A section with exclude = true instead says not to format matching files.
+// Configuration files named .fmtrc in the file's directory and its parents
+// add project rules, taking precedence over those of $HOME/lib/fmt/config,
+// with nearer files taking precedence over farther ones.
+// In a project file, a pattern containing a slash is matched against
+// the file name relative to the directory of the project file.
+// Since a project file names commands to run,
+// only edit files in projects whose .fmtrc files you trust.
+//
+// If there is no configuration file at all, Go files are formatted with gofmt.
+//
+// With the -blocks flag, Fmt instead formats each fenced code block
+// of a document, such as a Markdown README, as in
+//
+//	```go
+//	func main() { fmt.Println("hello") }
+//	```
+//
+// with the command that the rules choose for the block's language,
+// as if it were a file named block.go in the same directory,
+// leaving the prose around the blocks untouched.
+// Likewise, it formats each shell here-document with a quoted delimiter
+// that is redirected to a file, as in cat >main.go <<'EOF',
+// with the command for the file's name extension.
+// With -trim, each block is trimmed after it is formatted.
+// Blocks whose formatter fails are left unchanged and reported.
+//
+// With the -changed flag, Fmt formats only the lines changed since
+// the git revision given by the -base flag, by default HEAD,
+// or with -base= since the index, as git-clang-format does,
+// keeping formatting changes to untouched lines out of the diff.
+//
+// With the -lsp flag, or the lsp = true key of a configuration section,
+// the command is instead a language server, such as gopls -remote=auto,
+// that Fmt asks to format the text with a textDocument/formatting request
+// of the Language Server Protocol. Fmt applies the edits that it returns
+// and re-writes only the changed lines, as for other commands.
+// The -imports flag also asks the server to organize the imports
+// with its source.organizeImports code action before formatting.
+// Without a command, -imports uses the configured command
+// if it is a language server, and otherwise, for a Go file, gopls;
+// for other files it is an error.
+// A server that has not finished in the -readtimeout, or by default two minutes,
+// is killed.
+//
+// The [alias] section of the configuration file names commands,
+// so that Fmt go in a tag can run a longer command:
+//
+//	[alias]
+//	go = goimports -local=example.com
+//	py = black -q - | isort -
+//
+// A section headed [profile name] instead defines a profile,
+// a bundle of settings for a way of working, chosen by the -p flag.
+// Its flags key gives flags of Fmt, which those on the command line override,
+// its cmd key the command to run if none is given,
+// and its pre and post keys hooks that replace those of the rules:
+//
+//	[profile strict]
+//	flags = -fixpoint 3 -trim -confirm
+//	post = go vet
+//
+// As in the py alias, a command, whether of an alias or a cmd key,
+// may be a pipeline of commands separated by |.
+// It may also be a sequence of steps separated by &&, as in isort - && black -,
+// each formatting the output of the step before it,
+// so that the body is changed only if every step succeeds.
+// A section with several cmd keys runs them in order, in the same way.
+// It may also be a fallback chain of commands separated by ||,
+// as in goimports || gofmt, in which each command is tried
+// only if those before it are not installed,
+// so that the same configuration or tag works on machines with different tools.
+// A command counts as not installed if it is not found,
+// or if it exits with status 127, as a wrapper does that cannot find it.
+//
+// For formatters that it knows, clang-format, shfmt, prettier, black, and rustfmt,
+// Fmt adds arguments for the indent_style, indent_size, and max_line_length
+// of the file's .editorconfig files, unless the cmd already gives them,
+// so that the indentation need not be configured twice.
+// Likewise, goimports is given -srcdir with the file name,
+// so that it resolves imports against the file's module,
+// and, with golocal = true, -local with the module path from go.mod.
+//
+// Some formatters, or pipelines of them, are not idempotent,
+// changing their own output when run again.
+// The -fixpoint flag re-runs the command on its own output,
+// at most the given number of times, until the output stops changing,
+// and warns if it never does.
+//
+// The -trim flag tidies the formatter's output:
+// it strips the trailing white space of each line,
+// removes the blank lines at the end of the text,
+// and ends the last line with a newline.
+// Given no command, Fmt -trim does only that, running no formatter.
+//
+// As Acme does for the commands that it runs, Fmt sets $% and $samfile
+// to the file name and $winid to the window's ID in the formatter's environment,
+// for wrapper scripts that use them.
+//
+// Files with Windows line endings confuse many formatters.
+// With -crlf keep, the carriage returns are stripped
+// from the text given to the formatter and, if most lines of the body
+// ended with them, put back on the lines of its output.
+// With -crlf lf or -crlf crlf, the output's lines end that way instead,
+// converting the file.
+//
+// Text that is not valid UTF-8, such as that of a legacy file
+// formatted on disk by Fmt files, is converted for the formatter
+// from the encoding, such as latin1 or shift_jis,
+// given by the encoding key of its rule or the -encoding flag,
+// and its output converted back, using iconv(1).
+// The body of an Acme window is always UTF-8, so it is never converted.
+//
+// A region of the text from a comment line holding only fmt:off
+// through the next comment line holding only fmt:on, as in
+//
+//	// fmt:off
+//	var identity = []int{
+//		1, 0,
+//		0, 1,
+//	}
+//	// fmt:on
+//
+// is kept byte-for-byte as it was, even if the formatter changes it.
+// A region without fmt:on runs to the end of the text, with a warning.
+// The offmarker and onmarker keys of a section give other markers.
+//
+// The wrapper key of a section gives a command that runs the formatter,
+// given as its final arguments, such as a sandbox, as in
+//
+//	[*.js]
+//	cmd = node_modules/.bin/prettier --stdin-filepath x.js
+//	wrapper = firejail --quiet --net=none
+//
+// The -cpu and -mem flags, or the cpu and mem keys of a section,
+// limit the CPU time of the formatter in seconds
+// and its address space in bytes, using prlimit(1),
+// and Fmt reports which limit a formatter that fails has hit.
+//
+// The pre and post keys of a section give hook commands to run
+// before formatting a window and after formatting it successfully,
+// with $fmtfile set to the file name and, for post, $fmtchanged
+// set to 1 if the body changed and 0 if not.
+//
+// Fmt which <file> prints the command that the rules choose for the file.
+//
+// Fmt also has subcommands, which take the flags of a format after their names:
+// Fmt run formats the window, as does Fmt with no subcommand;
+// Fmt check formats it without changing the body and prints the window's name
+// if formatting would change it, exiting with status 1;
+// Fmt diff instead prints the diff of the change;
+// Fmt daemon is Fmt -listen; and Fmt restore is Fmt -restore.
+//
+// Fmt talks to the Acme serving the name space $NAMESPACE,
+// or the default name space if it is unset;
+// the -ns flag selects a different name space directory,
+// for example when running several instances of Acme.
+// Like Acme, if $NAMESPACE is unset, Fmt derives the name space from $USER and $DISPLAY,
+// so Fmt run from another display or session may not find Acme;
+// if so, it says which name space it looked in.
+// The -a flag instead dials an Acme whose 9P service is exported
+// over the network, given as a dial string such as tcp!host!port.
+// The -edwood flag adapts Fmt to Edwood's implementation of the file system,
+// in every mode that formats windows.
+//
+// Run outside of Acme, where $winid is not set, Fmt is a filter
+// from standard input to standard output, for use in Makefiles, git hooks,
+// and with sam's | command, as in ,|Fmt gofmt.
+// If the formatter fails, Fmt copies its input to its output unchanged
+// and exits with a non-zero status.
+// With the -file flag, Fmt instead formats the named file in place,
+// re-writing it only if the formatter succeeds.
+// Files re-written on disk keep their mode, owner, and extended attributes,
+// and with the -keepmtime flag, their modification time.
+// But if the file is open in an Acme window, Fmt formats the window.
+// The rules choose the command by the -file name or, under sam, by $samfile.
+//
+// Fmt files formats files on disk, in parallel, with the commands chosen by the rules.
+// It lists the files that need formatting, or with -diff prints their diffs,
+// or with -write re-writes them. The -j flag limits the CPUs that it uses.
+// Given the argument -, it reads
+// the file names one per line from standard input, as in
+//
+//	git ls-files '*.go' | Fmt files -write -
+//
+// Fmt git formats the open windows of the files changed in the git repository
+// of the current directory, or of the directory given as its argument:
+// those that differ from HEAD, staged or not, and those that are untracked.
+// With the -disk flag, it also re-writes on disk the changed files with no window.
+// It reports the result for each file and a summary,
+// and Fmt -next then visits the windows, as after Fmt -all.
+//
+// With the -onput flag, Fmt stays resident, watching the Acme log,
+// and formats each window matching the -match regexp after it is Put.
+// If formatting changed the body, the window is Put again.
+// If the configuration file changes, it is reloaded before the next format,
+// which is noted in the +Errors window.
+// With the -tag flag, it also adds the given text, such as " Fmt",
+// to the tag of each new window whose file a rule matches,
+// so that Fmt is a click away.
+//
+// With the -listen flag, Fmt serves requests on the Unix socket $NAMESPACE/fmt,
+// so that other programs can format windows.
+// Each request is a line of the form
+//
+//	format <winid> [<cmd> [<arg>...]]
+//
+// answered by a line beginning with ok or error.
+// The command may be an alias, and the configuration applies as for Fmt itself.
+// A request without a command repeats the command last given for the window's file,
+// or if there is none, runs that chosen by the rules.
+//
+// With the -plumb flag, Fmt stays resident, reading messages from the plumber's
+// fmt port, and formats the file named by each, in its window if it has one,
+// and otherwise on disk, with the command given to Fmt, or that of
+// the message's cmd attribute, or that chosen by the rules.
+// Other tools can then ask for a format with plumb -d fmt file.go,
+// and a plumbing rule such as
+//
+//	type is text
+//	data matches 'fmt:([^ ]+)'
+//	data set $1
+//	plumb to fmt
+//
+// formats a file when fmt:file.go is clicked with button 3.
+//
+// With the -all flag, Fmt formats every open window whose name matches
+// the given regexp, reporting a summary line for each window.
+// Afterwards, each Fmt -next shows the next window that failed to format,
+// or if none failed, the next window that changed, cycling through them.
+//
+// With the -preview flag, Fmt leaves the body unchanged and instead
+// opens a window showing the diff that formatting would make,
+// headed by the command, tool, and directory that produced it.
+// Changes only to white space are shown with visible markers.
+// Fmt serve-diff serves the diff as a web page, by default at a local address
+// that it prints, for review by someone without a view of the screen.
+// The -confirm flag shows the diff in the same way, but adds Apply and Discard
+// to the tag of the diff window: Apply makes the change, unless
+// the body was edited in the meantime, and Discard deletes the diff window.
+// Until then, the window is locked against other runs of Fmt.
+// With the -n flag, Fmt runs nothing and leaves the body unchanged,
+// but prints what formatting the window would run:
+// each command as resolved from the configuration, aliases, and file arguments,
+// with its wrapper, and the directory, environment, and hooks.
+//
+// With the -resident flag, Fmt stays attached to the window,
+// adds Fmt to its tag, and formats the window each time Fmt is executed there.
+// Executing Fmt with arguments changes the command used from then on.
+// Arguments containing spaces can be quoted as in rc(1),
+// as in Fmt clang-format '-style={BasedOnStyle: LLVM}',
+// and likewise in control requests and configuration files.
+// The command is remembered by file name in $HOME/lib/fmt/last,
+// so that a later Fmt -resident without arguments repeats it,
+// even after restarting Acme.
+// While resident, whether with -resident, -onput, or -listen,
+// Fmt remembers the bodies that it has formatted,
+// and does not run the formatter again on a body that is unchanged since.
+//
+// Each format applied to a window is recorded under a label
+// made of the tool name and the time, for example gofmt@15:04:05.
+// Fmt -labels lists the recorded labels of the current window,
+// and Fmt -undo label reverts the format with that label,
+// if the text that it changed has not since been edited.
+// Fmt -revert reverts only the edits of the most recent format
+// that intersect the selection, keeping the rest.
+// Fmt -changes lists the lines changed by the most recent format
+// as addresses of the form file:line,line,
+// which can be clicked in +Errors to step through the changes.
+// Fmt stats summarizes the recorded formats of the files in a project,
+// the git repository of the current directory or of the one given:
+// how often each file was reformatted, by how many lines on average,
+// and how long each formatter took, slowest first.
+// Independently of Acme's Undo and of the history,
+// Fmt backs up the body and selection of a window before each format,
+// with the other files it keeps about the window, and Fmt -restore puts them back.
+// Bodies larger than the -backupmax flag, in bytes, are not backed up.
+//
+// With the -crash flag, panics and internal errors write a report
+// to the given directory for inclusion in a bug report.
+// The report describes the invocation, the window's file extension,
+// the sizes of the body and selection, and the stack,
+// but includes the body itself only with the -crashbody flag.
+//
+// Fmt keeps its scratch files in the directory $TMPDIR/Fmt-<user>-<pid>,
+// which it removes on exit, and on startup it removes those left behind
+// by runs that died.
+// The files that it keeps about windows from one run to the next,
+// such as their format histories and backups, are in $TMPDIR/Fmt-<user>,
+// readable only by the user, in a directory for each Acme,
+// named by its name space or -a dial string.
+// The -tmpdir flag puts all of them in another directory instead,
+// or given mem, on Linux, in the memory-backed /dev/shm,
+// so that the text being formatted is never written to a disk,
+// and sets $TMPDIR to it for the commands that Fmt runs.
+// With -tmpdir mem, the -crashbody flag is refused,
+// as it would write the body to the -crash directory.
+//
+// Operations on the window that fail transiently, interrupted or hung up,
+// as they now and then do while Acme is busy,
+// are retried twice, after 10 and 20 milliseconds.
+//
+// Some tools ignore standard input, and so would never finish.
+// With the -readtimeout flag, if the formatter reads none of its standard input
+// and writes nothing for as long as the flag gives, such as 10s,
+// Fmt kills it and suggests giving it a file with the maxstdin key.
+// By default, Fmt waits for the formatter however long it takes.
+// This is only detected on Linux.
+//
+// The -v flag traces to standard error the control messages,
+// address reads and writes, and writes of the window,
+// and each command run, with its arguments, directory, and time taken.
+// The -vv flag also traces reads of the window's files,
+// and the -vlog flag appends the trace to a file instead.
+//
+// The -plain flag makes the windows and summaries that Fmt writes
+// avoid symbols and column alignment and give one fact per line,
+// for use with screen readers and narrow fonts.
+//
+// The output of Fmt -all, Fmt -changes, and the formatter's diagnostics
+// can be rendered instead by Go text/templates named result, summary, change, and diag,
+// defined in $HOME/lib/fmt/templates, for example
+//
+//	{{define "result"}}{{.Status}}	{{.Name}}
+//	{{end}}
+//
+// Messages are translated for the locale given by $LC_ALL, $LC_MESSAGES, or $LANG
+// using the catalog $HOME/lib/fmt/messages.<locale>, if it exists.
+// Each line of a catalog is a pair of Go-quoted strings:
+// a message format string followed by its translation.
+//
+// The -time flag prints how long Fmt took to read the body, run the formatter,
+// compare its output with the body, and re-write the body,
+// and the sizes of the body and the output, to tell whether
+// a slow format is the formatter's fault or that of the transfers with Acme.
+// The body is read as the formatter consumes it, so those times overlap.
+//
+// Formatting a window, Fmt exits with status 0 if the body needed no change,
+// 1 if it was reformatted, 2 if the formatter failed,
+// 3 if Fmt failed for another reason, such as failing to talk to Acme,
+// and 4 if it refused to apply the format,
+// for example because the body was edited while the formatter ran,
+// and the refusal was not resolved at the prompt.
+// With the -legacy-exit flag, it exits with status 1 for any failure
+// and 0 otherwise, as it used to.
+//
+// The -json flag prints the result to standard output as a JSON object,
+// for scripts and editor wrappers, with the fields
+// name, changed, hunks, added, and deleted, for the lines changed,
+// status, the formatter's exit status, or -1 if it did not exit,
+// duration, in seconds, diagnostics, the lines of its standard error,
+// and error, if the format failed.
+//
+// With the -disk flag, Fmt formats the window's file on disk
+// and reloads the window with Get, instead of reading the body
+// and re-writing it, which is far faster for a large file.
+// The window must have no unsaved changes, and Undo cannot revert the format.
+//
+// Before formatting a body of over 16MiB, Fmt warns instead,
+// as the formatter may take minutes;
+// running Fmt again within 10 seconds formats it.
+// The -large flag sets the size in bytes, or with 0, turns the warning off.
+//
+// A body of up to 4MiB and the formatter's output for it are held in memory.
+// A larger body and its output are written to temporary files instead,
+// and are never read back into memory, so the whole body is re-written,
+// -goto-change shows the first line that changed, and the format
+// cannot -merge edits, is not recorded for -undo, and is not backed up.
+// The -maxmem flag sets the size in bytes at which to switch,
+// trading memory for speed.
+//
+// The -keep flag keeps the file holding the formatter's output,
+// even if the formatter fails, and prints its name,
+// for inspecting exactly what the formatter wrote.
+// The file is kept with the files that Fmt keeps about the window,
+// described above, so it is readable only by the user.
+//
+// If the body is edited while the formatter runs, Fmt refuses the format
+// rather than lose the edits, or with the -merge flag, merges the edits
+// with the formatted text, marking any conflicts in the body.
+//
+// A single Undo reverts the whole format,
+// or with the -hunkundo flag, each changed hunk is a separate Undo step.
+//
+// With the -dir flag, run in a directory window, Fmt instead formats on disk
+// the files listed in the window whose names match the given pattern,
+// such as *.go, with the commands chosen by the rules.
+// It skips files whose windows have unsaved changes,
+// reloads the windows of the others that it changes,
+// and reports the result for each file in the +Errors window.
+//
+// Fmt does not format directory windows or the windows of read-only files.
+// A window is formatted by one Fmt at a time;
+// while a format is in progress, another Fmt of the window fails.
+// If the formatter runs for more than a second,
+// Fmt… is shown in the window's tag until it is done.
+//
+// The -legacy flag restores the behavior of Fmt before configuration,
+// for scripts that depend on it: Fmt -legacy <cmd> [<arg>...]
+// takes no other flags, formats the window $winid, the command must be given,
+// its output replaces the whole body, even if empty, and nothing
+// is recorded for -undo or -restore.
+//
+// If Fmt refuses to apply the formatted output, for example because
+// it is empty, it opens a prompt window offering to Retry, Force
+// the apply anyway, show the Diff, or Cancel.
+// With -json, check, or diff, it only reports the refusal.
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"9fans.net/go/acme"
+	"9fans.net/go/plan9/client"
+	"github.com/eaburns/Fmt/fmtharness"
 )
 
-type bodyReader struct{ *acme.Win }
+// A job describes how to format a window.
+type job struct {
+	// ID is the window's ID, which keys its format history.
+	id int
+	// Dir is the directory in which to run the command.
+	// If empty, the command is run in the current directory.
+	dir string
+	// Run is the formatting command and its arguments.
+	// If empty, the command is chosen by the configuration rules.
+	run []string
+	// Conf is the configuration.
+	conf *config
+	// Jobs, if positive, is the number of parallel jobs for the command,
+	// given to it by jobsFlag, as in -j%d, if jobsFlag is non-empty.
+	jobs     int
+	jobsFlag string
+	// Wrapper is the command that runs the command, if any,
+	// such as nice -n 10.
+	wrapper []string
+	// CPULimit and MemLimit, if positive, limit the CPU time of the command
+	// in seconds and its address space in bytes.
+	cpuLimit int
+	memLimit int64
+	// MaxStdin is the size of the largest text to give the command on standard input,
+	// or 0 if there is no limit.
+	maxStdin int64
+	// Suffix is the file name extension of the text.
+	suffix string
+	// LSP is whether the command is a language server,
+	// to be asked to format the text by the Language Server Protocol.
+	lsp bool
+	// Imports is whether to ask the language server to organize imports
+	// before formatting.
+	imports bool
+	// File is the name of the file whose text is formatted.
+	file string
+	// GuardOff and GuardOn are the markers of the regions of the text
+	// to keep as they were. If empty, they are fmt:off and fmt:on.
+	guardOff, guardOn string
+	// Changed, if set, formats only the lines changed since the git revision base,
+	// or since the index if base is empty.
+	changed bool
+	base    string
+	// BaseText is the text of the file in the revision base.
+	baseText []byte
+	// Blocks formats the fenced code blocks of the text,
+	// each with the command chosen by the configuration for its language,
+	// instead of the whole text.
+	blocks bool
+	// Fixpoint, if greater than 1, is the most times to run the command,
+	// re-running it on its own output until the output stops changing.
+	fixpoint int
+	// EOL is the mode of the -crlf flag: how line endings are
+	// normalized for the command and set in its output, if at all.
+	eol string
+	// Trim tidies the trailing white space and blank lines of the output.
+	// With no command, it is the whole format.
+	trim bool
+	// Encoding, if non-empty, is the encoding of text that is not UTF-8,
+	// which is converted to UTF-8 for the command and back.
+	encoding string
+	// Pre and Post are the hook commands run before formatting a window
+	// and after formatting it successfully, if any.
+	pre, post []string
+	// Force applies the formatted output even if a check refuses it.
+	force bool
+	// GotoChange selects the first change instead of restoring the selection.
+	gotoChange bool
+	// UndoPerHunk makes each changed hunk a separate Undo step.
+	undoPerHunk bool
+	// KeepMtime keeps the modification time of files re-written on disk.
+	keepMtime bool
+	// LineCol restores the selection by line and column instead of by offset.
+	lineCol bool
+	// Merge merges edits made while the command ran instead of refusing the format.
+	merge bool
+	// ReadTimeout, if positive, is how long the command may leave
+	// its standard input unread, producing nothing, before it is killed.
+	readTimeout time.Duration
+	// Report, if non-nil, is filled in with the result of formatting a window.
+	report *report
+	// Keep keeps the file holding the output of the command and prints its name.
+	keep bool
+	// Timing prints the time taken by each step of formatting.
+	timing bool
+	// MaxStderr is the size of the largest standard error of the command shown,
+	// or if 0, defaultMaxStderr.
+	maxStderr int
+	// BackupMax is the size of the largest body backed up before formatting.
+	backupMax int64
+	// Stderr receives the standard error of the command.
+	// If nil, it goes to the standard error of Fmt.
+	stderr io.Writer
+	// Cache, if non-nil, remembers the bodies already formatted,
+	// so that formatting them again is skipped.
+	cache *fmtCache
+}
+
+// resolved returns the job with the command chosen by the configuration
+// for the file name, if the job has no command.
+func (j job) resolved(name string) (job, error) {
+	j, err := j.resolveRule(name)
+	if err == nil && j.conf != nil && j.conf.profile != nil {
+		p := j.conf.profile
+		if p.pre != nil {
+			j.pre = p.pre
+		}
+		if p.post != nil {
+			j.post = p.post
+		}
+	}
+	return j, err
+}
 
-func (r bodyReader) Read(data []byte) (int, error) {
-	return r.Win.Read("body", data)
+// resolveRule returns j for formatting the file name,
+// with the command and settings of the rule that matches it.
+func (j job) resolveRule(name string) (job, error) {
+	j.file = name
+	if j.changed {
+		var err error
+		if j.baseText, err = gitBase(name, j.base); err != nil {
+			return j, err
+		}
+	}
+	if j.blocks && len(j.run) > 0 {
+		return j, errorf("the command for each code block is chosen by its language; give no command")
+	}
+	if j.blocks {
+		return j, nil
+	}
+	if len(j.run) > 0 {
+		return j, j.checkLSP()
+	}
+	if j.trim {
+		// Just trimming.
+		return j, nil
+	}
+	j.suffix = filepath.Ext(name)
+	conf, err := j.conf.forFile(name)
+	if err != nil {
+		return j, errorf("failed to load the project configuration: %s", err)
+	}
+	r := conf.match(name)
+	if r != nil && r.exclude {
+		return j, errorf("%s is excluded by %s", name, r.source)
+	}
+	if r != nil {
+		j.run, j.maxStdin, j.wrapper, j.jobsFlag, j.lsp = r.cmd, r.maxStdin, r.wrapper(), r.jobsFlag, r.lsp
+		j.pre, j.post = r.pre, r.post
+		j.guardOff, j.guardOn = r.guardOff, r.guardOn
+		if j.cpuLimit == 0 {
+			j.cpuLimit = r.cpu
+		}
+		if j.memLimit == 0 {
+			j.memLimit = r.mem
+		}
+		if j.encoding == "" {
+			j.encoding = r.encoding
+		}
+		j.trim = r.trim
+		if j.run, err = fileArgs(r, name); err != nil {
+			// Not fatal. The formatter just uses its own defaults.
+			eprintf("%s\n", err)
+		}
+		if j.imports && !r.lsp {
+			// gopls organizes only Go imports.
+			if filepath.Ext(name) != ".go" {
+				return j, errorf("-imports needs a language server, but %s configures %s", r.source, quoteArgs(r.cmd))
+			}
+			j.run, j.lsp = importsServer, true
+		}
+		return j, j.checkLSP()
+	}
+	if j.run = conf.fallback(name); j.run != nil && j.imports {
+		j.run, j.lsp = importsServer, true
+		return j, nil
+	}
+	if j.run != nil {
+		eprintf("no configuration, so using gofmt; to use goimports instead, add to %s:\n\t[*.go]\n\tcmd = goimports\n", configPath())
+		return j, nil
+	}
+	return j, errorf("no formatter configured for %s", name)
 }
 
-type countReader struct {
-	count int
-	r     io.Reader
+// importsServer is the language server asked to organize imports
+// when the command chosen by the configuration is not a language server.
+var importsServer = []string{"gopls"}
+
+// defaultReadTimeout is the default of the -readtimeout flag:
+// formatters are not killed for leaving their input unread,
+// as a slow one cannot be told from one that never reads.
+const defaultReadTimeout time.Duration = 0
+
+// defaultMaxMemory is the default size of the largest body
+// for which the formatter's output is held in memory.
+const defaultMaxMemory = 4 << 20
+
+// checkLSP returns an error if the job's command is a language server
+// in a pipeline or a fallback chain, which Fmt does not support.
+func (j job) checkLSP() error {
+	if j.lsp && (len(stages(j.run)) > 1 || len(alternatives(j.run)) > 1 || len(steps(j.run)) > 1) {
+		return errorf("a language server cannot be part of a pipeline or fallback chain")
+	}
+	return nil
 }
 
-func (r *countReader) Read(data []byte) (int, error) {
-	n, err := r.r.Read(data)
-	r.count += n
-	return n, err
+// formatter returns the Formatter that runs the job's command,
+// re-running it to a fixpoint or applying only its changes to changed lines
+// if the job says to, and keeping the guarded regions of the text as they were.
+// A command containing && arguments is a sequence of the steps between them,
+// each formatting the output of the one before.
+// A step containing || arguments is a fallback chain
+// of the alternative commands between them, each tried in turn
+// if those before it are not installed.
+// A command containing | arguments is a pipeline of the commands between them;
+// the priorities apply to each, but the jobs argument and the limit
+// on standard input only to the first.
+func (j job) formatter() fmtharness.Formatter {
+	stderr := j.stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	if j.blocks {
+		j.stderr = stderr
+		return j.normalized(blockFormatter{j})
+	}
+	var f fmtharness.Formatter
+	if len(j.run) > 0 {
+		f = j.command(stderr)
+	}
+	if j.trim {
+		f = trimmed{f}
+	}
+	if j.fixpoint > 1 {
+		f = fmtharness.Fixpoint{Formatter: f, Max: j.fixpoint, Stderr: stderr}
+	}
+	if j.changed {
+		f = changedOnly{Formatter: f, base: j.baseText}
+	}
+	g := guarded{Formatter: f, off: j.guardOff, on: j.guardOn, stderr: stderr}
+	if g.off == "" {
+		g.off = defaultGuardOff
+	}
+	if g.on == "" {
+		g.on = defaultGuardOn
+	}
+	return j.normalized(g)
 }
 
-type countWriter struct {
-	count int
-	w     io.Writer
+// normalized returns f, wrapped to normalize line endings
+// and convert the encoding of the text if the job says to.
+func (j job) normalized(f fmtharness.Formatter) fmtharness.Formatter {
+	if j.eol != "" {
+		f = lineEndings{Formatter: f, mode: j.eol}
+	}
+	if j.encoding != "" {
+		f = encoded{Formatter: f, encoding: j.encoding}
+	}
+	return f
 }
 
-func (w *countWriter) Write(data []byte) (int, error) {
-	n, err := w.w.Write(data)
-	w.count += n
-	return n, err
+// command returns the Formatter that runs the job's command once,
+// with its standard error going to stderr.
+func (j job) command(stderr io.Writer) fmtharness.Formatter {
+	wrapper := append(limitWrapper(j.cpuLimit, j.memLimit), j.wrapper...)
+	if j.lsp {
+		return lspFormatter{server: j.run, wrapper: wrapper, dir: j.dir, file: j.file, env: j.acmeEnv(), imports: j.imports, stderr: stderr, timeout: j.readTimeout}
+	}
+	var seq fmtharness.Pipeline
+	for _, step := range steps(j.run) {
+		var f fmtharness.Fallback
+		for _, alt := range alternatives(step) {
+			var p fmtharness.Pipeline
+			for _, args := range stages(alt) {
+				c := fmtharness.Command{
+					Args:    args,
+					Wrapper: wrapper,
+					Dir:     j.dir,
+					Stderr:  stderr,
+					Trace:   trace,
+					Env:     j.acmeEnv(),
+				}
+				if len(p) == 0 {
+					c.ReadTimeout = j.readTimeout
+					if j.jobs > 0 && j.jobsFlag != "" {
+						c.Args = append(args[:len(args):len(args)], fmt.Sprintf(j.jobsFlag, j.jobs))
+					}
+					c.MaxStdin, c.Suffix = j.maxStdin, j.suffix
+				}
+				p = append(p, c)
+			}
+			if len(p) == 1 {
+				f = append(f, p[0])
+			} else {
+				f = append(f, p)
+			}
+		}
+		if len(f) == 1 {
+			seq = append(seq, f[0])
+		} else {
+			seq = append(seq, f)
+		}
+	}
+	if len(seq) == 1 {
+		return seq[0]
+	}
+	return seq
 }
 
-type dataWriter struct{ *acme.Win }
+// acmeEnv returns the environment variables that Acme sets
+// for the commands that it runs from a window,
+// for formatters and their wrapper scripts that expect them:
+// $% and $samfile, the file name, and $winid, the window's ID.
+func (j job) acmeEnv() []string {
+	var env []string
+	if j.file != "" {
+		env = append(env, "%="+j.file, "samfile="+j.file)
+	}
+	if j.id != 0 {
+		env = append(env, "winid="+strconv.Itoa(j.id))
+	}
+	return env
+}
 
-func (w dataWriter) Write(data []byte) (int, error) {
-	return w.Win.Write("data", data)
+// steps returns the steps of the sequence run,
+// which are separated by && arguments.
+func steps(run []string) [][]string {
+	return split(run, "&&")
 }
 
+// alternatives returns the alternative commands of the fallback chain run,
+// which are separated by || arguments.
+// Empty commands are dropped.
+func alternatives(run []string) [][]string {
+	return split(run, "||")
+}
+
+// stages returns the commands of the pipeline run,
+// which are separated by | arguments.
+// Empty commands are dropped.
+func stages(run []string) [][]string {
+	return split(run, "|")
+}
+
+// split returns the non-empty commands of run separated by sep arguments.
+func split(run []string, sep string) [][]string {
+	var cmds [][]string
+	for len(run) > 0 {
+		i := 0
+		for i < len(run) && run[i] != sep {
+			i++
+		}
+		if i > 0 {
+			cmds = append(cmds, run[:i:i])
+		}
+		if i == len(run) {
+			break
+		}
+		run = run[i+1:]
+	}
+	return cmds
+}
+
+// plain is set by the -plain flag.
+// If set, windows and summaries that Fmt writes avoid
+// symbols and column alignment, and give one fact per line.
+var plain bool
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: Fmt <cmd>\n")
-		os.Exit(1)
+	flag.BoolVar(&plain, "plain", false, "write output without symbols or alignment, one fact per line")
+	verbose := flag.Bool("v", false, "trace window control and address operations, writes, and commands run")
+	veryVerbose := flag.Bool("vv", false, "like -v, but also trace reads of window files")
+	traceLog := flag.String("vlog", "", "with -v or -vv, append the trace to this file instead of standard error")
+	legacyMode := flag.Bool("legacy", false, "format $winid with the given command as before configuration and diff-based writes")
+	onput := flag.Bool("onput", false, "stay resident and format matching windows after each Put")
+	addTag := flag.String("tag", "", "with -onput, add this text, such as ' Fmt', to the tags of new windows that the rules match")
+	match := flag.String("match", "", "with -onput, only format windows whose name matches this regexp")
+	nextWin := flag.Bool("next", false, "show the next window that failed or changed in the latest -all format")
+	all := flag.String("all", "", "format every open window whose name matches this regexp")
+	undoLabel := flag.String("undo", "", "revert the format with the given label")
+	revertSel := flag.Bool("revert", false, "revert the edits of the latest format that intersect the selection")
+	restoreBackup := flag.Bool("restore", false, "restore the body and selection from before the latest format")
+	backupMax := flag.Int64("backupmax", defaultBackupMax, "back up bodies of at most this many bytes before formatting, for -restore")
+	labels := flag.Bool("labels", false, "list the labels of formats that can be reverted")
+	chg := flag.Bool("changes", false, "list the addresses of the lines changed by the latest format")
+	res := flag.Bool("resident", false, "stay attached to the window, formatting each time Fmt is executed in it")
+	dirPattern := flag.String("dir", "", "in a directory window, format on disk the listed files matching this pattern")
+	plumbMode := flag.Bool("plumb", false, "format the files named by messages plumbed to the fmt port")
+	ctl := flag.Bool("listen", false, "serve format requests on the control socket $NAMESPACE/fmt")
+	winID := flag.Int("w", 0, "format the window with this ID instead of $winid")
+	winFile := flag.String("name", "", "format the window with this file name instead of $winid")
+	gotoChange := flag.Bool("goto-change", false, "select the first change instead of restoring the selection")
+	lineCol := flag.Bool("linecol", false, "restore the selection to the same line and column instead of the same offset")
+	cpuLimit := flag.Int("cpu", 0, "limit the CPU time of the formatter to this many seconds")
+	memLimit := flag.Int64("mem", 0, "limit the address space of the formatter to this many bytes")
+	maxStderr := flag.Int("maxstderr", defaultMaxStderr, "show at most this many bytes of the formatter's standard error")
+	timing := flag.Bool("time", false, "print the time taken to read, format, diff, and write the body")
+	legacyExit := flag.Bool("legacy-exit", false, "exit with status 1 for any failure and 0 otherwise, even if the body changed")
+	jsonOut := flag.Bool("json", false, "print the result as JSON to standard output")
+	onDisk := flag.Bool("disk", false, "format the window's file on disk and reload the window with Get, instead of re-writing the body")
+	large := flag.Int("large", defaultLarge, "warn instead of formatting a body of over this many bytes, unless run again soon; 0 for no limit")
+	maxMem := flag.Int("maxmem", defaultMaxMemory, "hold the body and the formatter output in memory for bodies of up to this many bytes")
+	keep := flag.Bool("keep", false, "keep the file holding the formatter output and print its name")
+	mergeEdits := flag.Bool("merge", false, "merge edits made while the formatter ran instead of refusing the format")
+	hunkUndo := flag.Bool("hunkundo", false, "make each changed hunk a separate Undo step instead of one for the format")
+	lspServer := flag.Bool("lsp", false, "run the command as a language server, such as gopls, and ask it to format")
+	changedLines := flag.Bool("changed", false, "format only the lines changed since the -base revision in git")
+	base := flag.String("base", "HEAD", "with -changed, the git revision, or if empty the index, to compare against")
+	blocks := flag.Bool("blocks", false, "format each fenced code block, as in Markdown, with the formatter for its language")
+	trimFlag := flag.Bool("trim", false, "strip trailing white space and blank lines and end with a newline, after the command, if given, instead of that of the rules")
+	encoding := flag.String("encoding", "", "convert text that is not UTF-8 from this encoding, such as latin1 or shift_jis, for the formatter, and back")
+	eol := flag.String("crlf", "", "give the formatter Unix line endings and end the output's lines as the body's did (keep), or with lf or crlf")
+	fixpoint := flag.Int("fixpoint", 0, "re-run the formatter on its output until it stops changing, at most this many times")
+	imports := flag.Bool("imports", false, "ask the language server, by default gopls, to organize imports before formatting")
+	dryRunFlag := flag.Bool("n", false, "print the commands that formatting would run, with their directory and environment, without running them")
+	prev := flag.Bool("preview", false, "show the diff in a new window instead of changing the body")
+	confirmDiff := flag.Bool("confirm", false, "show the diff in a new window, and apply it when Apply is executed there")
+	file := flag.String("file", "", "outside of Acme, format this file in place instead of standard input")
+	keepMtime := flag.Bool("keepmtime", false, "with -file, keep the modification time of the file")
+	flag.BoolVar(&edwood, "edwood", false, "adapt to the Edwood implementation of the Acme file system")
+	dial := flag.String("a", "", "use the Acme 9P service at this dial string, such as tcp!host!port")
+	ns := flag.String("ns", "", "use the Acme in this name space directory instead of $NAMESPACE")
+	crashDir := flag.String("crash", "", "write a report to this directory on panics and internal errors")
+	readTimeout := flag.Duration("readtimeout", defaultReadTimeout, "kill the formatter if it reads none of its standard input and writes nothing in this time, such as 10s; by default, wait forever")
+	tmpDir := flag.String("tmpdir", "", "create the scratch and state files, which hold the text being formatted, in this directory, or with mem, in memory")
+	profileName := flag.String("p", "", "use the named profile of the configuration")
+	crashBody := flag.Bool("crashbody", false, "with -crash, include the body in the report")
+	flag.Usage = func() {
+		eprintf("Usage: Fmt [run] [-n | -preview | -confirm | -all regexp | -onput [-match regexp]] [<cmd>]\n       Fmt check | diff [<cmd>]\n       Fmt daemon\n       Fmt restore\n       Fmt -resident [<cmd>]\n       Fmt which <file>\n       Fmt files [-check | -diff | -write] <file>... | -\n       Fmt git [-disk] [<dir>]\n       Fmt [-file file] [<cmd>] (outside of Acme)\n       Fmt -labels | -undo label | -revert | -changes | -restore\n       Fmt stats [<dir>]\n       Fmt -listen\n       Fmt -plumb [<cmd>]\n       Fmt -next\n       Fmt -dir pattern (in a directory window)\n       Fmt -legacy <cmd>\n       Fmt serve-diff [-http addr] [<cmd>]\n\nThe window is $winid, or as given by -w or -name.\n")
+		flag.PrintDefaults()
 	}
-	win, err := openWin()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open win: %s\n", err)
-		os.Exit(1)
+	flag.Parse()
+	var sub string
+	if flag.NArg() > 0 && subcommands[flag.Arg(0)] {
+		sub = flag.Arg(0)
+		// The flags may also follow the subcommand.
+		flag.CommandLine.Parse(flag.Args()[1:])
 	}
-	q0, q1, err := readAddr(win)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to get the current selection: %s\n", err)
-		os.Exit(1)
+	conf, confErr := loadConfig()
+	// Args are the arguments of the command line, before any of a profile.
+	args := flag.Args()
+	if *profileName != "" && confErr == nil {
+		if err := conf.useProfile(*profileName, args); err != nil {
+			eprintf("%s\n", err)
+			exit(1)
+		}
+	}
+	switch sub {
+	case "daemon":
+		*ctl = true
+	case "restore":
+		*restoreBackup = true
+	}
+	if *imports {
+		*lspServer = true
+	}
+	if *tmpDir != "" {
+		if err := setScratchRoot(*tmpDir); err != nil {
+			eprintf("%s\n", err)
+			exit(1)
+		}
+	}
+	if *tmpDir == "mem" && *crashBody {
+		eprintf("-crashbody would write the body to the -crash directory, so it cannot be used with -tmpdir mem\n")
+		exit(1)
+	}
+	fmtharness.MaxMemory = *maxMem
+	if !validEOL(*eol) {
+		eprintf("-crlf must be keep, lf, or crlf\n")
+		exit(1)
+	}
+	if *ns != "" {
+		// The acme package finds Acme through $NAMESPACE.
+		if err := os.Setenv("NAMESPACE", *ns); err != nil {
+			eprintf("failed to set the name space: %s\n", err)
+			exit(1)
+		}
+	}
+	if stateKey = *dial; stateKey == "" {
+		stateKey = client.Namespace()
+	}
+	if *verbose || *veryVerbose {
+		trace, traceVerbose = os.Stderr, *veryVerbose
+		if *traceLog != "" {
+			f, err := os.OpenFile(*traceLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				eprintf("failed to open the trace log: %s\n", err)
+				exit(1)
+			}
+			defer f.Close()
+			trace = f
+		}
+	}
+	crash := &crashReporter{dir: *crashDir, body: *crashBody, legacy: *legacyExit}
+	defer crash.recover()
+	startSession()
+	defer endSession()
+	if *legacyMode {
+		// Only the interface of Fmt before its flags: the command, for $winid.
+		var set []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "legacy" {
+				set = append(set, "-"+f.Name)
+			}
+		})
+		if len(set) > 0 || flag.NArg() == 0 {
+			eprintf("Usage: Fmt -legacy <cmd> [<arg>...]\n")
+			if len(set) > 0 {
+				eprintf("-legacy takes no other flags: %s\n", strings.Join(set, " "))
+			}
+			exit(1)
+		}
+		id, win, err := openWin("", 0, "")
+		if err != nil {
+			eprintf("failed to open win: %s\n", err)
+			exit(1)
+		}
+		if err := legacy(win, id, flag.Args()); err != nil {
+			eprintf("%s\n", err)
+			exit(1)
+		}
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "stats" {
+		exit(stats(flag.Args()[1:]))
+	}
+	if confErr != nil {
+		eprintf("failed to load the configuration: %s\n", confErr)
+		exit(1)
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "files" {
+		exit(files(conf, flag.Args()[1:]))
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "git" {
+		exit(gitFiles(job{conf: conf, backupMax: *backupMax}, flag.Args()[1:]))
+	}
+	if flag.NArg() == 2 && flag.Arg(0) == "which" {
+		if err := which(conf, flag.Arg(1)); err != nil {
+			eprintf("%s\n", err)
+			exit(1)
+		}
+		return
+	}
+	if *plumbMode {
+		j := job{run: conf.command(flag.Args()), lsp: *lspServer, imports: *imports, conf: conf, backupMax: *backupMax}
+		if err := plumbServe(j); err != nil {
+			eprintf("failed to read the plumber port %s: %s\n", plumbPort, err)
+			exit(1)
+		}
+		return
+	}
+	if *ctl {
+		if err := listen(conf); err != nil {
+			eprintf("failed to serve %s: %s\n", socketPath(), err)
+			exit(1)
+		}
+		return
+	}
+	if *nextWin {
+		if err := next(); err != nil {
+			eprintf("%s\n", err)
+			exit(1)
+		}
+		return
+	}
+	if *all != "" {
+		re, err := regexp.Compile(*all)
+		if err != nil {
+			eprintf("bad -all regexp: %s\n", err)
+			exit(1)
+		}
+		nfailed, err := fmtAll(re, job{run: conf.command(flag.Args()), lsp: *lspServer, imports: *imports, changed: *changedLines, base: *base, blocks: *blocks, fixpoint: *fixpoint, eol: *eol, encoding: *encoding, trim: *trimFlag, readTimeout: *readTimeout, cpuLimit: *cpuLimit, memLimit: *memLimit, conf: conf, backupMax: *backupMax})
+		if err != nil {
+			eprintf("failed to read the acme index: %s\n", err)
+			exit(1)
+		}
+		if nfailed > 0 {
+			exit(1)
+		}
+		return
+	}
+	if *onput {
+		re, err := regexp.Compile(*match)
+		if err != nil {
+			eprintf("bad -match regexp: %s\n", err)
+			exit(1)
+		}
+		if err := onPut(re, *addTag, args, job{run: conf.command(flag.Args()), lsp: *lspServer, imports: *imports, changed: *changedLines, base: *base, blocks: *blocks, fixpoint: *fixpoint, eol: *eol, encoding: *encoding, trim: *trimFlag, readTimeout: *readTimeout, cpuLimit: *cpuLimit, memLimit: *memLimit, conf: conf, backupMax: *backupMax}); err != nil {
+			eprintf("failed to read the acme log: %s\n", err)
+			exit(1)
+		}
+		return
+	}
+	if os.Getenv("winid") == "" && *winID == 0 && *winFile == "" && *dial == "" && *file != "" {
+		// Run from outside of Acme, for example a win shell,
+		// but the file may be open in Acme.
+		// If so, format the window instead of the file on disk,
+		// which would be overwritten by the next Put.
+		if _, err := findWin(localWindows, *file); err == nil {
+			*winFile = *file
+		}
+	}
+	if os.Getenv("winid") == "" && *winID == 0 && *winFile == "" && *dial == "" {
+		// Not run from Acme, for example run by sam or make.
+		j := job{run: conf.command(flag.Args()), lsp: *lspServer, imports: *imports, changed: *changedLines, base: *base, blocks: *blocks, fixpoint: *fixpoint, eol: *eol, encoding: *encoding, trim: *trimFlag, readTimeout: *readTimeout, cpuLimit: *cpuLimit, memLimit: *memLimit, conf: conf, keepMtime: *keepMtime}
+		var err error
+		if *file != "" {
+			err = filterFile(j, *file)
+		} else {
+			err = filter(j, os.Getenv("samfile"))
+		}
+		if err != nil {
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		return
 	}
-	status := 0
-	ffile, sameSize, err := format(win, os.Args[1:])
-	diff := !sameSize
+	id, win, err := openWin(*dial, *winID, *winFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "format failed: %s\n", err)
-		status = 1
-		goto out
+		eprintf("failed to open win: %s\n", err)
+		if h := nsHint(); *dial == "" && h != "" {
+			eprintf("%s\n", h)
+		}
+		exit(exitStatus(false, err, *legacyExit))
+	}
+	crash.win = win
+	aw, local := win.(*acme.Win)
+	if !local && (*res || *prev || *confirmDiff) {
+		err := errorf("-resident, -preview, and -confirm need a local Acme")
+		eprintf("%s\n", err)
+		exit(exitStatus(false, err, *legacyExit))
 	}
-	if !diff {
-		diff, err = bodyDiff(win, ffile)
+	win = wrapped(win)
+	if *dirPattern != "" {
+		name, err := winName(win)
+		if err != nil {
+			eprintf("failed to read the window name: %s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		if !strings.HasSuffix(name, "/") {
+			err := errorf("-dir needs a directory window")
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		nfailed, err := fmtDir(win, name, *dirPattern, job{conf: conf, backupMax: *backupMax})
 		if err != nil {
-			// Not fatal. Re-write the body anyway.
-			fmt.Fprintf(os.Stderr, "failed to diff the body: ", err)
-			diff = true
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		if nfailed > 0 {
+			// The failures are already reported.
+			exit(exitStatus(false, errorf("%d files failed", nfailed), *legacyExit))
 		}
+		return
 	}
-	if diff {
-		if err := writeBody(win, ffile); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to write the body: %s\n", err)
-			status = 1
-			goto out
+	if flag.NArg() >= 1 && flag.Arg(0) == "serve-diff" {
+		j := job{id: id, lsp: *lspServer, imports: *imports, changed: *changedLines, base: *base, blocks: *blocks, fixpoint: *fixpoint, eol: *eol, encoding: *encoding, trim: *trimFlag, readTimeout: *readTimeout, cpuLimit: *cpuLimit, memLimit: *memLimit, conf: conf}
+		if name, err := winName(win); err == nil {
+			j.dir = filepath.Dir(name)
 		}
-		if err := showAddr(win, q0, q1); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to restore the selection: %s\n", err)
-			status = 1
-			goto out
+		if err := serveDiff(win, j, flag.Args()[1:]); err != nil {
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
 		}
+		return
 	}
-
-out:
-	if err := os.Remove(ffile); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to remove tempfile %s: %s\n", ffile, err)
+	if *labels || *undoLabel != "" || *revertSel || *chg || *restoreBackup {
+		switch {
+		case *restoreBackup:
+			err = restore(win, id)
+		case *labels:
+			err = listHistory(win, id)
+		case *chg:
+			err = changes(win, id)
+		case *revertSel:
+			err = revertHunks(win, id)
+		default:
+			err = undo(win, id, *undoLabel)
+		}
+		if err != nil {
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		return
+	}
+	j := job{id: id, run: conf.command(flag.Args()), lsp: *lspServer, imports: *imports, changed: *changedLines, base: *base, blocks: *blocks, fixpoint: *fixpoint, eol: *eol, encoding: *encoding, trim: *trimFlag, readTimeout: *readTimeout, cpuLimit: *cpuLimit, memLimit: *memLimit, conf: conf, gotoChange: *gotoChange, undoPerHunk: *hunkUndo, merge: *mergeEdits, keep: *keep, timing: *timing, maxStderr: *maxStderr, lineCol: *lineCol, backupMax: *backupMax}
+	if *winID != 0 || *winFile != "" {
+		// The window may not be in the current directory,
+		// so run the command in the window's directory.
+		name, err := winName(win)
+		if err != nil {
+			eprintf("failed to read the window name: %s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		j.dir = filepath.Dir(name)
+	}
+	if *dryRunFlag {
+		if err := dryRun(os.Stdout, win, j); err != nil {
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		return
+	}
+	if *res {
+		if err := resident(aw, win, j, flag.Args()); err != nil {
+			eprintf("%s\n", err)
+			exit(exitStatus(false, err, *legacyExit))
+		}
+		return
+	}
+	if err := checkLarge(win, id, *large); err != nil {
+		eprintf("%s\n", err)
+		if *legacyExit {
+			exit(1)
+		}
+		exit(exitRefused)
+	}
+	format := fmtWin
+	switch {
+	case sub == "check" || sub == "diff":
+		diff := sub == "diff"
+		format = func(win fmtharness.Window, j job) (bool, error) { return checkWin(win, j, diff) }
+	case *prev:
+		format = func(win fmtharness.Window, j job) (bool, error) { return false, preview(win, j) }
+	case *confirmDiff:
+		format = func(win fmtharness.Window, j job) (bool, error) { return false, confirm(win, j) }
+	case *onDisk:
+		format = fmtOnDisk
+	case *jsonOut:
+		format = fmtWinJSON
+	}
+	changed, err := format(win, j)
+	var r *fmtharness.RefusalError
+	// Check, diff, and -json report to a program, which cannot answer a prompt.
+	if errors.As(err, &r) && local && !*jsonOut && sub != "check" && sub != "diff" {
+		changed, err = prompt(win, j, r, format)
+	}
+	if err != nil {
+		eprintf("%s\n", err)
+		crash.reportError(err)
 	}
-	os.Exit(status)
+	exit(exitStatus(changed, err, *legacyExit))
 }
 
-func openWin() (*acme.Win, error) {
-	id, err := strconv.Atoi(os.Getenv("winid"))
+// fmtWin formats the body of win as described by j,
+// restoring the selection afterwards.
+// If the formatter fails, the selection is set to the position
+// of the first error that it reports, if any.
+// The standard error of the formatter is shown by showDiagnostics.
+// The returned bool reports whether the body was re-written.
+func fmtWin(win fmtharness.Window, j job) (bool, error) {
+	name, err := winName(win)
 	if err != nil {
-		return nil, err
+		return false, errorf("failed to read the window name: %s", err)
+	}
+	if err := writable(win, name); err != nil {
+		return false, err
+	}
+	unlock, err := lockWin(j.id)
+	if err != nil {
+		return false, err
 	}
-	return acme.Open(id, nil)
+	defer unlock()
+	if j, err = j.resolved(name); err != nil {
+		return false, err
+	}
+	// The hooks run even if the body is known to be formatted,
+	// so that they see every format, as they would without the cache.
+	if err := runHook(j, j.pre, name); err != nil {
+		return false, errorf("pre hook failed: %s", err)
+	}
+	if j.cache != nil {
+		body, err := fmtharness.ReadBody(win)
+		if err != nil {
+			return false, errorf("failed to read the body: %s", err)
+		}
+		if j.cache.formatted(name, j, body) {
+			postHook(j, name, false)
+			return false, nil
+		}
+	}
+	stderr := &stderrBuffer{max: j.maxStderr}
+	if stderr.max <= 0 {
+		stderr.max = defaultMaxStderr
+	}
+	out := j.stderr
+	j.stderr = stderr
+	stop := func() {}
+	if isLocal(win) {
+		stop = showProgress(j.id)
+	}
+	res, err := fmtharness.Format(win, j.formatter(), fmtharness.Options{
+		Force:       j.force,
+		GotoChange:  j.gotoChange,
+		UndoPerHunk: j.undoPerHunk,
+		Merge:       j.merge,
+		LineCol:     j.lineCol,
+		Keep:        j.keep,
+	})
+	stop()
+	printWarnings(res)
+	if j.timing && res != nil {
+		printStats(res.Stats)
+	}
+	if j.report != nil {
+		j.report.set(name, res, err, stderr.Bytes())
+	}
+	var ferr *fmtharness.FormatterError
+	switch {
+	case res != nil && res.OutputFile != "":
+		keepOutput(j, res.OutputFile)
+	case errors.As(err, &ferr) && ferr.OutputFile != "":
+		keepOutput(j, ferr.OutputFile)
+	}
+	if stderr.Len() > 0 {
+		showDiagnostics(win, out, name, stderr.Bytes())
+	}
+	if errors.As(err, &ferr) {
+		if lerr := limitError(j, ferr.Err, stderr.Bytes()); lerr != nil {
+			ferr.Err = lerr
+		}
+		if errors.Is(ferr.Err, fmtharness.ErrUnread) {
+			ferr.Err = errorf("%s; if it formats only files, set maxstdin = 1 in its rule to give it a file", ferr.Err)
+		}
+		if err := showError(win, stderr.Bytes()); err != nil {
+			eprintf("failed to show the error: %s\n", err)
+		}
+	}
+	j.stderr = out
+	if res == nil || !res.Changed {
+		if err == nil {
+			if !res.Spilled {
+				j.cache.add(name, j, res.Body)
+			}
+			postHook(j, name, false)
+		}
+		return false, err
+	}
+	if err != nil {
+		return true, err
+	}
+	if !res.Spilled {
+		j.cache.add(name, j, res.Formatted)
+		recordFormat(win, j, res, res.Stats.Format)
+	}
+	postHook(j, name, true)
+	return true, nil
 }
 
-func readAddr(win *acme.Win) (q0, q1 int, err error) {
-	// This first read is bogus.
-	// Acme zeroes the win's address the first time addr is opened.
-	// So, we need to open it before setting addr=dot,
-	// lest we just read back a zero address.
-	if _, _, err := win.ReadAddr(); err != nil {
-		return 0, 0, err
+// printWarnings prints the warnings of res, if it is non-nil, to standard error.
+func printWarnings(res *fmtharness.Result) {
+	if res == nil {
+		return
 	}
-	if err := win.Ctl("addr=dot\n"); err != nil {
-		return 0, 0, err
+	for _, w := range res.Warnings {
+		eprintf("%s\n", w)
 	}
-	return win.ReadAddr()
 }
 
-func showAddr(win *acme.Win, q0, q1 int) error {
-	if err := win.Addr("#%d,#%d", q0, q1); err != nil {
-		return err
+// printStats prints the times and sizes of st to standard error.
+func printStats(st fmtharness.Stats) {
+	if plain {
+		eprintf("read: %s\n", st.Read)
+		eprintf("format: %s\n", st.Format)
+		eprintf("diff: %s\n", st.Diff)
+		eprintf("write: %s\n", st.Write)
+		eprintf("bytes in: %d\n", st.In)
+		eprintf("bytes out: %d\n", st.Out)
+		return
 	}
-	return win.Ctl("dot=addr\nshow\n")
+	eprintf("read %s, format %s, diff %s, write %s; %d bytes in, %d bytes out\n", st.Read, st.Format, st.Diff, st.Write, st.In, st.Out)
 }
 
-// If tmpFile is non-empty, it is created and must be removed by the caller.
-func format(win *acme.Win, run []string) (tmpFile string, sameSize bool, err error) {
-	tf, err := ioutil.TempFile(os.TempDir(), "Fmt")
-	if err != nil {
-		return "", false, err
-	}
-	tmpFile = tf.Name()
-	br := &countReader{0, bodyReader{win}}
-	fw := &countWriter{0, tf}
-	cmd := exec.Command(run[0], run[1:]...)
-	cmd.Stdin = br
-	cmd.Stdout = fw
-	cmd.Stderr = os.Stderr
-	if err = cmd.Run(); err != nil {
-		tf.Close()
-	} else {
-		err = tf.Close()
-	}
-	sameSize = fw.count == br.count
-	return
-}
-
-func writeBody(win *acme.Win, ffile string) error {
-	if err := win.Ctl("nomark"); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to set nomark: %s", err)
-	}
-	defer func() {
-		if err := win.Ctl("mark"); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to set mark: %s", err)
-		}
-	}()
-	tf, err := os.Open(ffile)
+// keepOutput moves the file holding the output of the command,
+// which is in the session directory, removed on exit,
+// to the state directory, and prints its new name.
+func keepOutput(j job, path string) {
+	kept, err := stateFile(fmt.Sprintf("output-%d-%s", j.id, filepath.Base(path)))
+	if err == nil {
+		err = os.Rename(path, kept)
+	}
 	if err != nil {
-		return err
+		eprintf("failed to keep the formatter output: %s\n", err)
+		return
 	}
-	defer tf.Close()
-	if err := win.Addr("0,$"); err != nil {
-		return err
+	eprintf("formatter output kept in %s\n", kept)
+}
+
+// recordFormat records the format res of win,
+// for which the formatter took the given time, in its history and backup.
+func recordFormat(win fmtharness.Window, j job, res *fmtharness.Result, took time.Duration) {
+	if err := record(win, j, res.Body, res.Formatted, took); err != nil {
+		// Not fatal. The format just can't be undone by label.
+		eprintf("failed to record the format: %s\n", err)
+	}
+	if err := saveBackup(win, j, res); err != nil {
+		// Not fatal. The format just can't be restored.
+		eprintf("failed to back up the body: %s\n", err)
 	}
-	_, err = io.Copy(dataWriter{win}, tf)
-	return err
 }
 
-func bodyDiff(win *acme.Win, ffile string) (bool, error) {
-	tf, err := os.Open(ffile)
+// writable returns an error if the window named name should not be edited:
+// if it is a directory window, or if its file exists but is read-only,
+// so that its changes could not be Put.
+func writable(win fmtharness.Window, name string) error {
+	ctl, err := win.ReadAll("ctl")
 	if err != nil {
-		return false, err
+		return errorf("failed to read the window ctl: %s", err)
+	}
+	if f := strings.Fields(string(ctl)); len(f) > 3 && f[3] == "1" {
+		return errorf("refusing to format %s: it is a directory", name)
 	}
-	defer tf.Close()
-	win.Seek("body", 0, 0)
-	fr := bufio.NewReader(tf)
-	br := bufio.NewReader(&bodyReader{win})
-	for {
-		fb, errf := fr.ReadByte()
-		if errf != nil && errf != io.EOF {
-			return false, errf
+	if fi, err := os.Stat(name); err == nil && fi.Mode().Perm()&0222 == 0 {
+		return errorf("refusing to format %s: the file is read-only", name)
+	}
+	return nil
+}
+
+// openWin opens the window with the given ID.
+// If id is 0, it opens the window with the given file name,
+// and if name is also empty, it opens the window $winid.
+// If addr is non-empty, the window is opened in the Acme
+// whose 9P service is at that dial string instead of the local Acme.
+func openWin(addr string, id int, name string) (int, fmtharness.Window, error) {
+	var remote *fmtharness.Remote
+	var err error
+	list := localWindows
+	if addr != "" {
+		if remote, err = fmtharness.Dial(addr); err != nil {
+			return 0, nil, err
 		}
-		bb, errb := br.ReadByte()
-		if errb != nil && errb != io.EOF {
-			return false, errb
+		list = remote.Windows
+	}
+	switch {
+	case id != 0:
+	case name != "":
+		if id, err = findWin(list, name); err != nil {
+			return 0, nil, err
 		}
-		if fb != bb {
-			return true, nil
+	default:
+		if id, err = strconv.Atoi(os.Getenv("winid")); err != nil {
+			return 0, nil, err
 		}
-		if errf == io.EOF && errb == io.EOF {
-			return false, nil
+	}
+	if remote != nil {
+		win, err := remote.Open(id)
+		return id, win, err
+	}
+	win, err := acme.Open(id, nil)
+	return id, win, err
+}
+
+// localWindows returns the windows of the local Acme.
+func localWindows() ([]fmtharness.WinInfo, error) {
+	wins, err := acme.Windows()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fmtharness.WinInfo, len(wins))
+	for i, wi := range wins {
+		infos[i] = fmtharness.WinInfo{ID: wi.ID, Name: wi.Name}
+	}
+	return infos, nil
+}
+
+// findWin returns the ID of the window with the given file name
+// among the windows returned by list.
+// A relative name is taken relative to the current directory.
+func findWin(list func() ([]fmtharness.WinInfo, error), name string) (int, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return 0, err
+	}
+	wins, err := list()
+	if err != nil {
+		return 0, err
+	}
+	for _, wi := range wins {
+		if wi.Name == name || wi.Name == abs {
+			return wi.ID, nil
 		}
 	}
+	return 0, errorf("no window named %s", name)
 }
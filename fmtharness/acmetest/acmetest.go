@@ -0,0 +1,312 @@
+// Package acmetest provides an in-memory fake of an Acme window
+// for testing code that uses fmtharness without a running Acme.
+//
+// The fake models the parts of the window's file system that Fmt uses:
+// the body, tag, addr, data, ctl, and event files.
+// Like Acme, the first read of the address zeroes it.
+package acmetest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"9fans.net/go/acme"
+)
+
+// A Win is a fake Acme window.
+// It implements fmtharness.Window.
+type Win struct {
+	mu     sync.Mutex
+	body   []rune
+	tag    string
+	addr   [2]int
+	dot    [2]int
+	opened bool
+	dirty  bool
+	marks  bool
+	offs   map[string]int64
+	ctls   []string
+	events chan *acme.Event
+	back   []*acme.Event
+}
+
+// New returns a new fake window with the given name and body.
+func New(name, body string) *Win {
+	return &Win{
+		body:   []rune(body),
+		tag:    name + " Del Snarf | Look ",
+		marks:  true,
+		offs:   make(map[string]int64),
+		events: make(chan *acme.Event, 16),
+	}
+}
+
+// Body returns the text of the body.
+func (w *Win) Body() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.body)
+}
+
+// Dot returns the rune offsets of the selection.
+func (w *Win) Dot() (q0, q1 int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dot[0], w.dot[1]
+}
+
+// SetDot sets the selection to the rune offsets [q0, q1).
+func (w *Win) SetDot(q0, q1 int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dot = [2]int{q0, q1}
+}
+
+// Dirty returns whether the body was modified since it was last clean.
+func (w *Win) Dirty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirty
+}
+
+// Ctls returns the control messages written to the window, one per line.
+func (w *Win) Ctls() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.ctls...)
+}
+
+// Addr implements fmtharness.Window.
+func (w *Win) Addr(format string, args ...interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	q0, q1, err := w.parseAddr(fmt.Sprintf(format, args...))
+	if err != nil {
+		return err
+	}
+	w.addr = [2]int{q0, q1}
+	return nil
+}
+
+// ReadAddr implements fmtharness.Window.
+func (w *Win) ReadAddr() (q0, q1 int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.opened {
+		w.opened = true
+		w.addr = [2]int{0, 0}
+	}
+	return w.addr[0], w.addr[1], nil
+}
+
+// Ctl implements fmtharness.Window.
+func (w *Win) Ctl(format string, args ...interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		if msg == "" {
+			continue
+		}
+		w.ctls = append(w.ctls, msg)
+		switch msg {
+		case "addr=dot":
+			w.addr = w.dot
+		case "dot=addr":
+			w.dot = w.addr
+		case "clean", "put", "get":
+			w.dirty = false
+		case "dirty":
+			w.dirty = true
+		case "mark":
+			w.marks = true
+		case "nomark":
+			w.marks = false
+		case "show", "del", "delete", "cleartag":
+		default:
+			if !strings.HasPrefix(msg, "name ") && !strings.HasPrefix(msg, "dumpdir ") && !strings.HasPrefix(msg, "dump ") {
+				return errors.New("bad ctl message: " + msg)
+			}
+		}
+	}
+	return nil
+}
+
+// Read implements fmtharness.Window.
+func (w *Win) Read(file string, b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, err := w.file(file)
+	if err != nil {
+		return 0, err
+	}
+	off := w.offs[file]
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[off:])
+	w.offs[file] = off + int64(n)
+	return n, nil
+}
+
+// ReadAll implements fmtharness.Window.
+func (w *Win) ReadAll(file string) ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file(file)
+}
+
+// Seek implements fmtharness.Window.
+func (w *Win) Seek(file string, offset int64, whence int) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, err := w.file(file)
+	if err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += w.offs[file]
+	case io.SeekEnd:
+		offset += int64(len(data))
+	}
+	w.offs[file] = offset
+	return offset, nil
+}
+
+// Write implements fmtharness.Window.
+// Writes to data replace the addressed text
+// and set the address to the end of the written text.
+func (w *Win) Write(file string, b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !utf8.Valid(b) {
+		return 0, errors.New("fake window only accepts whole UTF-8 writes")
+	}
+	switch file {
+	case "body":
+		w.body = append(w.body, []rune(string(b))...)
+		w.dirty = true
+	case "tag":
+		w.tag += string(b)
+	case "data":
+		text := []rune(string(b))
+		rest := append(text, w.body[w.addr[1]:]...)
+		w.body = append(w.body[:w.addr[0]:w.addr[0]], rest...)
+		w.addr[0] += len(text)
+		w.addr[1] = w.addr[0]
+		w.dirty = true
+	default:
+		return 0, errors.New("cannot write " + file)
+	}
+	return len(b), nil
+}
+
+// Send queues an event to be received from EventChan.
+func (w *Win) Send(e *acme.Event) { w.events <- e }
+
+// EventChan returns the channel of events sent with Send.
+func (w *Win) EventChan() <-chan *acme.Event { return w.events }
+
+// WriteEvent records an event written back to the window.
+func (w *Win) WriteEvent(e *acme.Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.back = append(w.back, e)
+	return nil
+}
+
+// WrittenEvents returns the events written back to the window.
+func (w *Win) WrittenEvents() []*acme.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*acme.Event(nil), w.back...)
+}
+
+func (w *Win) file(file string) ([]byte, error) {
+	switch file {
+	case "body":
+		return []byte(string(w.body)), nil
+	case "tag":
+		return []byte(w.tag), nil
+	case "ctl":
+		// Like Acme, a window whose name ends in / is a directory.
+		isdir, dirty := 0, 0
+		if name := strings.Fields(w.tag); len(name) > 0 && strings.HasSuffix(name[0], "/") {
+			isdir = 1
+		}
+		if w.dirty {
+			dirty = 1
+		}
+		return []byte(fmt.Sprintf("%11d %11d %11d %11d %11d ", 0, utf8.RuneCountInString(w.tag), len(w.body), isdir, dirty)), nil
+	default:
+		return nil, errors.New("cannot read " + file)
+	}
+}
+
+// parseAddr parses the subset of Acme addresses
+// made of one or two simple addresses separated by a comma.
+func (w *Win) parseAddr(addr string) (q0, q1 int, err error) {
+	addr = strings.TrimSpace(addr)
+	i := strings.IndexByte(addr, ',')
+	if i < 0 {
+		return w.simpleAddr(addr, false)
+	}
+	q0, _, err = w.simpleAddr(addr[:i], false)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, q1, err = w.simpleAddr(addr[i+1:], true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if q1 < q0 {
+		return 0, 0, errors.New("addresses out of order")
+	}
+	return q0, q1, nil
+}
+
+// simpleAddr parses a single address: #n, a line number, $, or dot.
+// An empty address is the start of the body, or the end if end is true.
+func (w *Win) simpleAddr(addr string, end bool) (q0, q1 int, err error) {
+	switch {
+	case addr == "" && end, addr == "$":
+		return len(w.body), len(w.body), nil
+	case addr == "":
+		return 0, 0, nil
+	case addr == ".":
+		return w.dot[0], w.dot[1], nil
+	case addr[0] == '#':
+		q, err := strconv.Atoi(addr[1:])
+		if err != nil || q < 0 || q > len(w.body) {
+			return 0, 0, errors.New("address out of range")
+		}
+		return q, q, nil
+	}
+	n, err := strconv.Atoi(addr)
+	if err != nil {
+		return 0, 0, errors.New("bad address: " + addr)
+	}
+	if n == 0 {
+		return 0, 0, nil
+	}
+	line, start := 1, 0
+	for i, r := range w.body {
+		if r != '\n' {
+			continue
+		}
+		if line == n {
+			return start, i + 1, nil
+		}
+		line++
+		start = i + 1
+	}
+	if line == n {
+		return start, len(w.body), nil
+	}
+	return 0, 0, errors.New("address out of range")
+}
@@ -0,0 +1,252 @@
+package fmtharness
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// A Hunk replaces lines [A0, A1) of the old text
+// with lines [B0, B1) of the new text.
+type Hunk struct{ A0, A1, B0, B1 int }
+
+// SplitLines splits text into lines, each retaining its trailing newline.
+// The final line has no newline if text does not end with one.
+func SplitLines(text string) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// Diff returns the hunks of a minimal line diff from a to b
+// in increasing order, computed with the linear-space refinement
+// of Myers' O(ND) algorithm, so that the memory it takes
+// grows with the lengths of a and b, not with the number of differences.
+func Diff(a, b []string) []Hunk {
+	n := len(a) + len(b)
+	d := differ{a: a, b: b, vf: make([]int, n+4), vb: make([]int, n+4)}
+	d.compare(0, len(a), 0, len(b))
+	return d.hs
+}
+
+// A differ holds the state of Diff.
+type differ struct {
+	a, b []string
+	// Vf and vb are the furthest reaching paths
+	// of the forward and backward searches of middleSnake, by diagonal.
+	vf, vb []int
+	hs     []Hunk
+}
+
+// compare adds the hunks of the diff from a[a0:a1] to b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	// Formatters usually change little,
+	// so skip the common prefix and suffix before the quadratic part.
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0++
+		b0++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+	}
+	if a0 == a1 || b0 == b1 {
+		if a0 < a1 || b0 < b1 {
+			d.add(Hunk{a0, a1, b0, b1})
+		}
+		return
+	}
+	x0, y0, x1, y1 := d.middleSnake(a0, a1, b0, b1)
+	d.compare(a0, x0, b0, y0)
+	d.compare(x1, a1, y1, b1)
+}
+
+// add adds h to the hunks, joining it to the last if they touch.
+func (d *differ) add(h Hunk) {
+	if l := len(d.hs) - 1; l >= 0 && d.hs[l].A1 == h.A0 && d.hs[l].B1 == h.B0 {
+		d.hs[l].A1, d.hs[l].B1 = h.A1, h.B1
+		return
+	}
+	d.hs = append(d.hs, h)
+}
+
+// middleSnake returns the middle snake, from x0, y0 to x1, y1,
+// of a shortest edit path from a[a0:a1] to b[b0:b1],
+// found by searching from both ends at once until the paths overlap.
+// The parts of the path before and after the snake
+// each take at most half of the edits of the whole.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x0, y0, x1, y1 int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta&1 != 0
+	max := (n + m + 1) / 2
+	// Diagonal k is at v[off+k], and is x-y for the forward search
+	// and counts from the ends of a and b for the backward search,
+	// on which it is diagonal delta-k of the forward search.
+	off := max + 1
+	vf, vb := d.vf[:2*max+3], d.vb[:2*max+3]
+	vf[off+1], vb[off+1] = 0, 0
+	for e := 0; e <= max; e++ {
+		for k := -e; k <= e; k += 2 {
+			var x int
+			if k == -e || k != e && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if kb := delta - k; odd && kb >= -(e-1) && kb <= e-1 && x+vb[off+kb] >= n {
+				return a0 + sx, b0 + sy, a0 + x, b0 + y
+			}
+		}
+		for k := -e; k <= e; k += 2 {
+			var x int
+			if k == -e || k != e && vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x++
+				y++
+			}
+			vb[off+k] = x
+			if kf := delta - k; !odd && kf >= -e && kf <= e && x+vf[off+kf] >= n {
+				return a1 - x, b1 - y, a1 - sx, b1 - sy
+			}
+		}
+	}
+	panic("no middle snake")
+}
+
+// Unified writes hunks hs of the diff from a to b in unified format
+// with ctx lines of context.
+// If marks is non-nil, the changed lines of hunks that differ only in white space
+// are written with white space replaced by marks,
+// such as SpaceMarks or PlainSpaceMarks.
+func Unified(w io.Writer, aName, bName string, a, b []string, hs []Hunk, ctx int, marks *strings.Replacer) {
+	if len(hs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(hs); {
+		j := i + 1
+		for j < len(hs) && hs[j].A0-hs[j-1].A1 <= 2*ctx {
+			j++
+		}
+		a0 := maxInt(hs[i].A0-ctx, 0)
+		b0 := maxInt(hs[i].B0-ctx, 0)
+		a1 := minInt(hs[j-1].A1+ctx, len(a))
+		b1 := minInt(hs[j-1].B1+ctx, len(b))
+		var ws bool
+		if marks != nil {
+			ws = true
+			for _, h := range hs[i:j] {
+				ws = ws && spaceOnly(a[h.A0:h.A1], b[h.B0:h.B1])
+			}
+		}
+		if ws {
+			fmt.Fprintf(w, "@@ -%s +%s @@ white space only\n", span(a0, a1), span(b0, b1))
+		} else {
+			fmt.Fprintf(w, "@@ -%s +%s @@\n", span(a0, a1), span(b0, b1))
+		}
+		l := a0
+		for _, h := range hs[i:j] {
+			writeLines(w, " ", a[l:h.A0])
+			if ws {
+				writeLines(w, "-", visible(marks, a[h.A0:h.A1]))
+				writeLines(w, "+", visible(marks, b[h.B0:h.B1]))
+			} else {
+				writeLines(w, "-", a[h.A0:h.A1])
+				writeLines(w, "+", b[h.B0:h.B1])
+			}
+			l = h.A1
+		}
+		writeLines(w, " ", a[l:a1])
+		i = j
+	}
+}
+
+// spaceOnly returns whether lines a and b differ only in white space.
+func spaceOnly(a, b []string) bool {
+	strip := func(lines []string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, strings.Join(lines, ""))
+	}
+	return strip(a) == strip(b)
+}
+
+// SpaceMarks marks tabs, spaces, and carriage returns with symbols.
+var SpaceMarks = strings.NewReplacer("\t", "→\t", " ", "·", "\r", "␍")
+
+// PlainSpaceMarks marks tabs, spaces, and carriage returns with ASCII words,
+// which read better with screen readers and narrow fonts than SpaceMarks.
+var PlainSpaceMarks = strings.NewReplacer("\t", "<tab>", " ", "<space>", "\r", "<cr>")
+
+// visible returns lines with tabs, spaces, and carriage returns marked.
+func visible(marks *strings.Replacer, lines []string) []string {
+	vis := make([]string, len(lines))
+	for i, l := range lines {
+		nl := strings.HasSuffix(l, "\n")
+		vis[i] = marks.Replace(strings.TrimSuffix(l, "\n"))
+		if nl {
+			vis[i] += "\n"
+		}
+	}
+	return vis
+}
+
+func span(l0, l1 int) string {
+	if l0 == l1 {
+		return fmt.Sprintf("%d,0", l0)
+	}
+	if l1-l0 == 1 {
+		return fmt.Sprintf("%d", l0+1)
+	}
+	return fmt.Sprintf("%d,%d", l0+1, l1-l0)
+}
+
+func writeLines(w io.Writer, prefix string, lines []string) {
+	for _, l := range lines {
+		io.WriteString(w, prefix)
+		io.WriteString(w, l)
+		if !strings.HasSuffix(l, "\n") {
+			io.WriteString(w, "\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
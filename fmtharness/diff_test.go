@@ -0,0 +1,237 @@
+package fmtharness_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"\n", []string{"\n"}},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"a\n\nb\n", []string{"a\n", "\n", "b\n"}},
+	}
+	for _, test := range tests {
+		if got := fmtharness.SplitLines(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitLines(%q)=%q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []fmtharness.Hunk
+	}{
+		{name: "both empty", a: "", b: "", want: nil},
+		{name: "equal", a: "a\nb\n", b: "a\nb\n", want: nil},
+		{name: "from empty", a: "", b: "a\nb\n", want: []fmtharness.Hunk{{0, 0, 0, 2}}},
+		{name: "to empty", a: "a\nb\n", b: "", want: []fmtharness.Hunk{{0, 2, 0, 0}}},
+		{name: "change", a: "a\nb\nc\n", b: "a\nB\nc\n", want: []fmtharness.Hunk{{1, 2, 1, 2}}},
+		{name: "insert", a: "a\nc\n", b: "a\nb\nc\n", want: []fmtharness.Hunk{{1, 1, 1, 2}}},
+		{name: "delete", a: "a\nb\nc\n", b: "a\nc\n", want: []fmtharness.Hunk{{1, 2, 1, 1}}},
+		{name: "append", a: "a\n", b: "a\nb\n", want: []fmtharness.Hunk{{1, 1, 1, 2}}},
+		{name: "final newline", a: "a\nb", b: "a\nb\n", want: []fmtharness.Hunk{{1, 2, 1, 2}}},
+		{
+			name: "separate hunks",
+			a:    "a\nb\nc\nd\ne\n",
+			b:    "A\nb\nc\nd\nE\n",
+			want: []fmtharness.Hunk{{0, 1, 0, 1}, {4, 5, 4, 5}},
+		},
+		{
+			name: "adjacent changes are one hunk",
+			a:    "a\nb\nc\n",
+			b:    "a\nx\ny\nz\n",
+			want: []fmtharness.Hunk{{1, 3, 1, 4}},
+		},
+		{
+			name: "common lines in the middle",
+			a:    "a\nb\nc\nd\n",
+			b:    "x\nb\nc\ny\n",
+			want: []fmtharness.Hunk{{0, 1, 0, 1}, {3, 4, 3, 4}},
+		},
+	}
+	for _, test := range tests {
+		a, b := fmtharness.SplitLines(test.a), fmtharness.SplitLines(test.b)
+		got := fmtharness.Diff(a, b)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Diff(%q, %q)=%v, want %v", test.name, test.a, test.b, got, test.want)
+		}
+		if s := apply(a, b, got); s != test.b {
+			t.Errorf("%s: applying Diff(%q, %q) gives %q", test.name, test.a, test.b, s)
+		}
+	}
+}
+
+// TestDiffMinimal checks that the diffs of texts with many ways
+// to line up their lines are minimal.
+func TestDiffMinimal(t *testing.T) {
+	tests := []struct {
+		a, b string
+		// Edits is the number of lines deleted and inserted.
+		edits int
+	}{
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+		{"a\nb\na\nb\n", "b\na\nb\na\n", 2},
+		{"a\na\na\n", "a\na\n", 1},
+		{"}\n\n}\n\n", "}\n}\n", 2},
+		{"x\ny\nz\n", "z\ny\nx\n", 4},
+	}
+	for _, test := range tests {
+		a, b := fmtharness.SplitLines(test.a), fmtharness.SplitLines(test.b)
+		hs := fmtharness.Diff(a, b)
+		if s := apply(a, b, hs); s != test.b {
+			t.Errorf("applying Diff(%q, %q) gives %q", test.a, test.b, s)
+		}
+		edits := 0
+		for _, h := range hs {
+			edits += h.A1 - h.A0 + h.B1 - h.B0
+		}
+		if edits != test.edits {
+			t.Errorf("Diff(%q, %q) makes %d edits, want %d", test.a, test.b, edits, test.edits)
+		}
+	}
+}
+
+// apply returns the text of the lines of a with hunks hs of lines of b applied.
+func apply(a, b []string, hs []fmtharness.Hunk) string {
+	var s strings.Builder
+	pos := 0
+	for _, h := range hs {
+		s.WriteString(strings.Join(a[pos:h.A0], ""))
+		s.WriteString(strings.Join(b[h.B0:h.B1], ""))
+		pos = h.A1
+	}
+	s.WriteString(strings.Join(a[pos:], ""))
+	return s.String()
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name          string
+		orig, a, b    string
+		want          string
+		wantConflicts int
+	}{
+		{
+			name: "no changes",
+			orig: "a\nb\n", a: "a\nb\n", b: "a\nb\n",
+			want: "a\nb\n",
+		},
+		{
+			name: "only a",
+			orig: "a\nb\n", a: "A\nb\n", b: "a\nb\n",
+			want: "A\nb\n",
+		},
+		{
+			name: "only b",
+			orig: "a\nb\n", a: "a\nb\n", b: "a\nB\n",
+			want: "a\nB\n",
+		},
+		{
+			name: "different lines",
+			orig: "a\nb\nc\n", a: "A\nb\nc\n", b: "a\nb\nC\n",
+			want: "A\nb\nC\n",
+		},
+		{
+			name: "same change",
+			orig: "a\nb\nc\n", a: "a\nB\nc\n", b: "a\nB\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "insertion and change",
+			orig: "a\nb\nc\n", a: "a\nx\nb\nc\n", b: "a\nb\nC\n",
+			want: "a\nx\nb\nC\n",
+		},
+		{
+			name: "insertion next to a change conflicts",
+			orig: "a\nb\n", a: "a\nx\nb\n", b: "A\nb\n",
+			want:          "<<<<<<< edited\na\nx\n=======\nA\n>>>>>>> formatted\nb\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "deletion and change elsewhere",
+			orig: "a\nb\nc\n", a: "a\nc\n", b: "a\nb\nC\n",
+			want: "a\nC\n",
+		},
+		{
+			name: "conflict",
+			orig: "a\nb\nc\n", a: "a\nx\nc\n", b: "a\ny\nc\n",
+			want:          "a\n<<<<<<< edited\nx\n=======\ny\n>>>>>>> formatted\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "insertions at the same place conflict",
+			orig: "a\nb\n", a: "a\nx\nb\n", b: "a\ny\nb\n",
+			want:          "a\n<<<<<<< edited\nx\n=======\ny\n>>>>>>> formatted\nb\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "conflict without a final newline",
+			orig: "a", a: "x", b: "y",
+			want:          "<<<<<<< edited\nx\n=======\ny\n>>>>>>> formatted\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "two conflicts",
+			orig: "a\nb\nc\n", a: "x\nb\nz\n", b: "y\nb\nw\n",
+			want:          "<<<<<<< edited\nx\n=======\ny\n>>>>>>> formatted\nb\n<<<<<<< edited\nz\n=======\nw\n>>>>>>> formatted\n",
+			wantConflicts: 2,
+		},
+	}
+	for _, test := range tests {
+		orig := fmtharness.SplitLines(test.orig)
+		a, b := fmtharness.SplitLines(test.a), fmtharness.SplitLines(test.b)
+		merged, n := fmtharness.Merge(orig, a, b, "edited", "formatted")
+		if got := strings.Join(merged, ""); got != test.want || n != test.wantConflicts {
+			t.Errorf("%s: Merge(%q, %q, %q)=%q, %d, want %q, %d",
+				test.name, test.orig, test.a, test.b, got, n, test.want, test.wantConflicts)
+		}
+	}
+}
+
+// benchText returns a text of n lines, and the text with every stride-th line changed.
+func benchText(n, stride int) (text, changed string) {
+	var a, b strings.Builder
+	for i := 0; i < n; i++ {
+		line := "\tx" + strconv.Itoa(i) + " := f(a, b)\n"
+		a.WriteString(line)
+		if i%stride == 0 {
+			line = "\tx" + strconv.Itoa(i) + " := f(a,b)\n"
+		}
+		b.WriteString(line)
+	}
+	return a.String(), b.String()
+}
+
+func BenchmarkDiff(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		n, stride int
+	}{
+		{"few changes", 10000, 1000},
+		{"many changes", 10000, 10},
+		{"every line", 2000, 1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			text, changed := benchText(bench.n, bench.stride)
+			x, y := fmtharness.SplitLines(text), fmtharness.SplitLines(changed)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fmtharness.Diff(x, y)
+			}
+		})
+	}
+}
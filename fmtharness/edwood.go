@@ -0,0 +1,28 @@
+package fmtharness
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Edwood returns a Window that adapts win, a window of Edwood,
+// to the behavior of Acme that this package expects.
+//
+// Edwood does not zero the address the first time that the addr file is opened,
+// and it expects each control message in a write of its own.
+func Edwood(win Window) Window { return edwood{win} }
+
+type edwood struct{ Window }
+
+// Ctl writes each line of the control message separately.
+func (w edwood) Ctl(format string, args ...interface{}) error {
+	for _, msg := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		if msg == "" {
+			continue
+		}
+		if err := w.Window.Ctl("%s\n", msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
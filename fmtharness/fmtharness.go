@@ -0,0 +1,982 @@
+// Package fmtharness formats the bodies of Acme windows.
+//
+// It runs a Formatter over the body of a Window
+// and, only if the formatter succeeds and changes the text,
+// replaces the body with the formatted text,
+// restoring the selection afterwards so the user stays where they were.
+package fmtharness
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TempDir is the directory in which temporary files are created.
+// If empty, they are created in os.TempDir().
+// Temporary files hold the text of the body,
+// so they are created readable only by the user, mode 0600, whatever the umask.
+var TempDir string
+
+// tempDir returns the directory in which to create temporary files.
+func tempDir() string {
+	if TempDir != "" {
+		return TempDir
+	}
+	return os.TempDir()
+}
+
+// MaxMemory is the size in bytes of the largest body
+// whose text and formatted text are held in memory.
+// The text of a larger body is written to a temporary file
+// as it is read by the formatter, and the formatted text to another,
+// and neither is read back into memory: Format compares them
+// with the body as they are read, and re-writes the whole body from the file.
+// If zero, every body is held in temporary files.
+var MaxMemory int
+
+// A Window is an Acme window.
+// It is satisfied by *acme.Win from 9fans.net/go/acme.
+type Window interface {
+	// Addr writes the address file of the window.
+	Addr(format string, args ...interface{}) error
+	// ReadAddr reads the address file of the window,
+	// returning the rune offsets of the address.
+	ReadAddr() (q0, q1 int, err error)
+	// Ctl writes a control message to the window.
+	Ctl(format string, args ...interface{}) error
+	// Read reads from the named file of the window.
+	Read(file string, b []byte) (int, error)
+	// ReadAll reads the entire contents of the named file of the window.
+	ReadAll(file string) ([]byte, error)
+	// Seek sets the offset for the next Read of the named file of the window.
+	Seek(file string, offset int64, whence int) (int64, error)
+	// Write writes to the named file of the window.
+	Write(file string, b []byte) (int, error)
+}
+
+// Options control how Format applies the formatted text.
+type Options struct {
+	// Force applies the formatted text even if a check refuses it.
+	Force bool
+	// GotoChange selects the first lines changed by the formatter
+	// instead of restoring the selection.
+	GotoChange bool
+	// Merge, if the body was edited while the formatter ran,
+	// merges the edits with the formatted text instead of refusing it.
+	// Conflicting changes are marked in the body.
+	Merge bool
+	// UndoPerHunk makes each changed hunk a separate Undo step in Acme.
+	// Otherwise a single Undo reverts the whole format.
+	UndoPerHunk bool
+	// LineCol restores the selection to the same lines and columns,
+	// instead of the same rune offsets,
+	// which keeps it in place when the formatter changes earlier lines
+	// without adding or removing lines.
+	LineCol bool
+	// Rewrite re-writes the whole body with the formatted text,
+	// instead of only the lines that changed.
+	// Acme then scrolls to the top of the body,
+	// so the selection is scrolled into view afterwards.
+	// Otherwise the lines on screen stay there.
+	Rewrite bool
+	// Keep keeps the temporary file holding the formatter's output
+	// instead of removing it, and names it in the Result,
+	// or if the formatter fails, in the FormatterError.
+	Keep bool
+}
+
+// A Result describes the outcome of Format.
+type Result struct {
+	// Body is the body of the window as given to the formatter.
+	// It is nil if Spilled.
+	Body []byte
+	// Formatted is the formatted text.
+	// It is only set if the body was changed, and not Spilled.
+	Formatted []byte
+	// Spilled is whether the body was larger than MaxMemory,
+	// so that it and the formatted text were held in temporary files
+	// rather than in memory.
+	Spilled bool
+	// Changed is whether the body was re-written.
+	Changed bool
+	// Q0 and Q1 are the rune offsets of the selection before formatting.
+	Q0, Q1 int
+	// OutputFile, if Options.Keep was set, is the name of the kept file
+	// holding the formatter's output.
+	OutputFile string
+	// Stats are the times taken by the steps of Format
+	// and the sizes of the text.
+	Stats Stats
+	// Warnings describe the problems that did not stop Format,
+	// such as failing to remove a temporary file,
+	// for the caller to report.
+	Warnings []string
+}
+
+// warnf adds a warning to r.
+func (r *Result) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Stats are the times taken by the steps of Format
+// and the sizes of the text, for finding where the time goes.
+type Stats struct {
+	// Read is the time spent reading the body.
+	// The body is read as the formatter consumes it,
+	// so Read overlaps Format.
+	Read time.Duration
+	// Format is the time that the formatter ran,
+	// including the reading of the body that it consumed.
+	Format time.Duration
+	// Diff is the time spent comparing the formatted text with the body.
+	Diff time.Duration
+	// Write is the time spent re-writing the body.
+	Write time.Duration
+	// In and Out are the sizes in bytes of the body
+	// and of the formatted text.
+	In, Out int
+}
+
+// A RefusalError is returned by Format when a check declines
+// to apply the formatted text to the body.
+type RefusalError struct {
+	// Reason describes why the formatted text was refused.
+	Reason string
+}
+
+func (r *RefusalError) Error() string { return "refusing to apply: " + r.Reason }
+
+// A FormatterError is returned when the Formatter fails.
+type FormatterError struct {
+	// Err is the error returned by the Formatter.
+	Err error
+	// OutputFile, if Options.Keep was set, is the name of the kept file
+	// holding the formatter's output.
+	OutputFile string
+}
+
+func (e *FormatterError) Error() string { return "format failed: " + e.Err.Error() }
+
+// Unwrap returns e.Err.
+func (e *FormatterError) Unwrap() error { return e.Err }
+
+// Format formats the body of win with f and, if the body changed,
+// re-writes it with the formatted text and restores the selection.
+// If f fails, the body is left unchanged.
+// If re-writing the body fails, the original body is written back.
+// If the body was edited while f ran, Format returns a RefusalError
+// instead of overwriting the edits, or with opts.Merge,
+// merges the edits with the formatted text,
+// or with opts.Force, overwrites them.
+// The edits to a body larger than MaxMemory cannot be merged.
+//
+// The returned Result is non-nil if the formatter ran,
+// even if the error is non-nil.
+func Format(win Window, f Formatter, opts Options) (*Result, error) {
+	q0, q1, err := ReadAddr(win)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current selection: %s", err)
+	}
+	start := time.Now()
+	o, err := run(win, f, opts.Keep)
+	stats := Stats{Read: o.read, Format: time.Since(start), In: o.nin, Out: o.nout}
+	var kept string
+	if opts.Keep {
+		kept = o.outFile
+	}
+	if err != nil {
+		o.remove(opts.Keep, ignoreWarning)
+		return nil, &FormatterError{Err: err, OutputFile: kept}
+	}
+	res := &Result{Body: o.body, Q0: q0, Q1: q1, OutputFile: kept, Spilled: o.bodyFile != "", Stats: stats}
+	defer o.remove(opts.Keep, res.warnf)
+	if o.nout == 0 && o.nin > 0 && !opts.Force {
+		return res, &RefusalError{"the formatter output is empty"}
+	}
+	if res.Spilled {
+		return formatSpilled(win, res, o, opts)
+	}
+	body, formatted, nout := o.body, o.formatted, o.nout
+	if o.outFile != "" {
+		if formatted, err = ioutil.ReadFile(o.outFile); err != nil {
+			return res, fmt.Errorf("failed to read the formatted text: %s", err)
+		}
+	}
+	// Both sizes are in bytes of UTF-8, as read from the body file.
+	// Only the addresses are in runes.
+	diff := len(body) != nout
+	if !diff {
+		start := time.Now()
+		diff, err = bodyDiff(win, bytes.NewReader(formatted))
+		res.Stats.Diff = time.Since(start)
+		if err != nil {
+			// Not fatal. Re-write the body anyway.
+			res.warnf("failed to diff the body: %s", err)
+			diff = true
+		}
+	}
+	if !diff {
+		return res, nil
+	}
+	// The user may have typed while the formatter ran.
+	// The formatted text would lose those edits.
+	start = time.Now()
+	cur, err := ReadBody(win)
+	res.Stats.Read += time.Since(start)
+	if err != nil {
+		return res, fmt.Errorf("failed to read the body: %s", err)
+	}
+	if !bytes.Equal(cur, body) {
+		switch {
+		case opts.Merge:
+			return merge(win, res, cur, formatted)
+		case !opts.Force:
+			return res, &RefusalError{"the body changed while the formatter ran"}
+		}
+		// Forced, so the formatted text replaces the edits.
+		body = cur
+		res.Body = cur
+	}
+	res.Formatted = formatted
+	res.Changed = true
+	start = time.Now()
+	if opts.Rewrite {
+		err = writeBody(win, bytes.NewReader(formatted), res.warnf)
+	} else {
+		err = writeHunks(win, body, formatted, opts.UndoPerHunk, res.warnf)
+	}
+	res.Stats.Write = time.Since(start)
+	if err != nil {
+		// The body may be partly re-written, so put back the original.
+		if rerr := writeBody(win, bytes.NewReader(body), res.warnf); rerr != nil {
+			return res, fmt.Errorf("failed to write the body: %s; failed to restore it: %s", err, rerr)
+		}
+		res.Changed = false
+		ShowAddr(win, q0, q1)
+		return res, fmt.Errorf("failed to write the body, so it was restored: %s", err)
+	}
+	if opts.LineCol {
+		l0, c0 := lineCol(body, q0)
+		l1, c1 := lineCol(body, q1)
+		q0, q1 = offset(formatted, l0, c0), offset(formatted, l1, c1)
+	}
+	show := ShowAddr
+	if !opts.Rewrite {
+		// The view did not move, so leave it.
+		show = SetAddr
+	}
+	if opts.GotoChange {
+		q0, q1 = firstChange(body, formatted)
+		show = ShowAddr
+	}
+	if err := show(win, q0, q1); err != nil {
+		return res, fmt.Errorf("failed to restore the selection: %s", err)
+	}
+	return res, nil
+}
+
+// merge re-writes the body of win, which is cur, with the merge
+// of the changes from res.Body to cur and the changes from res.Body to formatted,
+// and restores the selection.
+// If any changes conflict, it returns an error saying how many.
+func merge(win Window, res *Result, cur, formatted []byte) (*Result, error) {
+	q0, q1, err := ReadAddr(win)
+	if err != nil {
+		return res, fmt.Errorf("failed to get the current selection: %s", err)
+	}
+	lines, n := Merge(SplitLines(string(res.Body)), SplitLines(string(cur)), SplitLines(string(formatted)), "edited", "formatted")
+	merged := strings.Join(lines, "")
+	if merged == string(cur) {
+		return res, nil
+	}
+	res.Body = cur
+	res.Formatted = []byte(merged)
+	res.Changed = true
+	if err := writeBody(win, strings.NewReader(merged), res.warnf); err != nil {
+		return res, fmt.Errorf("failed to write the body: %s", err)
+	}
+	if err := ShowAddr(win, q0, q1); err != nil {
+		return res, fmt.Errorf("failed to restore the selection: %s", err)
+	}
+	if n > 0 {
+		return res, fmt.Errorf("the body changed while the formatter ran: %d conflicts are marked in the body", n)
+	}
+	return res, nil
+}
+
+// formatSpilled finishes Format for a body larger than MaxMemory,
+// whose text and formatted text are in the temporary files of o,
+// without reading either into memory.
+// The edits made while the formatter ran cannot be merged,
+// and the whole body is re-written.
+func formatSpilled(win Window, res *Result, o *output, opts Options) (*Result, error) {
+	diff := o.nin != o.nout
+	if !diff {
+		start := time.Now()
+		d, err := fileDiff(win, o.outFile)
+		res.Stats.Diff = time.Since(start)
+		if err != nil {
+			// Not fatal. Re-write the body anyway.
+			res.warnf("failed to diff the body: %s", err)
+			d = true
+		}
+		diff = d
+	}
+	if !diff {
+		return res, nil
+	}
+	start := time.Now()
+	edited, err := fileDiff(win, o.bodyFile)
+	res.Stats.Read += time.Since(start)
+	if err != nil {
+		return res, fmt.Errorf("failed to read the body: %s", err)
+	}
+	if edited {
+		switch {
+		case !opts.Force && opts.Merge:
+			return res, &RefusalError{"the body changed while the formatter ran, and is too large to merge"}
+		case !opts.Force:
+			return res, &RefusalError{"the body changed while the formatter ran"}
+		}
+		// Forced, so the formatted text replaces the edits,
+		// which are kept in place of the body in case the write fails.
+		if err := saveBody(win, o.bodyFile); err != nil {
+			return res, fmt.Errorf("failed to read the body: %s", err)
+		}
+	}
+	res.Changed = true
+	start = time.Now()
+	err = writeFile(win, o.outFile, res.warnf)
+	res.Stats.Write = time.Since(start)
+	if err != nil {
+		if rerr := writeFile(win, o.bodyFile, res.warnf); rerr != nil {
+			return res, fmt.Errorf("failed to write the body: %s; failed to restore it: %s", err, rerr)
+		}
+		res.Changed = false
+		ShowAddr(win, res.Q0, res.Q1)
+		return res, fmt.Errorf("failed to write the body, so it was restored: %s", err)
+	}
+	q0, q1 := res.Q0, res.Q1
+	var perr error
+	switch {
+	case opts.GotoChange:
+		q0, q1, perr = firstChangedLine(o.bodyFile, o.outFile)
+	case opts.LineCol:
+		q0, q1, perr = fileLineCol(o.bodyFile, o.outFile, q0, q1)
+	}
+	if perr != nil {
+		// Not fatal. Restore the selection by offset instead.
+		res.warnf("failed to find the selection: %s", perr)
+		q0, q1 = res.Q0, res.Q1
+	}
+	// The whole body was re-written, so scroll to the selection.
+	if err := ShowAddr(win, q0, q1); err != nil {
+		return res, fmt.Errorf("failed to restore the selection: %s", err)
+	}
+	return res, nil
+}
+
+// fileDiff returns whether the body of win differs from the contents of the file.
+func fileDiff(win Window, file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return bodyDiff(win, f)
+}
+
+// writeFile replaces the body of win with the contents of the file,
+// as writeBody.
+func writeFile(win Window, file string, warnf func(string, ...interface{})) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeBody(win, bufio.NewReaderSize(f, chunkSize), warnf)
+}
+
+// saveBody replaces the contents of the file with the body of win.
+func saveBody(win Window, file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := win.Seek("body", 0, 0); err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.Copy(f, bufio.NewReaderSize(bodyReader{win}, chunkSize))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fileLineCol returns the rune offsets in the file of the formatted text
+// of the lines and columns of rune offsets q0 and q1 in the file of the body,
+// as Format does with Options.LineCol.
+func fileLineCol(bodyFile, outFile string, q0, q1 int) (int, int, error) {
+	b, err := os.Open(bodyFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer b.Close()
+	l0, c0 := readLineCol(bufio.NewReader(b), q0)
+	if _, err := b.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	l1, c1 := readLineCol(bufio.NewReader(b), q1)
+	f, err := os.Open(outFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	q0 = readOffset(bufio.NewReader(f), l0, c0)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	q1 = readOffset(bufio.NewReader(f), l1, c1)
+	return q0, q1, nil
+}
+
+// firstChangedLine returns the rune offsets, in the file of the formatted text,
+// of the first line that differs from the file of the body.
+func firstChangedLine(bodyFile, outFile string) (q0, q1 int, err error) {
+	b, err := os.Open(bodyFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer b.Close()
+	f, err := os.Open(outFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	br, fr := bufio.NewReader(b), bufio.NewReader(f)
+	// Q is the offset of the current rune of the formatted text.
+	q := 0
+	for {
+		rb, _, errb := br.ReadRune()
+		rf, _, errf := fr.ReadRune()
+		if errf != nil {
+			// The formatted text is a prefix of the body;
+			// the change is the deletion after its last line.
+			return q0, q, nil
+		}
+		q++
+		if errb != nil || rb != rf {
+			// The rest of the line, to its newline.
+			for r := rf; r != '\n'; q++ {
+				if r, _, errf = fr.ReadRune(); errf != nil {
+					break
+				}
+			}
+			return q0, q, nil
+		}
+		if rf == '\n' {
+			q0 = q
+		}
+	}
+}
+
+// lineCol returns the 0-based line and rune column of rune offset q in text.
+func lineCol(text []byte, q int) (line, col int) {
+	return readLineCol(bytes.NewReader(text), q)
+}
+
+// readLineCol returns the 0-based line and rune column of rune offset q
+// in the text read from r.
+func readLineCol(r io.RuneReader, q int) (line, col int) {
+	for q > 0 {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			break
+		}
+		q--
+		if col++; c == '\n' {
+			line++
+			col = 0
+		}
+	}
+	return line, col
+}
+
+// offset returns the rune offset in text of the 0-based line and rune column,
+// clamped to the end of the line, or of the text.
+func offset(text []byte, line, col int) int {
+	return readOffset(bytes.NewReader(text), line, col)
+}
+
+// readOffset returns the rune offset in the text read from r
+// of the 0-based line and rune column,
+// clamped to the end of the line, or of the text.
+func readOffset(r io.RuneReader, line, col int) int {
+	q := 0
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil || line == 0 && (col == 0 || c == '\n') {
+			break
+		}
+		q++
+		if c == '\n' {
+			line--
+		} else if line == 0 {
+			col--
+		}
+	}
+	return q
+}
+
+// firstChange returns the rune offsets in formatted
+// of the lines of the first difference from body.
+func firstChange(body, formatted []byte) (q0, q1 int) {
+	a, b := SplitLines(string(body)), SplitLines(string(formatted))
+	hs := Diff(a, b)
+	if len(hs) == 0 {
+		return 0, 0
+	}
+	for _, l := range b[:hs[0].B0] {
+		q0 += utf8.RuneCountInString(l)
+	}
+	q1 = q0
+	for _, l := range b[hs[0].B0:hs[0].B1] {
+		q1 += utf8.RuneCountInString(l)
+	}
+	return q0, q1
+}
+
+// Formatted formats the body of win with f, leaving the body unchanged.
+// It returns the body as given to the formatter and the formatted text.
+func Formatted(win Window, f Formatter) (body, formatted []byte, err error) {
+	o, err := run(win, f, false)
+	defer o.remove(false, ignoreWarning)
+	if err != nil {
+		return nil, nil, &FormatterError{Err: err}
+	}
+	body, formatted = o.body, o.formatted
+	if o.bodyFile != "" {
+		if body, err = ioutil.ReadFile(o.bodyFile); err != nil {
+			return nil, nil, fmt.Errorf("failed to read the body: %s", err)
+		}
+	}
+	if o.outFile != "" {
+		if formatted, err = ioutil.ReadFile(o.outFile); err != nil {
+			return nil, nil, fmt.Errorf("failed to read the formatted text: %s", err)
+		}
+	}
+	return body, formatted, nil
+}
+
+// ReadAddr returns the rune offsets of the selection of win.
+// It sets the address of win to the selection.
+func ReadAddr(win Window) (q0, q1 int, err error) {
+	// This first read is bogus.
+	// Acme zeroes the win's address the first time addr is opened.
+	// So, we need to open it before setting addr=dot,
+	// lest we just read back a zero address.
+	// Edwood doesn't zero the address, so it doesn't need the bogus read.
+	if _, ok := win.(edwood); !ok {
+		if _, _, err := win.ReadAddr(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := win.Ctl("addr=dot\n"); err != nil {
+		return 0, 0, err
+	}
+	return win.ReadAddr()
+}
+
+// SetAddr sets the selection of win to the rune offsets [q0, q1)
+// without scrolling the window.
+// Offsets past the end of the body are taken to be the end of the body.
+func SetAddr(win Window, q0, q1 int) error {
+	if err := clampAddr(win, q0, q1); err != nil {
+		return err
+	}
+	return win.Ctl("dot=addr\n")
+}
+
+// ShowAddr sets the selection of win to the rune offsets [q0, q1)
+// and scrolls the window to show it.
+// Offsets past the end of the body are taken to be the end of the body.
+func ShowAddr(win Window, q0, q1 int) error {
+	if err := clampAddr(win, q0, q1); err != nil {
+		return err
+	}
+	return win.Ctl("dot=addr\nshow\n")
+}
+
+// clampAddr sets the address of win to the rune offsets [q0, q1),
+// clamped to the size of the body,
+// which may have become shorter, for example by formatting.
+func clampAddr(win Window, q0, q1 int) error {
+	if win.Addr("#%d,#%d", q0, q1) == nil {
+		return nil
+	}
+	if err := win.Addr("$"); err != nil {
+		return err
+	}
+	_, n, err := win.ReadAddr()
+	if err != nil {
+		return err
+	}
+	if q1 > n {
+		q1 = n
+	}
+	if q0 > q1 {
+		q0 = q1
+	}
+	return win.Addr("#%d,#%d", q0, q1)
+}
+
+// WriteBody replaces the body of win with the contents of r,
+// as a single Undo step.
+// Failing to make it a single Undo step does not stop the write.
+func WriteBody(win Window, r io.Reader) error {
+	return writeBody(win, r, ignoreWarning)
+}
+
+// writeBody is WriteBody, calling warnf with the problems that do not stop the write.
+func writeBody(win Window, r io.Reader, warnf func(string, ...interface{})) error {
+	defer undoStep(win, warnf)()
+	if err := win.Addr("0,$"); err != nil {
+		return err
+	}
+	_, err := io.Copy(dataWriter{win}, r)
+	return err
+}
+
+// undoStep begins a new Undo step holding the writes to win
+// until the returned function is called.
+// Acme adds writes made under nomark to the current Undo step,
+// which holds the user's most recent typing,
+// so mark first to begin a new step for the format.
+func undoStep(win Window, warnf func(string, ...interface{})) (end func()) {
+	if err := win.Ctl("mark"); err != nil {
+		warnf("failed to set mark: %s", err)
+	}
+	if err := win.Ctl("nomark"); err != nil {
+		warnf("failed to set nomark: %s", err)
+	}
+	return func() {
+		if err := win.Ctl("mark"); err != nil {
+			warnf("failed to set mark: %s", err)
+		}
+	}
+}
+
+// ignoreWarning is the warnf of the callers who have nowhere to report warnings.
+func ignoreWarning(string, ...interface{}) {}
+
+// WriteHunks changes the body of win, which is body, to formatted
+// by re-writing only the lines that differ,
+// so that Acme keeps the same lines on screen.
+// If perHunk is set, each hunk is a separate Undo step,
+// otherwise the change is a single Undo step.
+// Failing to make it a single Undo step does not stop the write.
+func WriteHunks(win Window, body, formatted []byte, perHunk bool) error {
+	return writeHunks(win, body, formatted, perHunk, ignoreWarning)
+}
+
+// writeHunks is WriteHunks, calling warnf with the problems that do not stop the write.
+func writeHunks(win Window, body, formatted []byte, perHunk bool, warnf func(string, ...interface{})) error {
+	if !perHunk {
+		defer undoStep(win, warnf)()
+	}
+	a, b := SplitLines(string(body)), SplitLines(string(formatted))
+	hs := Diff(a, b)
+	// The offset of each line of a.
+	offs := make([]int, len(a)+1)
+	for i, l := range a {
+		offs[i+1] = offs[i] + utf8.RuneCountInString(l)
+	}
+	// Write from the end, so that the offsets of earlier hunks are unchanged.
+	for i := len(hs) - 1; i >= 0; i-- {
+		h := hs[i]
+		if perHunk {
+			if err := win.Ctl("mark"); err != nil {
+				return err
+			}
+		}
+		a0, a1 := h.A0, h.A1
+		text := strings.Join(b[h.B0:h.B1], "")
+		// Acme may ignore an empty write, so a deletion
+		// re-writes an adjacent line, if there is one.
+		switch {
+		case text != "":
+		case a1 < len(a):
+			text = a[a1]
+			a1++
+		case a0 > 0:
+			a0--
+			text = a[a0]
+		}
+		if err := win.Addr("#%d,#%d", offs[a0], offs[a1]); err != nil {
+			return err
+		}
+		var err error
+		if text == "" {
+			// The whole body is deleted.
+			_, err = win.Write("data", nil)
+		} else {
+			_, err = dataWriter{win}.Write([]byte(text))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An output is the result of running a Formatter over the body of a window.
+type output struct {
+	// Body is the body as given to the formatter,
+	// unless it was larger than MaxMemory, when it is in bodyFile instead.
+	body     []byte
+	bodyFile string
+	// Formatted is the formatted text, unless it is in outFile instead.
+	formatted []byte
+	outFile   string
+	// Nin and nout are the sizes in bytes of the body and formatted text.
+	nin, nout int
+	// Read is the time spent reading the body.
+	read time.Duration
+}
+
+// remove removes the temporary files of o, except outFile if keep is set,
+// calling warnf with those it fails to remove.
+func (o *output) remove(keep bool, warnf func(string, ...interface{})) {
+	files := []string{o.bodyFile}
+	if !keep {
+		files = append(files, o.outFile)
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			warnf("failed to remove tempfile %s: %s", f, err)
+		}
+	}
+}
+
+// run runs f over the body of win.
+// The body and the formatted text are held in memory
+// if the body is at most MaxMemory bytes,
+// and otherwise written to temporary files as the formatter runs.
+// If keep is set, the formatted text is written to a temporary file regardless.
+// The returned output is non-nil even if the error is non-nil,
+// and its files must be removed by the caller.
+func run(win Window, f Formatter, keep bool) (*output, error) {
+	o := &output{}
+	// The window may have been read before, for example by a resident Fmt.
+	if _, err := win.Seek("body", 0, 0); err != nil {
+		return o, err
+	}
+	size := bodySize(win)
+	spill := size > MaxMemory
+	var out io.Writer
+	var fb bytes.Buffer
+	var tf *os.File
+	if keep || spill {
+		var err error
+		if tf, err = ioutil.TempFile(tempDir(), "Fmt"); err != nil {
+			return o, err
+		}
+		o.outFile, out = tf.Name(), tf
+	} else {
+		fb.Grow(size)
+		out = &fb
+	}
+	var in io.Writer
+	var bb bytes.Buffer
+	var bf *os.File
+	if spill {
+		var err error
+		if bf, err = ioutil.TempFile(tempDir(), "Fmt"); err != nil {
+			tf.Close()
+			return o, err
+		}
+		o.bodyFile, in = bf.Name(), bf
+	} else {
+		bb.Grow(size)
+		in = &bb
+	}
+	// Formatters may read in small pieces; buffer to read whole messages.
+	tr := &timedReader{r: bufio.NewReaderSize(bodyReader{win}, chunkSize)}
+	br := &countReader{0, io.TeeReader(tr, in)}
+	fw := &countWriter{0, out}
+	err := f.Format(fw, br)
+	for _, f := range []*os.File{tf, bf} {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if !spill {
+		o.body = bb.Bytes()
+	}
+	if tf == nil {
+		o.formatted = fb.Bytes()
+	}
+	o.nin, o.nout, o.read = br.count, fw.count, tr.d
+	return o, err
+}
+
+// bodyDiff returns whether the body of win differs from the text read from r.
+func bodyDiff(win Window, r io.Reader) (bool, error) {
+	win.Seek("body", 0, 0)
+	fr := bufio.NewReaderSize(r, chunkSize)
+	br := bufio.NewReaderSize(&bodyReader{win}, chunkSize)
+	for {
+		fb, errf := fr.ReadByte()
+		if errf != nil && errf != io.EOF {
+			return false, errf
+		}
+		bb, errb := br.ReadByte()
+		if errb != nil && errb != io.EOF {
+			return false, errb
+		}
+		if fb != bb {
+			return true, nil
+		}
+		if errf == io.EOF && errb == io.EOF {
+			return false, nil
+		}
+	}
+}
+
+// ReadBody reads the entire body of win.
+// Unlike ReadAll, it reads in chunks of chunkSize
+// into a buffer sized up front from the length in the ctl file,
+// so a large body takes as few messages and copies as it can.
+func ReadBody(win Window) ([]byte, error) {
+	if _, err := win.Seek("body", 0, 0); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, bodySize(win)+chunkSize)
+	for {
+		if cap(b)-len(b) < chunkSize {
+			nb := make([]byte, len(b), 2*cap(b)+chunkSize)
+			copy(nb, b)
+			b = nb
+		}
+		n, err := win.Read("body", b[len(b):len(b)+chunkSize])
+		b = b[:len(b)+n]
+		switch {
+		case err == io.EOF || err == nil && n == 0:
+			return b, nil
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+// bodySize returns the size in bytes to expect of the body of win.
+// The ctl file gives the length in runes, which is a lower bound;
+// the body of most files is mostly ASCII, so it is close.
+// If the ctl file cannot be read, bodySize returns 0.
+func bodySize(win Window) int {
+	ctl, err := win.ReadAll("ctl")
+	if err != nil {
+		return 0
+	}
+	f := strings.Fields(string(ctl))
+	if len(f) < 3 {
+		return 0
+	}
+	n, err := strconv.Atoi(f[2])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+type bodyReader struct{ Window }
+
+func (r bodyReader) Read(data []byte) (int, error) {
+	return r.Window.Read("body", data)
+}
+
+// chunkSize is the size of reads of the body and writes to the data file.
+// Acme's 9P message size is 8192 bytes plus the header,
+// so this is the most data that one message carries.
+const chunkSize = 8192
+
+// A dataWriter writes to the data file of a window
+// in pieces that each hold only whole UTF-8 encoded runes.
+// Acme joins a rune split across writes, but other servers,
+// such as Edwood, may replace its pieces with U+FFFD,
+// and the 9P client splits large writes wherever the message size falls.
+type dataWriter struct{ Window }
+
+func (w dataWriter) Write(data []byte) (int, error) {
+	var n int
+	for len(data) > 0 {
+		m := len(data)
+		if m > chunkSize {
+			m = chunkSize
+			for m > 0 && !utf8.RuneStart(data[m]) {
+				m--
+			}
+			if m == 0 {
+				// Not UTF-8; nothing to keep whole.
+				m = chunkSize
+			}
+		}
+		k, err := w.Window.Write("data", data[:m])
+		n += k
+		if err != nil {
+			return n, err
+		}
+		data = data[m:]
+	}
+	return n, nil
+}
+
+type countReader struct {
+	count int
+	r     io.Reader
+}
+
+func (r *countReader) Read(data []byte) (int, error) {
+	n, err := r.r.Read(data)
+	r.count += n
+	return n, err
+}
+
+// A timedReader reads from r, adding the time spent reading to d.
+type timedReader struct {
+	r io.Reader
+	d time.Duration
+}
+
+func (r *timedReader) Read(data []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(data)
+	r.d += time.Since(start)
+	return n, err
+}
+
+type countWriter struct {
+	count int
+	w     io.Writer
+}
+
+func (w *countWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.count += n
+	return n, err
+}
@@ -0,0 +1,384 @@
+package fmtharness_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+	"github.com/eaburns/Fmt/fmtharness/acmetest"
+)
+
+// A formatFunc is a Formatter that formats with a function of the whole text.
+type formatFunc func(string) string
+
+func (f formatFunc) Format(dst io.Writer, src io.Reader) error {
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, f(string(b)))
+	return err
+}
+
+// replace returns a formatFunc that replaces old with new.
+func replace(old, new string) formatFunc {
+	return func(s string) string { return strings.ReplaceAll(s, old, new) }
+}
+
+// memoryModes are the settings of MaxMemory with which Format is tested:
+// holding the text in memory, and in temporary files.
+var memoryModes = []struct {
+	name string
+	max  int
+}{
+	{"memory", 1 << 20},
+	{"files", 0},
+}
+
+// setMaxMemory sets MaxMemory to max, and TempDir to a directory of the test,
+// returning the function that restores them.
+func setMaxMemory(t testing.TB, max int) func() {
+	dir, mem := fmtharness.TempDir, fmtharness.MaxMemory
+	fmtharness.TempDir, fmtharness.MaxMemory = t.TempDir(), max
+	return func() { fmtharness.TempDir, fmtharness.MaxMemory = dir, mem }
+}
+
+func TestFormatRestoresSelection(t *testing.T) {
+	for _, m := range memoryModes {
+		t.Run(m.name, func(t *testing.T) {
+			defer setMaxMemory(t, m.max)()
+			testFormatRestoresSelection(t)
+		})
+	}
+}
+
+func testFormatRestoresSelection(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		f              formatFunc
+		opts           fmtharness.Options
+		q0, q1         int
+		want           string
+		wantQ0, wantQ1 int
+	}{
+		{
+			name:   "change after the selection",
+			body:   "a\nb  c\n",
+			f:      replace("  ", " "),
+			q0:     0,
+			q1:     1,
+			want:   "a\nb c\n",
+			wantQ0: 0,
+			wantQ1: 1,
+		},
+		{
+			name:   "empty selection",
+			body:   "ab\nc  d\n",
+			f:      replace("  ", " "),
+			q0:     1,
+			q1:     1,
+			want:   "ab\nc d\n",
+			wantQ0: 1,
+			wantQ1: 1,
+		},
+		{
+			name:   "clamped to the shorter body",
+			body:   "a  b  c\n",
+			f:      replace("  ", " "),
+			q0:     5,
+			q1:     8,
+			want:   "a b c\n",
+			wantQ0: 5,
+			wantQ1: 6,
+		},
+		{
+			name:   "line and column",
+			body:   "a  b\ncd\n",
+			f:      replace("  ", " "),
+			opts:   fmtharness.Options{LineCol: true},
+			q0:     6,
+			q1:     7,
+			want:   "a b\ncd\n",
+			wantQ0: 5,
+			wantQ1: 6,
+		},
+		{
+			name:   "line and column in a multi-byte line",
+			body:   "α  β\nγδ\n",
+			f:      replace("  ", " "),
+			opts:   fmtharness.Options{LineCol: true},
+			q0:     7,
+			q1:     7,
+			want:   "α β\nγδ\n",
+			wantQ0: 6,
+			wantQ1: 6,
+		},
+		{
+			name:   "go to the change",
+			body:   "a\nb\nc  d\ne\n",
+			f:      replace("  ", " "),
+			opts:   fmtharness.Options{GotoChange: true},
+			q0:     0,
+			q1:     0,
+			want:   "a\nb\nc d\ne\n",
+			wantQ0: 4,
+			wantQ1: 8,
+		},
+		{
+			name:   "rewrite",
+			body:   "a\nb  c\n",
+			f:      replace("  ", " "),
+			opts:   fmtharness.Options{Rewrite: true},
+			q0:     2,
+			q1:     3,
+			want:   "a\nb c\n",
+			wantQ0: 2,
+			wantQ1: 3,
+		},
+		{
+			name:   "unchanged",
+			body:   "a\nb\n",
+			f:      replace("  ", " "),
+			q0:     1,
+			q1:     3,
+			want:   "a\nb\n",
+			wantQ0: 1,
+			wantQ1: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			win := acmetest.New("/tmp/x.go", test.body)
+			win.SetDot(test.q0, test.q1)
+			res, err := fmtharness.Format(win, test.f, test.opts)
+			if err != nil {
+				t.Fatalf("Format()=_, %v, want nil", err)
+			}
+			if got := win.Body(); got != test.want {
+				t.Errorf("body=%q, want %q", got, test.want)
+			}
+			if res.Changed != (test.want != test.body) {
+				t.Errorf("Changed=%v, want %v", res.Changed, test.want != test.body)
+			}
+			if q0, q1 := win.Dot(); q0 != test.wantQ0 || q1 != test.wantQ1 {
+				t.Errorf("dot=%d,%d, want %d,%d", q0, q1, test.wantQ0, test.wantQ1)
+			}
+		})
+	}
+}
+
+var writeHunksTests = []struct {
+	name            string
+	body, formatted string
+}{
+	{name: "unchanged", body: "a\nb\n", formatted: "a\nb\n"},
+	{name: "change a line", body: "a\nb\nc\n", formatted: "a\nB\nc\n"},
+	{name: "insert at the start", body: "b\nc\n", formatted: "a\nb\nc\n"},
+	{name: "append at the end", body: "a\nb\n", formatted: "a\nb\nc\n"},
+	{name: "delete a line", body: "a\nb\nc\n", formatted: "a\nc\n"},
+	{name: "delete the first line", body: "a\nb\n", formatted: "b\n"},
+	{name: "delete the last line", body: "a\nb\n", formatted: "a\n"},
+	{name: "delete everything", body: "a\nb\n", formatted: ""},
+	{name: "from empty", body: "", formatted: "a\n"},
+	{name: "add the final newline", body: "a\nb", formatted: "a\nb\n"},
+	{name: "several hunks", body: "a\nb\nc\nd\ne\nf\n", formatted: "A\nb\nc\nd\nE\nF\ng\n"},
+	{name: "multi-byte runes", body: "α\nβ\nγ\nδ\n", formatted: "α\nβ β\nγ\nδδ\n"},
+}
+
+func TestWriteHunks(t *testing.T) {
+	for _, perHunk := range []bool{false, true} {
+		for _, test := range writeHunksTests {
+			win := acmetest.New("/tmp/x.go", test.body)
+			if err := fmtharness.WriteHunks(win, []byte(test.body), []byte(test.formatted), perHunk); err != nil {
+				t.Errorf("%s: WriteHunks(perHunk=%v)=%v, want nil", test.name, perHunk, err)
+				continue
+			}
+			if got := win.Body(); got != test.formatted {
+				t.Errorf("%s: WriteHunks(perHunk=%v) body=%q, want %q", test.name, perHunk, got, test.formatted)
+			}
+		}
+	}
+}
+
+func TestWriteBody(t *testing.T) {
+	win := acmetest.New("/tmp/x.go", "a\nb\n")
+	// Longer than a write to the data file, split within a rune.
+	text := "x" + strings.Repeat("αβγ\n", 4096)
+	if err := fmtharness.WriteBody(win, strings.NewReader(text)); err != nil {
+		t.Fatalf("WriteBody()=%v, want nil", err)
+	}
+	if got := win.Body(); got != text {
+		t.Errorf("body is %d bytes, want %d bytes of text", len(got), len(text))
+	}
+}
+
+// A failingWin is a fake window whose nth write to the data file fails.
+type failingWin struct {
+	*acmetest.Win
+	n, writes int
+}
+
+func (w *failingWin) Write(file string, b []byte) (int, error) {
+	if file == "data" {
+		if w.writes++; w.writes == w.n {
+			return 0, errors.New("write failed")
+		}
+	}
+	return w.Win.Write(file, b)
+}
+
+func TestFormatRestoresBodyWhenWriteFails(t *testing.T) {
+	const body = "a  b\nc\nd  e\n"
+	tests := []struct {
+		name string
+		max  int
+		// N is the write to the data file that fails.
+		n int
+	}{
+		// The hunks are written from the end,
+		// so the second write fails after the last line was re-written.
+		{"memory", 1 << 20, 2},
+		// The whole body is written at once.
+		{"files", 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setMaxMemory(t, test.max)()
+			win := &failingWin{Win: acmetest.New("/tmp/x.go", body), n: test.n}
+			win.SetDot(5, 6)
+			res, err := fmtharness.Format(win, replace("  ", " "), fmtharness.Options{})
+			if err == nil {
+				t.Fatalf("Format()=_, nil, want an error")
+			}
+			if res.Changed {
+				t.Errorf("Changed=true, want false")
+			}
+			if got := win.Body(); got != body {
+				t.Errorf("body=%q, want %q", got, body)
+			}
+			if q0, q1 := win.Dot(); q0 != 5 || q1 != 6 {
+				t.Errorf("dot=%d,%d, want 5,6", q0, q1)
+			}
+		})
+	}
+}
+
+// A noMarkWin is a fake window that fails to set the Undo marks.
+type noMarkWin struct{ *acmetest.Win }
+
+func (w noMarkWin) Ctl(format string, args ...interface{}) error {
+	if format == "mark" || format == "nomark" {
+		return errors.New("bad ctl")
+	}
+	return w.Win.Ctl(format, args...)
+}
+
+func TestFormatWarnsOfMarks(t *testing.T) {
+	for _, opts := range []fmtharness.Options{{}, {Rewrite: true}} {
+		win := noMarkWin{acmetest.New("/tmp/x.go", "a  b\n")}
+		res, err := fmtharness.Format(win, replace("  ", " "), opts)
+		if err != nil {
+			t.Fatalf("Format(Rewrite=%v)=_, %v, want nil", opts.Rewrite, err)
+		}
+		if got, want := win.Body(), "a b\n"; got != want {
+			t.Errorf("Format(Rewrite=%v) body=%q, want %q", opts.Rewrite, got, want)
+		}
+		want := []string{
+			"failed to set mark: bad ctl",
+			"failed to set nomark: bad ctl",
+			"failed to set mark: bad ctl",
+		}
+		if !reflect.DeepEqual(res.Warnings, want) {
+			t.Errorf("Format(Rewrite=%v) Warnings=%q, want %q", opts.Rewrite, res.Warnings, want)
+		}
+	}
+}
+
+func TestFormatRefusesEditedBody(t *testing.T) {
+	const body = "a  b\n"
+	for _, m := range memoryModes {
+		t.Run(m.name, func(t *testing.T) {
+			defer setMaxMemory(t, m.max)()
+			win := acmetest.New("/tmp/x.go", body)
+			edit := func(s string) string {
+				// The user types while the formatter runs.
+				win.Write("body", []byte("c\n"))
+				return strings.ReplaceAll(s, "  ", " ")
+			}
+			_, err := fmtharness.Format(win, formatFunc(edit), fmtharness.Options{})
+			var refusal *fmtharness.RefusalError
+			if !errors.As(err, &refusal) {
+				t.Fatalf("Format()=_, %v, want a RefusalError", err)
+			}
+			if got, want := win.Body(), body+"c\n"; got != want {
+				t.Errorf("body=%q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatForcedOverEdits(t *testing.T) {
+	for _, m := range memoryModes {
+		t.Run(m.name, func(t *testing.T) {
+			defer setMaxMemory(t, m.max)()
+			win := acmetest.New("/tmp/x.go", "a  b\n")
+			edit := func(s string) string {
+				win.Write("body", []byte("c\n"))
+				return strings.ReplaceAll(s, "  ", " ")
+			}
+			res, err := fmtharness.Format(win, formatFunc(edit), fmtharness.Options{Force: true})
+			if err != nil {
+				t.Fatalf("Format()=_, %v, want nil", err)
+			}
+			if !res.Changed || res.Spilled != (m.max == 0) {
+				t.Errorf("Changed=%v, Spilled=%v, want true, %v", res.Changed, res.Spilled, m.max == 0)
+			}
+			if got, want := win.Body(), "a b\n"; got != want {
+				t.Errorf("body=%q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteHunks(b *testing.B) {
+	text, changed := benchText(10000, 100)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		win := acmetest.New("/tmp/x.go", text)
+		b.StartTimer()
+		if err := fmtharness.WriteHunks(win, []byte(text), []byte(changed), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFormat(b *testing.B) {
+	text, changed := benchText(10000, 100)
+	f := formatFunc(func(string) string { return changed })
+	for _, bench := range []struct {
+		name string
+		max  int
+		opts fmtharness.Options
+	}{
+		{"hunks", 1 << 30, fmtharness.Options{}},
+		{"rewrite", 1 << 30, fmtharness.Options{Rewrite: true}},
+		{"files", 0, fmtharness.Options{}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			defer setMaxMemory(b, bench.max)()
+			b.SetBytes(int64(len(text)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				win := acmetest.New("/tmp/x.go", text)
+				b.StartTimer()
+				if _, err := fmtharness.Format(win, f, bench.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
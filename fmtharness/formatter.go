@@ -0,0 +1,329 @@
+package fmtharness
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Formatter formats source text.
+type Formatter interface {
+	// Format writes the formatted form of the text read from src to dst.
+	// If Format returns an error, the text written to dst is discarded.
+	Format(dst io.Writer, src io.Reader) error
+}
+
+// A Command is a Formatter that runs an external command,
+// giving it the source text on standard input
+// and taking the formatted text from its standard output.
+type Command struct {
+	// Args is the command name followed by its arguments.
+	Args []string
+	// Wrapper, if non-empty, is a command name and arguments
+	// that run the command given as its final arguments,
+	// such as nice -n 10.
+	// Args is run by the wrapper.
+	Wrapper []string
+	// Dir is the directory in which to run the command.
+	// If Dir is empty, the command is run in the current directory.
+	Dir string
+	// Stderr receives the standard error of the command.
+	// If Stderr is nil, it goes to the standard error of this process.
+	Stderr io.Writer
+	// MaxStdin, if positive, is the size in bytes of the largest text
+	// given to the command on standard input.
+	// Larger text is instead written to a temporary file,
+	// whose name is appended to Args,
+	// for commands that fail on large inputs.
+	MaxStdin int64
+	// Suffix is the suffix of the name of the temporary file,
+	// such as .js, for commands that choose a language by file name.
+	Suffix string
+	// Trace, if non-nil, receives a line for each run of the command,
+	// giving its arguments, its directory, and the time that it took.
+	Trace io.Writer
+	// Env are variables, each of the form key=value,
+	// added to the environment of the command.
+	Env []string
+	// ReadTimeout, if positive, is how long the command may run
+	// without reading any of its standard input or writing any output
+	// before it is killed and Format returns ErrUnread,
+	// for tools that ignore standard input and would wait forever.
+	// It is only enforced on Linux.
+	ReadTimeout time.Duration
+}
+
+// ErrUnread is returned, wrapped, by Command.Format
+// when the command does not read its standard input within its ReadTimeout.
+var ErrUnread = errors.New("the command did not read its standard input")
+
+// Format runs the command.
+func (c Command) Format(dst io.Writer, src io.Reader) error {
+	args := c.Args
+	if c.MaxStdin > 0 {
+		var head bytes.Buffer
+		if _, err := io.CopyN(&head, src, c.MaxStdin+1); err != nil && err != io.EOF {
+			return err
+		}
+		src = io.MultiReader(&head, src)
+		if int64(head.Len()) > c.MaxStdin {
+			path, err := writeTemp(src, c.Suffix)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(path)
+			args = append(args[:len(args):len(args)], path)
+			src = nil
+		}
+	}
+	if len(c.Wrapper) > 0 {
+		args = append(append([]string(nil), c.Wrapper...), args...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Stdin = src
+	cmd.Stdout = dst
+	cmd.Stderr = c.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	start := time.Now()
+	var err error
+	if c.ReadTimeout > 0 && src != nil {
+		err = runWatched(cmd, c.ReadTimeout)
+	} else {
+		err = cmd.Run()
+	}
+	TraceRun(c.Trace, start, args, cmd.Dir, err)
+	return err
+}
+
+// runWatched runs cmd, killing it if after timeout it is still running
+// and has neither read any of its standard input nor written any output.
+func runWatched(cmd *exec.Cmd, timeout time.Duration) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// The read end is kept open, for unread to look at the pipe,
+	// until the command is done.
+	defer pr.Close()
+	src := cmd.Stdin
+	in := &tally{w: pw}
+	out := &tally{w: cmd.Stdout}
+	cmd.Stdin, cmd.Stdout = pr, out
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	var mu sync.Mutex
+	go func() {
+		io.Copy(in, src)
+		pw.Close()
+	}()
+	var stalled bool
+	t := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		n, ok := unread(pr)
+		if ok && n > 0 && n == in.n() && out.n() == 0 {
+			stalled = true
+			cmd.Process.Kill()
+		}
+	})
+	err = cmd.Wait()
+	t.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if stalled {
+		return fmt.Errorf("%w in %s", ErrUnread, timeout)
+	}
+	return err
+}
+
+// A tally is a Writer to w that counts the bytes written,
+// which may be read while it is written.
+type tally struct {
+	w     io.Writer
+	count int64
+}
+
+func (t *tally) Write(data []byte) (int, error) {
+	n, err := t.w.Write(data)
+	atomic.AddInt64(&t.count, int64(n))
+	return n, err
+}
+
+// n returns the number of bytes written.
+func (t *tally) n() int { return int(atomic.LoadInt64(&t.count)) }
+
+// A Pipeline is a Formatter that runs its Formatters in turn,
+// each formatting the output of the one before it.
+type Pipeline []Formatter
+
+// Format runs the Formatters of the pipeline at once,
+// connected by pipes.
+// It returns the error of the first Formatter that fails,
+// except that, as in a shell, a Formatter that fails
+// because a later one stopped reading its output is not counted.
+func (p Pipeline) Format(dst io.Writer, src io.Reader) error {
+	if len(p) == 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	var mu sync.Mutex
+	// Read[i] is whether the Formatter reading the output of p[i] finished.
+	read := make([]bool, len(p))
+	errs := make([]error, len(p))
+	finish := func(i int, err error, src io.Reader) {
+		mu.Lock()
+		defer mu.Unlock()
+		// The source of the first Formatter is not the pipeline's own,
+		// even if it is a pipe, as in a pipeline nested in another.
+		if pr, ok := src.(*io.PipeReader); ok && i > 0 {
+			// Stops the previous Formatter if its output was not all read.
+			pr.Close()
+			read[i-1] = true
+		}
+		if !read[i] {
+			errs[i] = err
+		}
+	}
+	var wg sync.WaitGroup
+	for i, f := range p[:len(p)-1] {
+		pr, pw := io.Pipe()
+		wg.Add(1)
+		go func(i int, f Formatter, src io.Reader) {
+			defer wg.Done()
+			err := f.Format(pw, src)
+			pw.CloseWithError(err)
+			finish(i, err, src)
+		}(i, f, src)
+		src = pr
+	}
+	finish(len(p)-1, p[len(p)-1].Format(dst, src), src)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Fallback is a Formatter that tries its Formatters in turn,
+// formatting with the first whose tool is installed.
+type Fallback []Formatter
+
+// Format formats with each Formatter of the Fallback in turn
+// until one succeeds or fails for a reason other than a missing tool,
+// returning the error of the last one tried.
+// Since a later Formatter may need to read the text again,
+// the text is read into memory, and each output is only written to dst
+// if its Formatter succeeds.
+func (f Fallback) Format(dst io.Writer, src io.Reader) error {
+	if len(f) == 1 {
+		return f[0].Format(dst, src)
+	}
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	for _, g := range f {
+		var out bytes.Buffer
+		if err = g.Format(&out, bytes.NewReader(text)); err == nil {
+			_, err = dst.Write(out.Bytes())
+			return err
+		}
+		if !Missing(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Missing returns whether err is the error of a Formatter
+// whose command is not installed: the command was not found,
+// or it exited with status 127, as do shells and wrappers, such as nice,
+// that cannot find the command that they run.
+func Missing(err error) bool {
+	var ee *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist):
+		return true
+	case errors.As(err, &ee):
+		return ee.ExitCode() == 127
+	}
+	return false
+}
+
+// A Fixpoint is a Formatter that re-runs a Formatter on its own output
+// until the output stops changing,
+// for formatters, or pipelines of them, that are not idempotent.
+type Fixpoint struct {
+	// Formatter is the Formatter to run.
+	Formatter Formatter
+	// Max is the most times to run the Formatter.
+	Max int
+	// Stderr, if non-nil, receives a warning
+	// if the output still changed on the last run.
+	Stderr io.Writer
+}
+
+// Format runs the Formatter on the text read from src,
+// and then on its output, until the output equals the input
+// or the Formatter has run f.Max times,
+// and writes the last output to dst.
+func (f Fixpoint) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	for n := 1; ; n++ {
+		var out bytes.Buffer
+		if err := f.Formatter.Format(&out, bytes.NewReader(text)); err != nil {
+			return err
+		}
+		if n > 1 && bytes.Equal(out.Bytes(), text) {
+			break
+		}
+		text = out.Bytes()
+		if n >= f.Max {
+			if f.Stderr != nil {
+				fmt.Fprintf(f.Stderr, "the output still changed after %d runs of the formatter; it is not idempotent\n", n)
+			}
+			break
+		}
+	}
+	_, err = dst.Write(text)
+	return err
+}
+
+// writeTemp writes the contents of r to a new temporary file
+// with the given name suffix, and returns its name.
+func writeTemp(r io.Reader, suffix string) (string, error) {
+	f, err := ioutil.TempFile(tempDir(), "Fmt*"+suffix)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,103 @@
+package fmtharness
+
+import (
+	"sort"
+	"strings"
+)
+
+// Merge merges the changes from the lines of orig to those of a
+// with the changes from orig to those of b, diff3-style.
+// Changes to different lines are both kept.
+// Overlapping changes that differ are a conflict,
+// marked in the merged lines by
+//
+//	<<<<<<< aName
+//	lines from a
+//	=======
+//	lines from b
+//	>>>>>>> bName
+//
+// Merge returns the merged lines and the number of conflicts.
+func Merge(orig, a, b []string, aName, bName string) (merged []string, conflicts int) {
+	type change struct {
+		Hunk
+		fromB bool
+	}
+	var cs []change
+	for _, h := range Diff(orig, a) {
+		cs = append(cs, change{h, false})
+	}
+	for _, h := range Diff(orig, b) {
+		cs = append(cs, change{h, true})
+	}
+	sort.SliceStable(cs, func(i, j int) bool { return cs[i].A0 < cs[j].A0 })
+
+	// apply returns orig[lo:hi] with the changes of one side applied.
+	apply := func(lo, hi int, side []change, text []string) []string {
+		var out []string
+		pos := lo
+		for _, c := range side {
+			out = append(out, orig[pos:c.A0]...)
+			out = append(out, text[c.B0:c.B1]...)
+			pos = c.A1
+		}
+		return append(out, orig[pos:hi]...)
+	}
+	pos := 0
+	for i := 0; i < len(cs); {
+		// Group the changes that overlap, or are insertions at the same place.
+		lo, hi := cs[i].A0, cs[i].A1
+		var as, bs []change
+		for ; i < len(cs); i++ {
+			c := cs[i]
+			if len(as)+len(bs) > 0 && !(c.A0 < hi || c.A0 == hi && (c.A0 == c.A1 || lo == hi)) {
+				break
+			}
+			if c.fromB {
+				bs = append(bs, c)
+			} else {
+				as = append(as, c)
+			}
+			if c.A1 > hi {
+				hi = c.A1
+			}
+		}
+		merged = append(merged, orig[pos:lo]...)
+		pos = hi
+		ta, tb := apply(lo, hi, as, a), apply(lo, hi, bs, b)
+		switch {
+		case len(bs) == 0:
+			merged = append(merged, ta...)
+		case len(as) == 0 || equalLines(ta, tb):
+			merged = append(merged, tb...)
+		default:
+			conflicts++
+			merged = append(merged, "<<<<<<< "+aName+"\n")
+			merged = append(merged, terminated(ta)...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, terminated(tb)...)
+			merged = append(merged, ">>>>>>> "+bName+"\n")
+		}
+	}
+	return append(merged, orig[pos:]...), conflicts
+}
+
+// terminated returns lines with a newline added to the last line if it has none.
+func terminated(lines []string) []string {
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines = append(lines[:n-1:n-1], lines[n-1]+"\n")
+	}
+	return lines
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
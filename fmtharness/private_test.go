@@ -0,0 +1,36 @@
+//go:build unix
+
+package fmtharness_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+	"github.com/eaburns/Fmt/fmtharness/acmetest"
+)
+
+func TestTempFilesArePrivate(t *testing.T) {
+	defer func(dir string, max int) { fmtharness.TempDir, fmtharness.MaxMemory = dir, max }(fmtharness.TempDir, fmtharness.MaxMemory)
+	fmtharness.TempDir = t.TempDir()
+	// Spill the output to a file, whatever the size of the body.
+	fmtharness.MaxMemory = 0
+	defer syscall.Umask(syscall.Umask(0))
+
+	win := acmetest.New("/tmp/x.go", "a  b\n")
+	res, err := fmtharness.Format(win, replace("  ", " "), fmtharness.Options{Keep: true})
+	if err != nil {
+		t.Fatalf("Format()=_, %v, want nil", err)
+	}
+	fi, err := os.Stat(res.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to stat the kept output: %s", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("kept output mode=%o, want 600", mode)
+	}
+	if got := win.Body(); got != "a b\n" {
+		t.Errorf("body=%q, want %q", got, "a b\n")
+	}
+}
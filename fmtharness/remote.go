@@ -0,0 +1,176 @@
+package fmtharness
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+)
+
+// A Remote is a connection to the 9P service of an Acme over the network.
+type Remote struct {
+	fsys *client.Fsys
+}
+
+// Dial connects to the Acme 9P service at a Plan 9 dial string
+// of the form network!host!port, such as tcp!host!564.
+func Dial(addr string) (*Remote, error) {
+	fs := strings.Split(addr, "!")
+	if len(fs) != 3 {
+		return nil, errors.New("bad dial string " + addr + ": want network!host!port")
+	}
+	fsys, err := client.Mount(fs[0], fs[1]+":"+fs[2])
+	if err != nil {
+		return nil, err
+	}
+	return &Remote{fsys: fsys}, nil
+}
+
+// A WinInfo describes a window listed in the Acme index.
+type WinInfo struct {
+	ID   int
+	Name string
+}
+
+// Windows returns the windows listed in the Acme index.
+func (r *Remote) Windows() ([]WinInfo, error) {
+	fid, err := r.fsys.Open("index", plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	data, err := ioutil.ReadAll(fid)
+	if err != nil {
+		return nil, err
+	}
+	var wins []WinInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		// Each line has five 12-character numeric fields followed by the tag.
+		fs := strings.Fields(line)
+		if len(fs) < 6 {
+			continue
+		}
+		id, err := strconv.Atoi(fs[0])
+		if err != nil {
+			continue
+		}
+		wins = append(wins, WinInfo{ID: id, Name: fs[5]})
+	}
+	return wins, nil
+}
+
+// Open opens the window with the given ID.
+func (r *Remote) Open(id int) (*RemoteWin, error) {
+	ctl, err := r.fsys.Open(fmt.Sprintf("%d/ctl", id), plan9.ORDWR)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteWin{fsys: r.fsys, id: id, fids: map[string]*client.Fid{"ctl": ctl}}, nil
+}
+
+// A RemoteWin is a Window of an Acme reached over the network.
+type RemoteWin struct {
+	fsys *client.Fsys
+	id   int
+	fids map[string]*client.Fid
+}
+
+// Close closes the files of the window.
+func (w *RemoteWin) Close() {
+	for _, fid := range w.fids {
+		fid.Close()
+	}
+	w.fids = nil
+}
+
+func (w *RemoteWin) fid(file string) (*client.Fid, error) {
+	if fid, ok := w.fids[file]; ok {
+		return fid, nil
+	}
+	fid, err := w.fsys.Open(fmt.Sprintf("%d/%s", w.id, file), plan9.ORDWR)
+	if err != nil {
+		return nil, err
+	}
+	w.fids[file] = fid
+	return fid, nil
+}
+
+// Addr implements Window.
+func (w *RemoteWin) Addr(format string, args ...interface{}) error {
+	fid, err := w.fid("addr")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fid, format, args...)
+	return err
+}
+
+// ReadAddr implements Window.
+func (w *RemoteWin) ReadAddr() (q0, q1 int, err error) {
+	fid, err := w.fid("addr")
+	if err != nil {
+		return 0, 0, err
+	}
+	buf := make([]byte, 40)
+	n, err := fid.ReadAt(buf, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscan(string(buf[:n]), &q0, &q1); err != nil {
+		return 0, 0, err
+	}
+	return q0, q1, nil
+}
+
+// Ctl implements Window.
+func (w *RemoteWin) Ctl(format string, args ...interface{}) error {
+	fid, err := w.fid("ctl")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fid, format, args...)
+	return err
+}
+
+// Read implements Window.
+func (w *RemoteWin) Read(file string, b []byte) (int, error) {
+	fid, err := w.fid(file)
+	if err != nil {
+		return 0, err
+	}
+	return fid.Read(b)
+}
+
+// ReadAll implements Window.
+func (w *RemoteWin) ReadAll(file string) ([]byte, error) {
+	fid, err := w.fid(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fid.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(fid)
+}
+
+// Seek implements Window.
+func (w *RemoteWin) Seek(file string, offset int64, whence int) (int64, error) {
+	fid, err := w.fid(file)
+	if err != nil {
+		return 0, err
+	}
+	return fid.Seek(offset, whence)
+}
+
+// Write implements Window.
+func (w *RemoteWin) Write(file string, b []byte) (int, error) {
+	fid, err := w.fid(file)
+	if err != nil {
+		return 0, err
+	}
+	return fid.Write(b)
+}
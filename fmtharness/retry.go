@@ -0,0 +1,132 @@
+package fmtharness
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The defaults of Retrying.
+const (
+	defaultTries   = 3
+	defaultBackoff = 10 * time.Millisecond
+)
+
+// A Retrying is a Window that retries the failed operations
+// on the Window that it wraps, which now and then fail transiently
+// while Acme is busy, such as during a large paste,
+// instead of failing the whole format.
+//
+// Only the errors that are likely to pass are retried:
+// interrupted and would-block system calls, EINTR and EAGAIN,
+// and 9P hangups. Others, such as a bad address, are returned at once.
+// Reads and writes are only retried if they transferred nothing,
+// so that no text is read or written twice.
+type Retrying struct {
+	Window
+	// Tries is the most times to try each operation.
+	// If zero, it is 3.
+	Tries int
+	// Backoff is the wait before the first retry,
+	// which doubles before each later one.
+	// If zero, it is 10ms.
+	Backoff time.Duration
+}
+
+// retry calls f until it succeeds, or returns an error that is not transient,
+// or it has been called r.Tries times, returning its last error.
+func (r *Retrying) retry(f func() error) error {
+	tries, wait := r.Tries, r.Backoff
+	if tries <= 0 {
+		tries = defaultTries
+	}
+	if wait <= 0 {
+		wait = defaultBackoff
+	}
+	var err error
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = f(); err == nil || !transient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// transient returns whether err may pass if the operation is tried again.
+func transient(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	// A hangup, as reported by Acme, i/o on hungup channel, or by the 9P client.
+	msg := err.Error()
+	return strings.Contains(msg, "hungup") || strings.Contains(msg, "hangup")
+}
+
+// Addr writes the address file of the window.
+func (r *Retrying) Addr(format string, args ...interface{}) error {
+	return r.retry(func() error { return r.Window.Addr(format, args...) })
+}
+
+// ReadAddr reads the address file of the window.
+func (r *Retrying) ReadAddr() (q0, q1 int, err error) {
+	err = r.retry(func() error {
+		var err error
+		q0, q1, err = r.Window.ReadAddr()
+		return err
+	})
+	return q0, q1, err
+}
+
+// Ctl writes a control message to the window.
+func (r *Retrying) Ctl(format string, args ...interface{}) error {
+	return r.retry(func() error { return r.Window.Ctl(format, args...) })
+}
+
+// Read reads from the named file of the window.
+func (r *Retrying) Read(file string, b []byte) (n int, err error) {
+	r.retry(func() error {
+		n, err = r.Window.Read(file, b)
+		if n > 0 {
+			return nil
+		}
+		return err
+	})
+	return n, err
+}
+
+// ReadAll reads the entire contents of the named file of the window.
+func (r *Retrying) ReadAll(file string) (b []byte, err error) {
+	err = r.retry(func() error {
+		var err error
+		b, err = r.Window.ReadAll(file)
+		return err
+	})
+	return b, err
+}
+
+// Seek sets the offset for the next Read of the named file of the window.
+func (r *Retrying) Seek(file string, offset int64, whence int) (n int64, err error) {
+	err = r.retry(func() error {
+		var err error
+		n, err = r.Window.Seek(file, offset, whence)
+		return err
+	})
+	return n, err
+}
+
+// Write writes to the named file of the window.
+func (r *Retrying) Write(file string, b []byte) (n int, err error) {
+	r.retry(func() error {
+		n, err = r.Window.Write(file, b)
+		if n > 0 {
+			return nil
+		}
+		return err
+	})
+	return n, err
+}
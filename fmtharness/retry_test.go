@@ -0,0 +1,52 @@
+package fmtharness_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+	"github.com/eaburns/Fmt/fmtharness/acmetest"
+)
+
+// A flakyWin is a fake window whose control messages fail
+// with err the first fails times.
+type flakyWin struct {
+	*acmetest.Win
+	err          error
+	fails, tries int
+}
+
+func (w *flakyWin) Ctl(format string, args ...interface{}) error {
+	if w.tries++; w.tries <= w.fails {
+		return w.err
+	}
+	return w.Win.Ctl(format, args...)
+}
+
+func TestRetrying(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		fails     int
+		wantTries int
+		wantErr   bool
+	}{
+		{name: "no error", err: nil, fails: 0, wantTries: 1},
+		{name: "interrupted", err: syscall.EINTR, fails: 2, wantTries: 3},
+		{name: "would block", err: fmt.Errorf("write ctl: %w", syscall.EAGAIN), fails: 1, wantTries: 2},
+		{name: "hung up", err: errors.New("i/o on hungup channel"), fails: 1, wantTries: 2},
+		{name: "too many", err: syscall.EINTR, fails: 5, wantTries: 3, wantErr: true},
+		{name: "not transient", err: errors.New("bad address"), fails: 1, wantTries: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		win := &flakyWin{Win: acmetest.New("/tmp/x.go", ""), err: test.err, fails: test.fails}
+		r := &fmtharness.Retrying{Window: win, Backoff: 1}
+		err := r.Ctl("clean\n")
+		if (err != nil) != test.wantErr || win.tries != test.wantTries {
+			t.Errorf("%s: Ctl()=%v after %d tries, want error %v after %d tries",
+				test.name, err, win.tries, test.wantErr, test.wantTries)
+		}
+	}
+}
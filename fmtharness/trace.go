@@ -0,0 +1,110 @@
+package fmtharness
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// TraceRun writes a line to w describing the run of the command args
+// in the directory dir, started at start, that ended with err.
+// If w is nil, it does nothing.
+func TraceRun(w io.Writer, start time.Time, args []string, dir string, err error) {
+	if w == nil {
+		return
+	}
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(w, "run %q in %s: %s (%s)\n", args, dir, status, time.Since(start))
+}
+
+// A Traced is a Window that writes a line to W describing each operation
+// on the Window that it wraps, with the time that it took,
+// for debugging the interaction of Format with the window.
+//
+// Control messages and reads and writes of the address are traced,
+// as are writes of the other files with their sizes.
+// If Verbose is set, so are reads of the other files.
+type Traced struct {
+	Window
+	// W receives the trace.
+	W io.Writer
+	// Verbose traces reads of the files other than addr.
+	Verbose bool
+}
+
+func (t *Traced) trace(start time.Time, err error, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	fmt.Fprintf(t.W, "%s (%s)\n", msg, time.Since(start))
+}
+
+// Addr writes the address file of the window.
+func (t *Traced) Addr(format string, args ...interface{}) error {
+	start := time.Now()
+	err := t.Window.Addr(format, args...)
+	t.trace(start, err, "addr write %q", fmt.Sprintf(format, args...))
+	return err
+}
+
+// ReadAddr reads the address file of the window.
+func (t *Traced) ReadAddr() (q0, q1 int, err error) {
+	start := time.Now()
+	q0, q1, err = t.Window.ReadAddr()
+	t.trace(start, err, "addr read #%d,#%d", q0, q1)
+	return q0, q1, err
+}
+
+// Ctl writes a control message to the window.
+func (t *Traced) Ctl(format string, args ...interface{}) error {
+	start := time.Now()
+	err := t.Window.Ctl(format, args...)
+	t.trace(start, err, "ctl write %q", fmt.Sprintf(format, args...))
+	return err
+}
+
+// Read reads from the named file of the window.
+func (t *Traced) Read(file string, b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Window.Read(file, b)
+	if t.Verbose && err != io.EOF {
+		t.trace(start, err, "%s read %d bytes", file, n)
+	}
+	return n, err
+}
+
+// ReadAll reads the entire contents of the named file of the window.
+func (t *Traced) ReadAll(file string) ([]byte, error) {
+	start := time.Now()
+	b, err := t.Window.ReadAll(file)
+	if t.Verbose {
+		t.trace(start, err, "%s read all %d bytes", file, len(b))
+	}
+	return b, err
+}
+
+// Seek sets the offset for the next Read of the named file of the window.
+func (t *Traced) Seek(file string, offset int64, whence int) (int64, error) {
+	start := time.Now()
+	n, err := t.Window.Seek(file, offset, whence)
+	if t.Verbose {
+		t.trace(start, err, "%s seek %d %d", file, offset, whence)
+	}
+	return n, err
+}
+
+// Write writes to the named file of the window.
+func (t *Traced) Write(file string, b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Window.Write(file, b)
+	t.trace(start, err, "%s write %d bytes", file, n)
+	return n, err
+}
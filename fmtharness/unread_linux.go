@@ -0,0 +1,15 @@
+package fmtharness
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// unread returns the number of bytes in the pipe f not yet read,
+// and whether it could tell.
+func unread(f *os.File) (int, bool) {
+	var n int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	return int(n), errno == 0
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fmtharness
+
+import "os"
+
+// unread cannot tell the number of bytes unread in a pipe;
+// that is only done on Linux.
+func unread(f *os.File) (int, bool) { return 0, false }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"9fans.net/go/acme"
+)
+
+// gitFiles implements Fmt git, formatting the open windows
+// of the files changed in a git repository,
+// and optionally the changed files that have no window,
+// and returns the exit status.
+func gitFiles(j job, args []string) int {
+	fs := flag.NewFlagSet("git", flag.ExitOnError)
+	disk := fs.Bool("disk", false, "also format the changed files that have no window, on disk")
+	fs.Usage = func() {
+		eprintf("Usage: Fmt git [-disk] [<dir>]\n\nThe repository is that of <dir>, by default the current directory.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 1
+	}
+	paths, err := gitChanged(dir)
+	if err != nil {
+		eprintf("%s\n", err)
+		return 1
+	}
+	wins, err := acme.Windows()
+	if err != nil {
+		eprintf("failed to read the acme index: %s\n", err)
+		return 1
+	}
+	ids := make(map[string]int)
+	for _, wi := range wins {
+		ids[wi.Name] = wi.ID
+	}
+	var t tally
+	for _, p := range paths {
+		if id, ok := ids[p]; ok {
+			j.id, j.dir = id, filepath.Dir(p)
+			changed, err := fmtOpen(id, j)
+			t.add(id, p, changed, err)
+			continue
+		}
+		if !*disk {
+			continue
+		}
+		r := formatFile(j.conf, p, 0)
+		changed := r.err == nil && !bytes.Equal(r.body, r.formatted)
+		if changed {
+			r.err = writeFile(p, r.formatted, false)
+		}
+		t.add(0, p, changed, r.err)
+	}
+	t.finish()
+	if t.nfailed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// gitChanged returns the absolute names of the files of the git repository
+// of dir that differ from HEAD, staged or not, or that are untracked,
+// but not those that are deleted or ignored.
+func gitChanged(dir string) ([]string, error) {
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root = strings.TrimSpace(root)
+	changed, err := git(root, "diff", "--name-only", "-z", "--diff-filter=d", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(root, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, p := range strings.Split(changed+untracked, "\x00") {
+		if p != "" {
+			paths = append(paths, filepath.Join(root, p))
+		}
+	}
+	return paths, nil
+}
+
+// git returns the output of git run in dir with args.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errorf("git %s: %s", args[0], msg)
+		}
+		return "", errorf("git %s: %s", args[0], err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// goimportsArgs returns cmd with arguments added for the Go file name,
+// if cmd is goimports:
+// -srcdir, so that goimports resolves imports against the file's module
+// although it reads the file from standard input,
+// and, if local is set, -local with the path of the module
+// from the nearest go.mod, so that the module's own imports are grouped last.
+// Arguments that cmd already gives are left alone.
+func goimportsArgs(cmd []string, name string, local bool) []string {
+	if len(cmd) == 0 || filepath.Base(cmd[0]) != "goimports" {
+		return cmd
+	}
+	args := cmd[:len(cmd):len(cmd)]
+	if !hasFlag(cmd, "-srcdir") {
+		// The file name, rather than its directory, keeps goimports
+		// from counting the file's old contents as part of its package.
+		args = append(args, "-srcdir", name)
+	}
+	if local && !hasFlag(cmd, "-local") {
+		if mod := modulePath(filepath.Dir(name)); mod != "" {
+			args = append(args, "-local", mod)
+		}
+	}
+	return args
+}
+
+// modulePath returns the module path from the go.mod file
+// of dir or its nearest parent that has one, or "" if there is none.
+func modulePath(dir string) string {
+	for {
+		if mod, err := readModulePath(filepath.Join(dir, "go.mod")); err == nil {
+			return mod
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readModulePath returns the module path of the go.mod file at path.
+func readModulePath(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 2 || fs[0] != "module" {
+			continue
+		}
+		if mod, err := strconv.Unquote(fs[1]); err == nil {
+			return mod, nil
+		}
+		return fs[1], nil
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errorf("%s: no module directive", path)
+}
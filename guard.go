@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// The default markers of guarded regions.
+const (
+	defaultGuardOff = "fmt:off"
+	defaultGuardOn  = "fmt:on"
+)
+
+// A guarded is a Formatter that keeps the guarded regions of the text
+// byte-for-byte as they were, even if its Formatter changes them.
+// A guarded region runs from a comment line holding only the off marker
+// through the next comment line holding only the on marker,
+// or to the end of the text, which is reported to stderr.
+type guarded struct {
+	fmtharness.Formatter
+	off, on string
+	stderr  io.Writer
+}
+
+// Format formats the text read from src with g.Formatter,
+// and then replaces each guarded region of its output
+// with the corresponding region of the text.
+// It fails if the output has a different number of guarded regions.
+func (g guarded) Format(dst io.Writer, src io.Reader) error {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(text, []byte(g.off)) {
+		return g.Formatter.Format(dst, bytes.NewReader(text))
+	}
+	var out bytes.Buffer
+	if err := g.Formatter.Format(&out, bytes.NewReader(text)); err != nil {
+		return err
+	}
+	in := fmtharness.SplitLines(string(text))
+	formatted := fmtharness.SplitLines(out.String())
+	inRegions, outRegions := g.regions(in), g.regions(formatted)
+	if len(inRegions) != len(outRegions) {
+		return errorf("the formatter changed the %s and %s markers", g.off, g.on)
+	}
+	if n := len(inRegions); n > 0 && inRegions[n-1][1] == len(in) && !isMarker(in[len(in)-1], g.on) {
+		fmt.Fprintf(g.stderr, tr("line %d: %s has no %s, so the rest of the text is kept as it is\n"), inRegions[n-1][0]+1, g.off, g.on)
+	}
+	var b strings.Builder
+	prev := 0
+	for i, r := range outRegions {
+		b.WriteString(strings.Join(formatted[prev:r[0]], ""))
+		b.WriteString(strings.Join(in[inRegions[i][0]:inRegions[i][1]], ""))
+		prev = r[1]
+	}
+	b.WriteString(strings.Join(formatted[prev:], ""))
+	_, err = io.WriteString(dst, b.String())
+	return err
+}
+
+// regions returns the line ranges of the guarded regions of lines,
+// each including its marker lines.
+func (g guarded) regions(lines []string) [][2]int {
+	var rs [][2]int
+	for i := 0; i < len(lines); i++ {
+		if !isMarker(lines[i], g.off) {
+			continue
+		}
+		j := i + 1
+		for j < len(lines) && !isMarker(lines[j], g.on) {
+			j++
+		}
+		if j < len(lines) {
+			j++
+		}
+		rs = append(rs, [2]int{i, j})
+		i = j - 1
+	}
+	return rs
+}
+
+// commentDelims are the opening and closing delimiters of the comments
+// that can hold a marker, in the syntax of common languages.
+var commentDelims = [][2]string{
+	{"//", ""},
+	{"#", ""},
+	{"--", ""},
+	{";", ""},
+	{"%", ""},
+	{"/*", "*/"},
+	{"(*", "*)"},
+	{"<!--", "-->"},
+}
+
+// isMarker returns whether line is a comment holding only marker,
+// such as // fmt:off, so that the marker in a string or in prose is ignored.
+func isMarker(line, marker string) bool {
+	l := strings.TrimSpace(line)
+	for _, d := range commentDelims {
+		if !strings.HasPrefix(l, d[0]) || !strings.HasSuffix(l, d[1]) || len(l) < len(d[0])+len(d[1]) {
+			continue
+		}
+		c := l[len(d[0]) : len(l)-len(d[1])]
+		// Such as ;; or ##.
+		for strings.HasPrefix(c, d[0]) {
+			c = c[len(d[0]):]
+		}
+		if strings.TrimSpace(c) == marker {
+			return true
+		}
+	}
+	return false
+}
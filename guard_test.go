@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+func TestIsMarker(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"// fmt:off\n", true},
+		{"\t//fmt:off", true},
+		{"# fmt:off\n", true},
+		{";; fmt:off\n", true},
+		{"-- fmt:off\n", true},
+		{"/* fmt:off */\n", true},
+		{"<!-- fmt:off -->\n", true},
+		{"fmt:off\n", false},
+		{"// fmt:off because of the table\n", false},
+		{"// fmt:offset\n", false},
+		{"x := 1 // fmt:off\n", false},
+		{"\tdefaultGuardOff = \"fmt:off\"\n", false},
+		{"/* fmt:off\n", false},
+		{"/**/\n", false},
+	}
+	for _, test := range tests {
+		if got := isMarker(test.line, "fmt:off"); got != test.want {
+			t.Errorf("isMarker(%q)=%v, want %v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestGuardRegions(t *testing.T) {
+	g := guarded{off: "fmt:off", on: "fmt:on"}
+	tests := []struct {
+		text string
+		want [][2]int
+	}{
+		{"a\nb\n", nil},
+		{"a\n// fmt:off\nb\n// fmt:on\nc\n", [][2]int{{1, 4}}},
+		{"// fmt:off\n// fmt:on\n// fmt:off\nx\n// fmt:on\n", [][2]int{{0, 2}, {2, 5}}},
+		// Unclosed, to the end.
+		{"a\n// fmt:off\nb\n", [][2]int{{1, 3}}},
+		// An on marker outside of a region is ignored.
+		{"// fmt:on\na\n", nil},
+		// Markers not alone in a comment are ignored.
+		{"s := \"fmt:off\"\na\n// fmt:on\n", nil},
+	}
+	for _, test := range tests {
+		got := g.regions(fmtharness.SplitLines(test.text))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("regions(%q)=%v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestGuarded(t *testing.T) {
+	upper := formatFunc(strings.ToUpper)
+	// Upper changes the markers, which the real formatters would not,
+	// so the markers are in upper case.
+	tests := []struct {
+		name   string
+		f      formatFunc
+		text   string
+		want   string
+		err    bool
+		stderr string
+	}{
+		{
+			name: "no markers",
+			f:    upper,
+			text: "a\nb\n",
+			want: "A\nB\n",
+		},
+		{
+			name: "a region",
+			f:    upper,
+			text: "a\n// FMT:OFF\nb\n// FMT:ON\nc\n",
+			want: "A\n// FMT:OFF\nb\n// FMT:ON\nC\n",
+		},
+		{
+			name: "regions move in the output",
+			f:    func(s string) string { return "new\n" + strings.ToUpper(s) },
+			text: "// FMT:OFF\nb\n// FMT:ON\nc\n// FMT:OFF\nd\n// FMT:ON\n",
+			want: "new\n// FMT:OFF\nb\n// FMT:ON\nC\n// FMT:OFF\nd\n// FMT:ON\n",
+		},
+		{
+			name: "regions change size in the output",
+			f:    func(s string) string { return strings.ReplaceAll(strings.ToUpper(s), "B\n", "B\nB\n") },
+			text: "a\n// FMT:OFF\nb\n// FMT:ON\nb\n",
+			want: "A\n// FMT:OFF\nb\n// FMT:ON\nB\nB\n",
+		},
+		{
+			name:   "unclosed",
+			f:      upper,
+			text:   "a\n// FMT:OFF\nb\n",
+			want:   "A\n// FMT:OFF\nb\n",
+			stderr: "line 2: FMT:OFF has no FMT:ON, so the rest of the text is kept as it is\n",
+		},
+		{
+			name: "a marker in a string",
+			f:    upper,
+			text: "s := \"FMT:OFF\"\nb\n",
+			want: "S := \"FMT:OFF\"\nB\n",
+		},
+		{
+			name: "markers removed",
+			f:    func(s string) string { return "x\n" },
+			text: "// FMT:OFF\nb\n// FMT:ON\n",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		var stderr strings.Builder
+		g := guarded{Formatter: test.f, off: "FMT:OFF", on: "FMT:ON", stderr: &stderr}
+		got, err := format(g, test.text)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: Format(%q)=%q, nil, want an error", test.name, test.text, got)
+		case !test.err && (err != nil || got != test.want):
+			t.Errorf("%s: Format(%q)=%q, %v, want %q, nil", test.name, test.text, got, err, test.want)
+		}
+		if stderr.String() != test.stderr {
+			t.Errorf("%s: stderr=%q, want %q", test.name, stderr.String(), test.stderr)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// maxHistory is the maximum number of formats recorded per window.
+const maxHistory = 20
+
+// An applied is a record of a format applied to a window.
+type applied struct {
+	Label string
+	// Name is the window name at the time of the format.
+	// Window IDs are reused, so a format only applies to a window of the same name.
+	Name  string
+	Time  time.Time
+	Edits []edit
+	// Tool is the base name of the formatter, and Took is how long it ran,
+	// for Fmt stats. They are empty in records made before they were added.
+	Tool string        `json:",omitempty"`
+	Took time.Duration `json:",omitempty"`
+}
+
+// An edit replaces the lines Old, which began at line Line of the formatted body,
+// with the lines New.
+type edit struct {
+	Line int
+	Old  []string
+	New  []string
+	// Before and After are the lines of the formatted body
+	// just before and after an edit that deleted lines, if any.
+	// A deletion has no new lines by which to find it,
+	// so it is found by these instead.
+	Before []string `json:",omitempty"`
+	After  []string `json:",omitempty"`
+}
+
+// at returns whether e is at line l of lines:
+// whether its new lines are there, or for a deletion,
+// whether the lines around it are.
+func (e edit) at(lines []string, l int) bool {
+	if len(e.New) > 0 {
+		return linesAt(lines, l, e.New)
+	}
+	if len(e.Before) == 0 && len(e.After) == 0 {
+		// The formatted body was empty.
+		return l == 0 && len(lines) == 0
+	}
+	return linesAt(lines, l-len(e.Before), e.Before) && linesAt(lines, l, e.After)
+}
+
+// historyPath returns the path of the history of the window with the given ID,
+// in the state directory.
+func historyPath(id int) (string, error) {
+	return stateFile(fmt.Sprintf("history-%d", id))
+}
+
+func readHistory(id int) ([]applied, error) {
+	path, err := historyPath(id)
+	if err != nil {
+		return nil, err
+	}
+	return readHistoryFile(path)
+}
+
+// readHistoryFile reads the history in the file at path.
+func readHistoryFile(path string) ([]applied, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hist []applied
+	if err := json.Unmarshal(data, &hist); err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+func writeHistory(id int, hist []applied) error {
+	if len(hist) > maxHistory {
+		hist = hist[len(hist)-maxHistory:]
+	}
+	data, err := json.Marshal(hist)
+	if err != nil {
+		return err
+	}
+	path, err := historyPath(id)
+	if err != nil {
+		return err
+	}
+	return writePrivate(path, data)
+}
+
+// record adds the format of body into formatted,
+// which took the given time, to the history of the window.
+func record(win fmtharness.Window, j job, body, formatted []byte, took time.Duration) error {
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	a, b := fmtharness.SplitLines(string(body)), fmtharness.SplitLines(string(formatted))
+	var edits []edit
+	for _, h := range fmtharness.Diff(a, b) {
+		e := edit{Line: h.B0, Old: a[h.A0:h.A1], New: b[h.B0:h.B1]}
+		if len(e.New) == 0 {
+			if h.B0 > 0 {
+				e.Before = b[h.B0-1 : h.B0]
+			}
+			if h.B0 < len(b) {
+				e.After = b[h.B0 : h.B0+1]
+			}
+		}
+		edits = append(edits, e)
+	}
+	hist, err := readHistory(j.id)
+	if err != nil {
+		return err
+	}
+	tool := "Fmt"
+	if len(j.run) > 0 {
+		tool = filepath.Base(j.run[0])
+	}
+	now := time.Now()
+	hist = append(hist, applied{
+		Label: tool + "@" + now.Format("15:04:05"),
+		Name:  name,
+		Time:  now,
+		Edits: edits,
+		Tool:  tool,
+		Took:  took,
+	})
+	return writeHistory(j.id, hist)
+}
+
+// listHistory writes the labels of the formats recorded for win to standard error,
+// most recent first.
+func listHistory(win fmtharness.Window, id int) error {
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	hist, err := readHistory(id)
+	if err != nil {
+		return err
+	}
+	for i := len(hist) - 1; i >= 0; i-- {
+		if f := hist[i]; f.Name == name {
+			if plain {
+				eprintf("%s: %d edits\n", f.Label, len(f.Edits))
+			} else {
+				eprintf("%s\t%d edits\n", f.Label, len(f.Edits))
+			}
+		}
+	}
+	return nil
+}
+
+// undo reverts the most recent format of win with the given label,
+// if all of the lines that it changed are still present in the body.
+func undo(win fmtharness.Window, id int, label string) error {
+	unlock, err := lockWin(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	hist, err := readHistory(id)
+	if err != nil {
+		return errorf("failed to read the format history: %s", err)
+	}
+	i := len(hist) - 1
+	for i >= 0 && (hist[i].Label != label || hist[i].Name != name) {
+		i--
+	}
+	if i < 0 {
+		return errorf("no format labeled %s", label)
+	}
+	q0, q1, err := fmtharness.ReadAddr(win)
+	if err != nil {
+		return errorf("failed to get the current selection: %s", err)
+	}
+	body, err := fmtharness.ReadBody(win)
+	if err != nil {
+		return errorf("failed to read the body: %s", err)
+	}
+	lines, err := revert(fmtharness.SplitLines(string(body)), hist[i].Edits)
+	if err != nil {
+		return errorf("cannot undo %s: %s", label, err)
+	}
+	if err := fmtharness.WriteBody(win, strings.NewReader(strings.Join(lines, ""))); err != nil {
+		return errorf("failed to write the body: %s", err)
+	}
+	if err := fmtharness.ShowAddr(win, q0, q1); err != nil {
+		return errorf("failed to restore the selection: %s", err)
+	}
+	return writeHistory(id, append(hist[:i], hist[i+1:]...))
+}
+
+// changes writes to standard output the address, file:line,line,
+// of each line changed by the most recent format of win,
+// so that the changes can be visited by clicking them in +Errors.
+// The lines are located in the current body,
+// so later edits elsewhere do not invalidate them.
+func changes(win fmtharness.Window, id int) error {
+	unlock, err := lockWin(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	hist, err := readHistory(id)
+	if err != nil {
+		return errorf("failed to read the format history: %s", err)
+	}
+	i := len(hist) - 1
+	for i >= 0 && hist[i].Name != name {
+		i--
+	}
+	if i < 0 {
+		return errorf("no format to list")
+	}
+	body, err := fmtharness.ReadBody(win)
+	if err != nil {
+		return errorf("failed to read the body: %s", err)
+	}
+	f := hist[i]
+	at, err := locate(fmtharness.SplitLines(string(body)), f.Edits)
+	if err != nil {
+		return errorf("cannot list the changes of %s: %s", f.Label, err)
+	}
+	for k, e := range f.Edits {
+		l0, l1 := at[k]+1, at[k]+len(e.New)
+		if l1 < l0 {
+			// A deletion; show the line after it.
+			l1 = l0
+		}
+		if !render(os.Stdout, "change", changeOutput{name, l0, l1}) {
+			fmt.Printf("%s:%d,%d\n", name, l0, l1)
+		}
+	}
+	return nil
+}
+
+// revert returns lines with edits reversed.
+func revert(lines []string, edits []edit) ([]string, error) {
+	at, err := locate(lines, edits)
+	if err != nil {
+		return nil, err
+	}
+	return unapply(lines, edits, at), nil
+}
+
+// locate returns the line of lines at which each edit's new lines begin.
+// Each edit is expected at its recorded line,
+// but if later changes moved it, it is found by searching
+// for the unique occurrence of its new lines,
+// or for a deletion, of the lines around it.
+func locate(lines []string, edits []edit) ([]int, error) {
+	at := make([]int, len(edits))
+	prev := 0
+	for i, e := range edits {
+		l := e.Line
+		if !e.at(lines, l) {
+			l = -1
+			for k := prev; k <= len(lines)-len(e.New); k++ {
+				if !e.at(lines, k) {
+					continue
+				}
+				if l >= 0 {
+					return nil, errorf("the edit at line %d is ambiguous", e.Line+1)
+				}
+				l = k
+			}
+			if l < 0 {
+				return nil, errorf("the edit at line %d has changed", e.Line+1)
+			}
+		}
+		if l < prev {
+			return nil, errorf("the edit at line %d has moved", e.Line+1)
+		}
+		at[i] = l
+		prev = l + len(e.New)
+	}
+	return at, nil
+}
+
+// unapply returns lines with edits, located at lines at, reversed.
+func unapply(lines []string, edits []edit, at []int) []string {
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		rest := append(append([]string(nil), e.Old...), lines[at[i]+len(e.New):]...)
+		lines = append(lines[:at[i]], rest...)
+	}
+	return lines
+}
+
+// revertHunks reverts the edits of the most recent format of win
+// that intersect its selection, leaving the format's other edits in place.
+func revertHunks(win fmtharness.Window, id int) error {
+	unlock, err := lockWin(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	name, err := winName(win)
+	if err != nil {
+		return err
+	}
+	hist, err := readHistory(id)
+	if err != nil {
+		return errorf("failed to read the format history: %s", err)
+	}
+	i := len(hist) - 1
+	for i >= 0 && hist[i].Name != name {
+		i--
+	}
+	if i < 0 {
+		return errorf("no format to revert")
+	}
+	q0, q1, err := fmtharness.ReadAddr(win)
+	if err != nil {
+		return errorf("failed to get the current selection: %s", err)
+	}
+	body, err := fmtharness.ReadBody(win)
+	if err != nil {
+		return errorf("failed to read the body: %s", err)
+	}
+	lines := fmtharness.SplitLines(string(body))
+	f := &hist[i]
+	at, err := locate(lines, f.Edits)
+	if err != nil {
+		return errorf("cannot revert %s: %s", f.Label, err)
+	}
+	l0, l1 := lineSpan(lines, q0, q1)
+	var rev, keep []edit
+	var revAt []int
+	shift := 0
+	for k, e := range f.Edits {
+		n := len(e.New)
+		if n == 0 {
+			// A deletion occupies the line after it.
+			n = 1
+		}
+		if at[k] < l1 && at[k]+n > l0 {
+			rev = append(rev, e)
+			revAt = append(revAt, at[k])
+			shift += len(e.Old) - len(e.New)
+			continue
+		}
+		e.Line = at[k] + shift
+		keep = append(keep, e)
+	}
+	if len(rev) == 0 {
+		return errorf("no edits of %s in the selection", f.Label)
+	}
+	lines = unapply(lines, rev, revAt)
+	if err := fmtharness.WriteBody(win, strings.NewReader(strings.Join(lines, ""))); err != nil {
+		return errorf("failed to write the body: %s", err)
+	}
+	if err := fmtharness.ShowAddr(win, q0, q1); err != nil {
+		return errorf("failed to restore the selection: %s", err)
+	}
+	if f.Edits = keep; len(keep) == 0 {
+		hist = append(hist[:i], hist[i+1:]...)
+	}
+	return writeHistory(id, hist)
+}
+
+// lineSpan returns the lines [l0, l1) spanned by the rune offsets [q0, q1).
+// An empty span covers the line containing q0.
+func lineSpan(lines []string, q0, q1 int) (l0, l1 int) {
+	l0, l1 = len(lines), len(lines)
+	q := 0
+	for i, l := range lines {
+		n := utf8.RuneCountInString(l)
+		if l0 == len(lines) && q0 < q+n {
+			l0 = i
+		}
+		if q1 <= q {
+			l1 = i
+			break
+		}
+		q += n
+	}
+	if l1 <= l0 {
+		l1 = l0 + 1
+	}
+	return l0, l1
+}
+
+func linesAt(lines []string, l int, want []string) bool {
+	if l < 0 || l+len(want) > len(lines) {
+		return false
+	}
+	for i, w := range want {
+		if lines[l+i] != w {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// runHook runs the hook command, if any, for the file name
+// in the job's directory, with $fmtfile set to name
+// and with the given additional environment variables.
+// Its output goes to the job's standard error.
+func runHook(j job, hook []string, name string, env ...string) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	cmd := exec.Command(hook[0], hook[1:]...)
+	cmd.Dir = j.dir
+	cmd.Env = append(append(os.Environ(), "fmtfile="+name), env...)
+	cmd.Stdout = j.stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = cmd.Stdout
+	start := time.Now()
+	err := cmd.Run()
+	fmtharness.TraceRun(trace, start, hook, cmd.Dir, err)
+	return err
+}
+
+// postHook runs the job's post hook for the file name,
+// telling it by $fmtchanged whether the format changed the body.
+func postHook(j job, name string, changed bool) {
+	c := "0"
+	if changed {
+		c = "1"
+	}
+	if err := runHook(j, j.post, name, "fmtchanged="+c); err != nil {
+		// Not fatal. The format is already done.
+		eprintf("post hook failed: %s\n", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// defaultLarge is the default of the -large flag.
+const defaultLarge = 16 << 20
+
+// largeAgain is how soon Fmt must be run again to format a large body.
+const largeAgain = 10 * time.Second
+
+// checkLarge returns an error warning that the body of win,
+// the window with the given ID, is large,
+// if it is over max bytes and Fmt was not run on it in the last largeAgain,
+// so that a formatter that may take minutes is not started by mistake.
+// Running Fmt again within largeAgain of the warning formats it.
+// If max is 0, any body is formatted.
+func checkLarge(win fmtharness.Window, id, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	ctl, err := win.ReadAll("ctl")
+	if err != nil {
+		return errorf("failed to read the window ctl: %s", err)
+	}
+	f := strings.Fields(string(ctl))
+	if len(f) < 3 {
+		return nil
+	}
+	// The length is in runes, so it may be a little short.
+	n, err := strconv.Atoi(f[2])
+	if err != nil || n <= max {
+		return nil
+	}
+	path, err := stateFile(fmt.Sprintf("large-%d", id))
+	if err != nil {
+		return errorf("failed to note the large body: %s", err)
+	}
+	if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < largeAgain {
+		os.Remove(path)
+		return nil
+	}
+	if err := writePrivate(path, nil); err != nil {
+		return errorf("failed to note the large body: %s", err)
+	}
+	return errorf("the body is %s; run Fmt again within %d seconds to proceed", size(n), int(largeAgain/time.Second))
+}
+
+// size returns n bytes in the largest whole unit.
+func size(n int) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%dKB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
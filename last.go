@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// lastPath returns the path of the file recording the command
+// last run on each window, by window name.
+// It is beside the configuration file, rather than in the temporary directory,
+// so that it lasts across restarts of Acme and of the machine.
+func lastPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "last")
+}
+
+// readLast returns the commands last run, by window name.
+func readLast() (map[string][]string, error) {
+	data, err := ioutil.ReadFile(lastPath())
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	last := map[string][]string{}
+	if err := json.Unmarshal(data, &last); err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// lastCommand returns the command last run on the window with the given name,
+// or nil if none is recorded.
+func lastCommand(name string) []string {
+	last, err := readLast()
+	if err != nil {
+		eprintf("failed to read the last commands: %s\n", err)
+		return nil
+	}
+	return last[name]
+}
+
+// rememberCommand records run as the command last run on the window with the given name.
+// Files that no longer exist are forgotten, so that the record does not grow forever.
+func rememberCommand(name string, run []string) error {
+	last, err := readLast()
+	if err != nil {
+		return err
+	}
+	for n := range last {
+		if _, err := os.Stat(n); os.IsNotExist(err) {
+			delete(last, n)
+		}
+	}
+	last[name] = run
+	data, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(lastPath()), 0700); err != nil {
+		return err
+	}
+	return writePrivate(lastPath(), data)
+}
+
+// remember records run as the command last run on the window with the given name,
+// printing any error.
+func remember(name string, run []string) {
+	if err := rememberCommand(name, run); err != nil {
+		// Not fatal. The command just isn't repeated after a restart.
+		eprintf("failed to remember the command: %s\n", err)
+	}
+}
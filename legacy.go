@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// legacy formats the window $winid with the command args
+// the way Fmt did before its configuration and diff-based writes:
+// the command is required and is run in the current directory,
+// its standard error goes to Fmt's, any output, even empty, replaces the whole body,
+// and nothing is recorded for undo or restore.
+// Scripts that depend on the old behavior can keep using it with -legacy.
+func legacy(win fmtharness.Window, id int, args []string) error {
+	unlock, err := lockWin(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f := fmtharness.Command{Args: args, Stderr: os.Stderr}
+	res, err := fmtharness.Format(win, f, fmtharness.Options{Force: true, Rewrite: true})
+	printWarnings(res)
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// limitWrapper returns the command and arguments with which to run a command
+// to limit its CPU time to cpu seconds and its address space to mem bytes,
+// using prlimit(1), or nil if neither is positive.
+func limitWrapper(cpu int, mem int64) []string {
+	if cpu <= 0 && mem <= 0 {
+		return nil
+	}
+	w := []string{"prlimit"}
+	if cpu > 0 {
+		// The hard limit, at which the command is killed,
+		// is a second past the soft limit, at which it gets SIGXCPU,
+		// so that the signal tells which limit was hit.
+		w = append(w, "--cpu="+strconv.Itoa(cpu)+":"+strconv.Itoa(cpu+1))
+	}
+	if mem > 0 {
+		w = append(w, "--as="+strconv.FormatInt(mem, 10))
+	}
+	return append(w, "--")
+}
+
+// memErrors are the messages with which common runtimes
+// report running out of memory.
+var memErrors = [][]byte{
+	[]byte("out of memory"),
+	[]byte("cannot allocate memory"),
+	[]byte("bad_alloc"),
+	[]byte("memoryerror"),
+}
+
+// limitError returns an error saying which limit of j the command hit,
+// if err, the error of the command, whose standard error is stderr,
+// looks to be the result of hitting one, or nil otherwise.
+func limitError(j job, err error, stderr []byte) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return nil
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && j.cpuLimit > 0 && ws.Signaled() {
+		if sig := ws.Signal(); sig == syscall.SIGXCPU || sig == syscall.SIGKILL {
+			return errorf("the formatter exceeded its CPU time limit of %d seconds", j.cpuLimit)
+		}
+	}
+	if j.memLimit > 0 {
+		lower := bytes.ToLower(stderr)
+		for _, m := range memErrors {
+			if bytes.Contains(lower, m) {
+				return errorf("the formatter exceeded its memory limit of %d bytes", j.memLimit)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"9fans.net/go/acme"
+	"9fans.net/go/plan9/client"
+)
+
+// socketPath returns the path of the control socket in the current name space.
+func socketPath() string {
+	return filepath.Join(client.Namespace(), "fmt")
+}
+
+// listen serves requests on the control socket until accepting a connection fails.
+// Each request is a line of the form
+//
+//	format <winid> [<cmd> [<arg>...]]
+//
+// and is answered with a line beginning with ok or error.
+// The command and the window are resolved with the configuration conf,
+// as for Fmt run from the window.
+// Without a command, the command last given for the window's file is run,
+// or if none was, that chosen by the rules.
+func listen(conf *config) error {
+	path := socketPath()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			s := bufio.NewScanner(c)
+			for s.Scan() {
+				mu.Lock()
+				resp := serve(s.Text(), conf)
+				mu.Unlock()
+				if _, err := fmt.Fprintln(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// listenCache remembers the bodies formatted by control requests,
+// which are served one at a time.
+var listenCache fmtCache
+
+// serve handles a single control request with the configuration conf,
+// returning the response.
+func serve(req string, conf *config) string {
+	fs, err := splitArgs(req)
+	if err != nil {
+		return "error " + err.Error()
+	}
+	if len(fs) < 2 || fs[0] != "format" {
+		return "error usage: format <winid> [<cmd> [<arg>...]]"
+	}
+	id, err := strconv.Atoi(fs[1])
+	if err != nil {
+		return "error bad winid: " + fs[1]
+	}
+	win, err := acme.Open(id, nil)
+	if err != nil {
+		return fmt.Sprintf("error failed to open win: %s", err)
+	}
+	defer win.CloseFiles()
+	name, err := winName(win)
+	if err != nil {
+		return fmt.Sprintf("error failed to read the window name: %s", err)
+	}
+	run := conf.command(fs[2:])
+	if len(run) == 0 {
+		run = lastCommand(name)
+	} else {
+		remember(name, run)
+	}
+	changed, err := fmtWin(wrapped(win), job{id: id, dir: filepath.Dir(name), run: run, conf: conf, backupMax: defaultBackupMax, cache: &listenCache})
+	switch {
+	case err != nil:
+		return "error " + err.Error()
+	case changed:
+		return "ok formatted"
+	default:
+		return "ok unchanged"
+	}
+}
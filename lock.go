@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockWin takes the lock of the window with the given ID,
+// which is held while Fmt changes the window,
+// so that simultaneous runs of Fmt do not interleave their writes.
+// It returns the function that releases the lock.
+// If another Fmt holds the lock, lockWin returns an error instead of waiting.
+func lockWin(id int) (unlock func(), err error) {
+	// The lock is in the state directory of the window's Acme,
+	// so that another user cannot take it first,
+	// and windows of other Acmes with the same ID do not share it.
+	path, err := stateFile(fmt.Sprintf("lock-%d", id))
+	if err != nil {
+		return nil, errorf("failed to lock the window: %s", err)
+	}
+	// The file is never removed; removing it would let
+	// a later Fmt lock a new file while an earlier one holds the old.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, errorf("failed to lock the window: %s", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errorf("format already in progress")
+		}
+		return nil, errorf("failed to lock the window: %s", err)
+	}
+	return func() { f.Close() }, nil
+}
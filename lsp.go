@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// An lspFormatter is a Formatter that asks a language server,
+// such as gopls, to format the text, using the Language Server Protocol
+// textDocument/formatting request, and applies the edits that it returns.
+type lspFormatter struct {
+	// Server is the command that runs the server
+	// on its standard input and output.
+	server []string
+	// Wrapper, if non-empty, is the command that runs the server.
+	wrapper []string
+	// Dir is the directory in which to run the server.
+	dir string
+	// File is the name of the file whose text is formatted.
+	file string
+	// Env are variables, each of the form key=value,
+	// added to the environment of the server.
+	env []string
+	// Imports is whether to organize the imports before formatting,
+	// with the server's source.organizeImports code action.
+	imports bool
+	// Stderr receives the standard error of the server
+	// and the errors that it reports.
+	stderr io.Writer
+	// Timeout, if positive, is how long the server has to format,
+	// from starting to answering the shutdown request,
+	// before it is killed.
+	// Otherwise it has defaultLSPTimeout.
+	timeout time.Duration
+}
+
+// lspTimeout is how long to wait for the server to exit
+// after the formatting is done, before killing it.
+const lspTimeout = 5 * time.Second
+
+// defaultLSPTimeout is how long the server has to format by default.
+// It is long, since a server may load a whole module before answering.
+const defaultLSPTimeout = 2 * time.Minute
+
+// Format formats the text read from src with a new session of the server.
+// Servers such as gopls -remote=auto forward the session
+// to a shared daemon, which keeps its state between formats.
+func (f lspFormatter) Format(dst io.Writer, src io.Reader) (err error) {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(f.file)
+	if err != nil {
+		return err
+	}
+	args := append(append([]string(nil), f.wrapper...), f.server...)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = f.dir
+	if len(f.env) > 0 {
+		cmd.Env = append(os.Environ(), f.env...)
+	}
+	cmd.Stderr = f.stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() { fmtharness.TraceRun(trace, start, args, cmd.Dir, err) }()
+	timeout := f.timeout
+	if timeout <= 0 {
+		timeout = defaultLSPTimeout
+	}
+	// A server that never answers would hold the window lock forever.
+	// Killing it may not close its output, if it has children,
+	// so the pipes are closed too, which ends a blocked read or write.
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cmd.Process.Kill()
+		in.Close()
+		out.Close()
+	})
+	c := &lspConn{w: in, r: bufio.NewReader(out), stderr: f.stderr}
+	formatted, err := c.format(abs, text, f.imports)
+	if err == nil {
+		// Errors shutting down do not matter; the edits are in hand.
+		if _, err := c.call("shutdown", nil); err == nil {
+			c.notify("exit", nil)
+		}
+	}
+	timer.Stop()
+	if err != nil && atomic.LoadInt32(&timedOut) != 0 {
+		err = errorf("the language server did not finish formatting in %s", timeout)
+	}
+	in.Close()
+	wait := make(chan error, 1)
+	go func() { wait <- cmd.Wait() }()
+	select {
+	case <-wait:
+	case <-time.After(lspTimeout):
+		cmd.Process.Kill()
+		<-wait
+	}
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(formatted)
+	return err
+}
+
+// An lspConn is a JSON-RPC connection to a language server.
+type lspConn struct {
+	w      io.Writer
+	r      *bufio.Reader
+	stderr io.Writer
+	// ID is the ID of the latest request.
+	id int
+}
+
+// An lspMessage is a message from the server:
+// a response, a request, or a notification.
+type lspMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// An lspPosition is a line and a character offset in the line,
+// counted in UTF-16 code units, both from zero.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// An lspEdit is an LSP TextEdit: the replacement of a range of the text.
+type lspEdit struct {
+	Range struct {
+		Start lspPosition `json:"start"`
+		End   lspPosition `json:"end"`
+	} `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// An lspCodeAction is an LSP CodeAction, or a Command,
+// which has no edit.
+type lspCodeAction struct {
+	Kind string `json:"kind"`
+	Edit *struct {
+		Changes         map[string][]lspEdit `json:"changes"`
+		DocumentChanges []struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Edits []lspEdit `json:"edits"`
+		} `json:"documentChanges"`
+	} `json:"edit"`
+}
+
+// edits returns the edits of the action to the document uri.
+func (a lspCodeAction) edits(uri string) []lspEdit {
+	if a.Edit == nil {
+		return nil
+	}
+	edits := a.Edit.Changes[uri]
+	for _, dc := range a.Edit.DocumentChanges {
+		if dc.TextDocument.URI == uri {
+			edits = append(edits, dc.Edits...)
+		}
+	}
+	return edits
+}
+
+// format opens the file with the text on the server
+// and returns the text formatted by the server,
+// with its imports first organized if imports is true.
+func (c *lspConn) format(file string, text []byte, imports bool) ([]byte, error) {
+	dir := fileURI(filepath.Dir(file))
+	uri := fileURI(file)
+	_, err := c.call("initialize", map[string]interface{}{
+		"processId":        os.Getpid(),
+		"rootUri":          dir,
+		"workspaceFolders": []interface{}{map[string]string{"uri": dir, "name": filepath.Base(filepath.Dir(file))}},
+		"capabilities": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"codeAction": map[string]interface{}{
+					"codeActionLiteralSupport": map[string]interface{}{
+						"codeActionKind": map[string]interface{}{"valueSet": []string{organizeImports}},
+					},
+				},
+			},
+			"workspace": map[string]interface{}{
+				"workspaceEdit": map[string]interface{}{"documentChanges": true},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.notify("initialized", map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+	err = c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri":        uri,
+			"languageId": languageID(file),
+			"version":    1,
+			"text":       string(text),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if imports {
+		if text, err = c.organizeImports(uri, text); err != nil {
+			return nil, err
+		}
+	}
+	res, err := c.call("textDocument/formatting", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"options":      map[string]interface{}{"tabSize": 8, "insertSpaces": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var edits []lspEdit
+	if err := json.Unmarshal(res, &edits); err != nil {
+		return nil, errorf("bad formatting response: %s", err)
+	}
+	return applyEdits(text, edits)
+}
+
+// organizeImports is the kind of the code action that organizes imports.
+const organizeImports = "source.organizeImports"
+
+// organizeImports returns the text of the open document uri
+// with the edits of the server's organizeImports code actions applied,
+// and tells the server of the change.
+func (c *lspConn) organizeImports(uri string, text []byte) ([]byte, error) {
+	lines := bytes.Count(text, []byte("\n")) + 1
+	res, err := c.call("textDocument/codeAction", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"range": map[string]interface{}{
+			"start": lspPosition{},
+			"end":   lspPosition{Line: lines},
+		},
+		"context": map[string]interface{}{
+			"diagnostics": []interface{}{},
+			"only":        []string{organizeImports},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var actions []lspCodeAction
+	if err := json.Unmarshal(res, &actions); err != nil {
+		return nil, errorf("bad code action response: %s", err)
+	}
+	var edits []lspEdit
+	for _, a := range actions {
+		if a.Kind == organizeImports {
+			edits = append(edits, a.edits(uri)...)
+		}
+	}
+	if len(edits) == 0 {
+		return text, nil
+	}
+	if text, err = applyEdits(text, edits); err != nil {
+		return nil, err
+	}
+	err = c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []interface{}{map[string]string{"text": string(text)}},
+	})
+	return text, err
+}
+
+// call sends a request and returns the result of its response,
+// answering the requests that the server makes in the meantime.
+func (c *lspConn) call(method string, params interface{}) (json.RawMessage, error) {
+	c.id++
+	id := strconv.Itoa(c.id)
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method}
+	if params != nil {
+		req["params"] = params
+	}
+	if err := c.send(req); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case m.Method != "" && len(m.ID) > 0:
+			if err := c.reply(m); err != nil {
+				return nil, err
+			}
+		case m.Method != "":
+			c.notified(m)
+		case string(m.ID) == id && m.Error != nil:
+			return nil, errorf("%s: %s", method, m.Error.Message)
+		case string(m.ID) == id:
+			return m.Result, nil
+		}
+	}
+}
+
+// reply answers a request from the server with an empty result,
+// which is all that a client with no capabilities owes it.
+func (c *lspConn) reply(m *lspMessage) error {
+	var result interface{}
+	if m.Method == "workspace/configuration" {
+		// One empty configuration for each item asked about.
+		var p struct{ Items []json.RawMessage }
+		json.Unmarshal(m.Params, &p)
+		result = make([]interface{}, len(p.Items))
+	}
+	return c.send(map[string]interface{}{"jsonrpc": "2.0", "id": m.ID, "result": result})
+}
+
+// notified handles a notification from the server,
+// writing the errors that it reports to c.stderr.
+func (c *lspConn) notified(m *lspMessage) {
+	if m.Method != "window/showMessage" && m.Method != "window/logMessage" {
+		return
+	}
+	var p struct {
+		Type    int
+		Message string
+	}
+	// Type 1 is an error.
+	if json.Unmarshal(m.Params, &p) == nil && p.Type == 1 && c.stderr != nil {
+		fmt.Fprintln(c.stderr, p.Message)
+	}
+}
+
+// notify sends a notification.
+func (c *lspConn) notify(method string, params interface{}) error {
+	n := map[string]interface{}{"jsonrpc": "2.0", "method": method}
+	if params != nil {
+		n["params"] = params
+	}
+	return c.send(n)
+}
+
+// send writes a message.
+func (c *lspConn) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+// read reads a message.
+func (c *lspConn) read() (*lspMessage, error) {
+	h, err := textproto.NewReader(c.r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF {
+			err = errorf("the language server exited")
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, errorf("bad Content-Length from the language server")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	var m lspMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errorf("bad message from the language server: %s", err)
+	}
+	return &m, nil
+}
+
+// fileURI returns the file URI of the absolute path.
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// languageID returns the LSP language identifier of the file,
+// which is mostly the extension without the dot.
+func languageID(file string) string {
+	ext := strings.TrimPrefix(filepath.Ext(file), ".")
+	switch ext {
+	case "mod":
+		return "go.mod"
+	case "js":
+		return "javascript"
+	case "ts":
+		return "typescript"
+	case "py":
+		return "python"
+	case "rs":
+		return "rust"
+	case "h":
+		return "c"
+	case "cc", "cpp", "cxx", "hh", "hpp":
+		return "cpp"
+	case "sh":
+		return "shellscript"
+	}
+	return ext
+}
+
+// applyEdits returns text with the edits applied.
+// The edits must not overlap; edits inserting at the same position
+// are applied in the order given.
+func applyEdits(text []byte, edits []lspEdit) ([]byte, error) {
+	lines := []int{0}
+	for i, c := range text {
+		if c == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	type span struct {
+		start, end int
+		text       string
+	}
+	var spans []span
+	for _, e := range edits {
+		if e.Range.Start.Line < 0 || e.Range.Start.Character < 0 || e.Range.End.Line < 0 || e.Range.End.Character < 0 {
+			return nil, errorf("bad edit position from the language server")
+		}
+		s := span{
+			start: lspOffset(text, lines, e.Range.Start),
+			end:   lspOffset(text, lines, e.Range.End),
+			text:  e.NewText,
+		}
+		if s.end < s.start {
+			return nil, errorf("bad edit range from the language server")
+		}
+		spans = append(spans, s)
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var b bytes.Buffer
+	prev := 0
+	for _, s := range spans {
+		if s.start < prev {
+			return nil, errorf("overlapping edits from the language server")
+		}
+		b.Write(text[prev:s.start])
+		b.WriteString(s.text)
+		prev = s.end
+	}
+	b.Write(text[prev:])
+	return b.Bytes(), nil
+}
+
+// lspOffset returns the byte offset in text of the position,
+// given the offsets of the starts of the lines of text.
+// Positions past the end of a line are at its end,
+// and those past the last line are at the end of the text.
+// The position must not be negative.
+func lspOffset(text []byte, lines []int, p lspPosition) int {
+	if p.Line >= len(lines) {
+		return len(text)
+	}
+	i := lines[p.Line]
+	for units := 0; units < p.Character && i < len(text) && text[i] != '\n'; {
+		r, n := utf8.DecodeRune(text[i:])
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		i += n
+	}
+	return i
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lspEditAt returns the edit replacing the range from line l0, character c0
+// to line l1, character c1 with text.
+func lspEditAt(l0, c0, l1, c1 int, text string) lspEdit {
+	var e lspEdit
+	e.Range.Start = lspPosition{Line: l0, Character: c0}
+	e.Range.End = lspPosition{Line: l1, Character: c1}
+	e.NewText = text
+	return e
+}
+
+func TestLSPOffset(t *testing.T) {
+	text := []byte("ab\nα𝄞c\n\nx")
+	lines := []int{0, 3, 11, 12}
+	tests := []struct {
+		line, char int
+		want       int
+	}{
+		{0, 0, 0},
+		{0, 2, 2},
+		// Past the end of the line.
+		{0, 5, 2},
+		{1, 0, 3},
+		// α is one UTF-16 unit and two bytes.
+		{1, 1, 5},
+		// 𝄞 is two UTF-16 units, a surrogate pair, and four bytes.
+		{1, 3, 9},
+		{1, 4, 10},
+		// Within the surrogate pair, so after it.
+		{1, 2, 9},
+		{2, 0, 11},
+		{2, 1, 11},
+		{3, 1, 13},
+		// Past the last line.
+		{4, 0, 13},
+		{100, 100, 13},
+	}
+	for _, test := range tests {
+		p := lspPosition{Line: test.line, Character: test.char}
+		if got := lspOffset(text, lines, p); got != test.want {
+			t.Errorf("lspOffset(%d:%d)=%d, want %d", test.line, test.char, got, test.want)
+		}
+	}
+}
+
+func TestApplyEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		edits []lspEdit
+		want  string
+		err   bool
+	}{
+		{
+			name: "no edits",
+			text: "a\nb\n",
+			want: "a\nb\n",
+		},
+		{
+			name:  "replace",
+			text:  "a  b\n",
+			edits: []lspEdit{lspEditAt(0, 1, 0, 3, " ")},
+			want:  "a b\n",
+		},
+		{
+			name:  "insert and delete lines",
+			text:  "a\nb\nc\n",
+			edits: []lspEdit{lspEditAt(1, 0, 2, 0, ""), lspEditAt(3, 0, 3, 0, "d\n")},
+			want:  "a\nc\nd\n",
+		},
+		{
+			name:  "out of order",
+			text:  "a\nb\n",
+			edits: []lspEdit{lspEditAt(1, 0, 1, 1, "B"), lspEditAt(0, 0, 0, 1, "A")},
+			want:  "A\nB\n",
+		},
+		{
+			name:  "insertions at the same place in order",
+			text:  "x\n",
+			edits: []lspEdit{lspEditAt(0, 0, 0, 0, "a"), lspEditAt(0, 0, 0, 0, "b")},
+			want:  "abx\n",
+		},
+		{
+			name:  "after a surrogate pair",
+			text:  "𝄞  x\n",
+			edits: []lspEdit{lspEditAt(0, 2, 0, 4, " ")},
+			want:  "𝄞 x\n",
+		},
+		{
+			name:  "past the end",
+			text:  "a",
+			edits: []lspEdit{lspEditAt(0, 1, 5, 0, "\n")},
+			want:  "a\n",
+		},
+		{
+			name:  "overlapping",
+			text:  "abcd\n",
+			edits: []lspEdit{lspEditAt(0, 0, 0, 3, "x"), lspEditAt(0, 2, 0, 4, "y")},
+			err:   true,
+		},
+		{
+			name:  "backwards",
+			text:  "abcd\n",
+			edits: []lspEdit{lspEditAt(0, 3, 0, 1, "x")},
+			err:   true,
+		},
+		{
+			name:  "negative line",
+			text:  "a\n",
+			edits: []lspEdit{lspEditAt(-1, 0, 0, 0, "x")},
+			err:   true,
+		},
+		{
+			name:  "negative character",
+			text:  "a\n",
+			edits: []lspEdit{lspEditAt(0, 0, 0, -1, "x")},
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		got, err := applyEdits([]byte(test.text), test.edits)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: applyEdits()=%q, nil, want an error", test.name, got)
+		case !test.err && (err != nil || string(got) != test.want):
+			t.Errorf("%s: applyEdits()=%q, %v, want %q, nil", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestLSPTimeout(t *testing.T) {
+	// A server that never answers.
+	f := lspFormatter{server: []string{"sleep", "60"}, file: "x.go", stderr: ioutil.Discard, timeout: 100 * time.Millisecond}
+	start := time.Now()
+	var out bytes.Buffer
+	err := f.Format(&out, strings.NewReader("package x\n"))
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("Format()=%v, want a timeout error", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Format() took %s", d)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+// tr returns the translation of the message format string
+// for the locale given by $LC_ALL, $LC_MESSAGES, or $LANG,
+// or the format itself if there is no translation.
+//
+// Translations are read from $HOME/lib/fmt/messages.<locale>,
+// where locale is the full locale name, such as fr_FR, or just the language, fr.
+// Each line of the file is a pair of Go-quoted strings:
+// the English format followed by its translation.
+// The translation must take the same formatting verbs in the same order.
+func tr(format string) string {
+	catalogOnce.Do(loadCatalog)
+	if t, ok := catalog[format]; ok {
+		return t
+	}
+	return format
+}
+
+// eprintf writes a translated message to standard error.
+func eprintf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, tr(format), args...)
+}
+
+// errorf returns an error with a translated message.
+func errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(tr(format), args...)
+}
+
+func loadCatalog() {
+	loc := locale()
+	if loc == "" || loc == "C" || loc == "POSIX" {
+		return
+	}
+	dir := filepath.Join(os.Getenv("HOME"), "lib", "fmt")
+	for _, l := range []string{loc, strings.SplitN(loc, "_", 2)[0]} {
+		c, err := readCatalog(filepath.Join(dir, "messages."+l))
+		if err == nil {
+			catalog = c
+			return
+		}
+		if !os.IsNotExist(err) {
+			// Don't use tr; we are in the middle of loading the catalog.
+			fmt.Fprintf(os.Stderr, "failed to read the message catalog: %s\n", err)
+			return
+		}
+	}
+}
+
+// locale returns the locale name without its encoding or modifier.
+func locale() string {
+	for _, v := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if l := os.Getenv(v); l != "" {
+			if i := strings.IndexAny(l, ".@"); i >= 0 {
+				l = l[:i]
+			}
+			return l
+		}
+	}
+	return ""
+}
+
+func readCatalog(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		val := strings.TrimSpace(line[len(key):])
+		if key, err = strconv.Unquote(key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		if val, err = strconv.Unquote(val); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		c[key] = val
+	}
+	return c, s.Err()
+}
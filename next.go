@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"9fans.net/go/acme"
+)
+
+// A visit is a window affected by a multi-window format.
+type visit struct {
+	ID     int
+	Name   string
+	Failed bool
+}
+
+// A tour is the windows affected by the latest multi-window format,
+// to be visited in turn by Fmt -next.
+type tour struct {
+	Wins []visit
+	// Next is the index of the next window to visit.
+	Next int
+}
+
+// tourPath returns the path of the file of the tour
+// of the windows of the current user's Acme.
+func tourPath() (string, error) {
+	return stateFile("next")
+}
+
+// saveTour saves the windows affected by a multi-window format.
+// If any failed, only the failed windows are visited,
+// otherwise the windows that changed are.
+func saveTour(wins []visit) error {
+	var failed []visit
+	for _, v := range wins {
+		if v.Failed {
+			failed = append(failed, v)
+		}
+	}
+	if len(failed) > 0 {
+		wins = failed
+	}
+	path, err := tourPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tour{Wins: wins})
+	if err != nil {
+		return err
+	}
+	return writePrivate(path, data)
+}
+
+// next shows the next window of the tour saved by the latest multi-window format,
+// cycling back to the first after the last.
+func next() error {
+	path, err := tourPath()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errorf("no windows to visit")
+	}
+	if err != nil {
+		return err
+	}
+	var t tour
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	for len(t.Wins) > 0 {
+		i := t.Next % len(t.Wins)
+		v := t.Wins[i]
+		win, err := acme.Open(v.ID, nil)
+		if err != nil {
+			// The window was closed; drop it from the tour.
+			t.Wins = append(t.Wins[:i], t.Wins[i+1:]...)
+			continue
+		}
+		err = win.Ctl("show")
+		win.CloseFiles()
+		if err != nil {
+			return err
+		}
+		t.Next = i + 1
+		what := "formatted"
+		if v.Failed {
+			what = "failed"
+		}
+		eprintf("%s: %s (%d of %d)\n", v.Name, what, i+1, len(t.Wins))
+		if data, err = json.Marshal(t); err != nil {
+			return err
+		}
+		return writePrivate(path, data)
+	}
+	os.Remove(path)
+	return errorf("no windows to visit")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"9fans.net/go/plan9/client"
+)
+
+// nsHint returns a hint explaining why Acme could not be reached
+// in the name space, or "" if there seems to be an Acme there.
+//
+// Like Acme, Fmt finds the name space by $NAMESPACE,
+// or if it is unset, by $USER and $DISPLAY,
+// so Fmt run from a different display or session than Acme
+// looks in the wrong place.
+func nsHint() string {
+	ns := client.Namespace()
+	if ns == "" {
+		return tr("cannot determine the name space; set $NAMESPACE or use -ns")
+	}
+	if _, err := os.Stat(filepath.Join(ns, "acme")); err == nil {
+		return ""
+	}
+	how := tr("from $NAMESPACE")
+	if os.Getenv("NAMESPACE") == "" {
+		how = fmt.Sprintf(tr("from $DISPLAY=%q"), os.Getenv("DISPLAY"))
+	}
+	return fmt.Sprintf(tr("no acme in the name space %s (%s); is Acme running on this display? Use -ns to choose another name space"), ns, how)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// onPut formats each window whose name matches re after it is Put.
+// If the configuration file changed since it was loaded,
+// it is reloaded before the next format, keeping the state of the windows,
+// and the command is chosen again from args, those of the command line,
+// and the profile in use.
+// If tag is non-empty, it is added to the tag of each new window
+// whose file the rules of the configuration match.
+// It returns only when reading the Acme log fails.
+func onPut(re *regexp.Regexp, tag string, args []string, j job) error {
+	log, err := acme.OpenLog()
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	// Putting a window that we just formatted generates another put event.
+	// The body is already formatted, so skip it.
+	ours := make(map[int]bool)
+	j.cache = &fmtCache{}
+	loaded := configTime()
+	for {
+		ev, err := log.Read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ev.Op == "new" && tag != "":
+			if err := addTag(ev.ID, ev.Name, tag, j.conf); err != nil {
+				eprintf("%s: %s\n", ev.Name, err)
+			}
+			continue
+		case ev.Op == "del":
+			delete(ours, ev.ID)
+			continue
+		case ev.Op != "put" || !nameMatch(re, ev.Name):
+			continue
+		case ours[ev.ID]:
+			delete(ours, ev.ID)
+			continue
+		}
+		j.id, j.dir = ev.ID, filepath.Dir(ev.Name)
+		if t := configTime(); !t.Equal(loaded) {
+			loaded = t
+			reloadConfig(&j, j.dir, args)
+		}
+		changed, err := fmtPut(ev.ID, j)
+		if err != nil {
+			eprintf("%s: %s\n", ev.Name, err)
+			continue
+		}
+		if changed {
+			ours[ev.ID] = true
+		}
+	}
+}
+
+// configTime returns the modification time of the configuration file,
+// or the zero time if it does not exist.
+func configTime() time.Time {
+	fi, err := os.Stat(configPath())
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// reloadConfig loads the configuration again into j,
+// with the command of args, those of the command line,
+// or of the profile in use, as the aliases and profile now say,
+// saying so in the +Errors window of dir.
+// If it fails to load, j keeps the configuration that it has.
+// Changes to the flags of the profile take effect only when Fmt restarts.
+func reloadConfig(j *job, dir string, args []string) {
+	conf, err := loadConfig()
+	if err == nil && j.conf.profile != nil {
+		if err = conf.useProfile(j.conf.profile.name, args); err == nil {
+			args = flag.Args()
+		}
+	}
+	if err != nil {
+		acme.Err(dir, fmt.Sprintf(tr("failed to reload the configuration: %s\n"), err))
+		return
+	}
+	j.conf = conf
+	j.run = conf.command(args)
+	// Formats cached under the old rules may not hold under the new.
+	j.cache = &fmtCache{}
+	acme.Err(dir, fmt.Sprintf(tr("reloaded the configuration %s\n"), configPath()))
+}
+
+// addTag adds text to the tag of the window with the given ID, named name,
+// if a rule of conf matches name and the tag does not already hold the text.
+func addTag(id int, name, text string, conf *config) error {
+	if !formattable(name) {
+		return nil
+	}
+	conf, err := conf.forFile(name)
+	if err != nil {
+		return errorf("failed to load the project configuration: %s", err)
+	}
+	if r := conf.match(name); r == nil || r.exclude {
+		return nil
+	}
+	win, err := acme.Open(id, nil)
+	if err != nil {
+		return errorf("failed to open win: %s", err)
+	}
+	defer win.CloseFiles()
+	cur, err := win.ReadAll("tag")
+	if err != nil {
+		return errorf("failed to read the tag: %s", err)
+	}
+	if strings.Contains(string(cur), strings.TrimSpace(text)) {
+		return nil
+	}
+	if _, err := win.Write("tag", []byte(text)); err != nil {
+		return errorf("failed to write the tag: %s", err)
+	}
+	return nil
+}
+
+// nameMatch returns whether the window named name matches re
+// and should be formatted.
+// Directory and special windows are never formatted.
+func nameMatch(re *regexp.Regexp, name string) bool {
+	return formattable(name) && re.MatchString(name)
+}
+
+// formattable returns whether the window named name may be formatted:
+// it is not a directory or a special window such as +Errors.
+func formattable(name string) bool {
+	return name != "" && !strings.HasSuffix(name, "/") && !strings.HasPrefix(filepath.Base(name), "+")
+}
+
+// fmtPut formats the window with the given ID.
+// If the body changed, the window is Put again.
+func fmtPut(id int, j job) (bool, error) {
+	win, err := acme.Open(id, nil)
+	if err != nil {
+		return false, errorf("failed to open win: %s", err)
+	}
+	defer win.CloseFiles()
+	changed, err := fmtWin(wrapped(win), j)
+	if err != nil || !changed {
+		return changed, err
+	}
+	if err := win.Ctl("put"); err != nil {
+		return changed, errorf("failed to put: %s", err)
+	}
+	return changed, nil
+}
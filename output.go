@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+)
+
+var (
+	outputOnce sync.Once
+	outputs    *template.Template
+)
+
+// templatesPath returns the path of the user's output templates.
+func templatesPath() string {
+	return filepath.Join(os.Getenv("HOME"), "lib", "fmt", "templates")
+}
+
+// A resultOutput is the data of the result template,
+// executed for each window formatted by Fmt -all.
+type resultOutput struct {
+	Name string
+	// Status is formatted, unchanged, or failed.
+	Status string
+	// Err is the error if Status is failed.
+	Err error
+}
+
+// A summaryOutput is the data of the summary template,
+// executed after Fmt -all.
+type summaryOutput struct {
+	Formatted, Unchanged, Failed int
+}
+
+// A changeOutput is the data of the change template,
+// executed for each change listed by Fmt -changes.
+type changeOutput struct {
+	Name         string
+	Line0, Line1 int
+}
+
+// A diagOutput is the data of the diag template,
+// executed for each diagnostic of a formatter shown by Fmt.
+type diagOutput struct {
+	// File is the file name of the diagnostic, made absolute.
+	File string
+	// Line and Col are the position; Col is 0 if it was not given.
+	Line, Col int
+	// Text is the rest of the line after the position.
+	Text string
+}
+
+// render writes the output template with the given name executed with data to w,
+// and reports whether the user defined a template of that name.
+// If not, the caller writes its usual output.
+//
+// The templates are Go text/templates read from $HOME/lib/fmt/templates,
+// each defined with {{define "name"}},
+// so that the look of Fmt's output can be made to match other Acme tools.
+// The names are result, summary, change, and diag.
+func render(w io.Writer, name string, data interface{}) bool {
+	outputOnce.Do(loadTemplates)
+	if outputs == nil || outputs.Lookup(name) == nil {
+		return false
+	}
+	var b bytes.Buffer
+	if err := outputs.ExecuteTemplate(&b, name, data); err != nil {
+		eprintf("bad %s template: %s\n", name, err)
+		return false
+	}
+	w.Write(b.Bytes())
+	return true
+}
+
+func loadTemplates() {
+	data, err := ioutil.ReadFile(templatesPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			eprintf("failed to read the templates: %s\n", err)
+		}
+		return
+	}
+	t, err := template.New("").Parse(string(data))
+	if err != nil {
+		eprintf("failed to read the templates: %s\n", err)
+		return
+	}
+	outputs = t
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"path/filepath"
+	"strings"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plumb"
+)
+
+// plumbPort is the plumber port from which Fmt -plumb reads requests.
+const plumbPort = "fmt"
+
+// plumbServe formats the file named by each message plumbed to the fmt port
+// as described by j, until reading the port fails.
+// The file is formatted in its window, if it has one, and otherwise on disk.
+// The command is that of j, if any, or else that of the message's cmd attribute,
+// if any, or else the one chosen by the configuration.
+func plumbServe(j job) error {
+	fid, err := plumb.Open(plumbPort, plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	r := bufio.NewReader(fid)
+	j.cache = &fmtCache{}
+	// The results are written as they come; there is no summary.
+	var t tally
+	for {
+		var m plumb.Message
+		if err := m.Recv(r); err != nil {
+			return err
+		}
+		name := strings.TrimSpace(string(m.Data))
+		if name == "" {
+			continue
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(m.Dir, name)
+		}
+		k := j
+		if len(k.run) == 0 {
+			cmd, err := splitArgs(m.LookupAttr("cmd"))
+			if err != nil {
+				eprintf("%s: %s\n", name, err)
+				continue
+			}
+			k.run = k.conf.command(cmd)
+		}
+		changed, err := plumbed(name, k)
+		t.add(0, name, changed, err)
+	}
+}
+
+// plumbed formats the file name as described by j,
+// in its window if it has one and otherwise on disk,
+// and returns whether it changed.
+func plumbed(name string, j job) (bool, error) {
+	if id, err := findWin(localWindows, name); err == nil {
+		j.id, j.dir = id, filepath.Dir(name)
+		return fmtOpen(id, j)
+	}
+	return fmtDisk(name, j)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// preview formats the body of win as described by j,
+// and shows the resulting diff in a new window instead of re-writing the body.
+// The header of the diff window describes the pipeline that produced it.
+func preview(win fmtharness.Window, j job) error {
+	name, err := winName(win)
+	if err != nil {
+		return errorf("failed to read the window name: %s", err)
+	}
+	if j, err = j.resolved(name); err != nil {
+		return err
+	}
+	dw, _, _, err := openDiff(win, name, j)
+	if dw != nil {
+		dw.CloseFiles()
+	}
+	return err
+}
+
+// confirm shows the diff of formatting win as described by j, like preview,
+// and adds Apply and Discard to the tag of the diff window.
+// Apply re-writes the body of win with the formatted text,
+// if the body has not changed since, and Discard deletes the diff window.
+// It returns once either is executed or the diff window is deleted.
+// The window is locked until then, so that another Fmt cannot change it
+// between the diff and Apply.
+func confirm(win fmtharness.Window, j job) error {
+	name, err := winName(win)
+	if err != nil {
+		return errorf("failed to read the window name: %s", err)
+	}
+	unlock, err := lockWin(j.id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if j, err = j.resolved(name); err != nil {
+		return err
+	}
+	dw, body, formatted, err := openDiff(win, name, j)
+	if dw == nil || err != nil {
+		return err
+	}
+	defer dw.CloseFiles()
+	if _, err := dw.Write("tag", []byte(" Apply Discard")); err != nil {
+		return err
+	}
+	for e := range dw.EventChan() {
+		if e.C2 != 'x' && e.C2 != 'X' {
+			dw.WriteEvent(e)
+			continue
+		}
+		switch string(e.Text) {
+		case "Apply":
+			cur, err := fmtharness.ReadBody(win)
+			if err != nil {
+				return errorf("failed to read the body: %s", err)
+			}
+			if !bytes.Equal(cur, body) {
+				eprintf("the body changed since the diff was made; execute Fmt again\n")
+				continue
+			}
+			// Not forced, so that edits made while it writes are refused.
+			res, err := fmtharness.Format(win, storedText(formatted), fmtharness.Options{})
+			printWarnings(res)
+			if err != nil {
+				return err
+			}
+			if res.Changed {
+				// The text of the diff is in memory, even if Format spilled it to files.
+				res.Body, res.Formatted = body, formatted
+				// The formatter ran for the diff, so its time is not known.
+				recordFormat(win, j, res, 0)
+			}
+			dw.Del(true)
+			return nil
+		case "Discard":
+			dw.Del(true)
+			return nil
+		default:
+			dw.WriteEvent(e)
+		}
+	}
+	return nil
+}
+
+// storedText is a Formatter whose output is the text itself, whatever the input.
+type storedText []byte
+
+func (t storedText) Format(dst io.Writer, src io.Reader) error {
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return err
+	}
+	_, err := dst.Write(t)
+	return err
+}
+
+// openDiff formats the body of win, named name, as described by the resolved job j,
+// and opens a window showing the diff, which the caller must close.
+// If formatting makes no changes, no window is opened and the returned window is nil.
+func openDiff(win fmtharness.Window, name string, j job) (dw *acme.Win, body, formatted []byte, err error) {
+	body, formatted, err = fmtharness.Formatted(win, j.formatter())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	a, b := fmtharness.SplitLines(string(body)), fmtharness.SplitLines(string(formatted))
+	hs := fmtharness.Diff(a, b)
+	if len(hs) == 0 {
+		eprintf("%s: no changes\n", name)
+		return nil, nil, nil, nil
+	}
+
+	var buf bytes.Buffer
+	writePipeline(&buf, j.dir, j.run)
+	buf.WriteString("\n")
+	marks := fmtharness.SpaceMarks
+	if plain {
+		marks = fmtharness.PlainSpaceMarks
+	}
+	fmtharness.Unified(&buf, name, name+" (formatted)", a, b, hs, 3, marks)
+
+	if dw, err = acme.New(); err != nil {
+		return nil, nil, nil, errorf("failed to open the diff window: %s", err)
+	}
+	if err := writeDiff(dw, name, buf.Bytes()); err != nil {
+		dw.CloseFiles()
+		return nil, nil, nil, err
+	}
+	return dw, body, formatted, nil
+}
+
+func writeDiff(dw *acme.Win, name string, diff []byte) error {
+	if err := dw.Name("%s+Fmt.diff", name); err != nil {
+		return err
+	}
+	if _, err := dw.Write("body", diff); err != nil {
+		return err
+	}
+	if err := dw.Ctl("clean"); err != nil {
+		return err
+	}
+	return fmtharness.ShowAddr(dw, 0, 0)
+}
+
+// writePipeline writes a description of the command run in directory dir:
+// the arguments, the resolved path and version of the tool, and the directory.
+// The values are aligned with tabs unless plain is set.
+func writePipeline(w io.Writer, dir string, run []string) {
+	sep := "\t"
+	if plain {
+		sep = " "
+	}
+	fmt.Fprintf(w, tr("Pipeline:%s%s\n"), sep, strings.Join(run, " "))
+	// With -trim or -blocks, there may be no command.
+	if len(run) > 0 {
+		path, err := exec.LookPath(run[0])
+		if err != nil {
+			fmt.Fprintf(w, tr("Tool:%s%s (not found: %s)\n"), sep, run[0], err)
+		} else if v := toolVersion(path); v != "" {
+			fmt.Fprintf(w, tr("Tool:%s%s (%s)\n"), sep, path, v)
+		} else {
+			fmt.Fprintf(w, tr("Tool:%s%s\n"), sep, path)
+		}
+	}
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	fmt.Fprintf(w, tr("Dir:%s%s\n"), sep, dir)
+}
+
+// toolVersion returns the module version and Go version
+// of the Go binary at path, or "" if it is not a Go binary.
+func toolVersion(path string) string {
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return fmt.Sprintf("%s %s, %s", bi.Main.Path, v, bi.GoVersion)
+	}
+	return bi.GoVersion
+}
+
+// winName returns the file name of win, the first word of its tag.
+func winName(win fmtharness.Window) (string, error) {
+	tag, err := win.ReadAll("tag")
+	if err != nil {
+		return "", err
+	}
+	fs := strings.Fields(string(tag))
+	if len(fs) == 0 {
+		return "", nil
+	}
+	return fs[0], nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+)
+
+// A profile is a named bundle of settings for a way of working,
+// such as strict or quick, chosen by the -p flag.
+type profile struct {
+	name string
+	// Flags are the flags of Fmt that the profile sets,
+	// unless they are given on the command line.
+	flags []string
+	// Cmd, if non-nil, is the command run if none is given.
+	cmd []string
+	// Pre and Post, if non-nil, replace the hooks of the rules.
+	pre, post []string
+	// Source is the file and line defining the profile.
+	source string
+}
+
+// set sets the key of the profile to val,
+// read from the file and line source.
+func (p *profile) set(key, val, source string) error {
+	args, err := splitArgs(val)
+	if err != nil {
+		return errorf("%s: %s", source, err)
+	}
+	if len(args) == 0 {
+		return errorf("%s: empty %s", source, key)
+	}
+	switch key {
+	case "flags":
+		p.flags = args
+	case "cmd":
+		p.cmd = args
+	case "pre":
+		p.pre = args
+	case "post":
+		p.post = args
+	default:
+		return errorf("%s: unknown profile key %s", source, key)
+	}
+	return nil
+}
+
+// useProfile sets the flags of the named profile of c
+// that are not already set on the command line,
+// gives its command as the arguments if args, those of the command line,
+// are empty, and makes it the profile in use, whose hooks apply to all files.
+func (c *config) useProfile(name string, args []string) error {
+	p := c.profiles[name]
+	if p == nil {
+		return errorf("no profile %s in %s", name, configPath())
+	}
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	// The command line exits on an error, so parse the profile's flags
+	// into a set that shares their values but reports errors.
+	// Flags set by a profile are then not counted as set on the command line
+	// if the profile is used again.
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(p.flags); err != nil {
+		return errorf("%s: flags of profile %s: %s", p.source, name, err)
+	}
+	if fs.NArg() > 0 {
+		return errorf("%s: flags of profile %s: unexpected %s", p.source, name, strings.Join(fs.Args(), " "))
+	}
+	// The command line takes precedence.
+	for name, val := range set {
+		flag.Set(name, val)
+	}
+	if len(args) == 0 {
+		args = p.cmd
+	}
+	flag.CommandLine.Parse(append([]string{"--"}, args...))
+	c.profile = p
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUseProfile(t *testing.T) {
+	c := &config{profiles: map[string]*profile{
+		"bad":    {name: "bad", flags: []string{"-nosuchflag"}, source: "config:3"},
+		"extra":  {name: "extra", flags: []string{"gofmt"}, source: "config:5"},
+		"strict": {name: "strict", cmd: []string{"gofumpt", "-extra"}, source: "config:7"},
+	}}
+	tests := []struct {
+		name string
+		args []string
+		// Err, if non-empty, is a substring of the expected error.
+		err string
+		// Want are the arguments after using the profile.
+		want []string
+	}{
+		{name: "bad", err: "config:3"},
+		{name: "extra", err: "config:5: flags of profile extra: unexpected gofmt"},
+		{name: "missing", err: "no profile missing"},
+		{name: "strict", want: []string{"gofumpt", "-extra"}},
+		{name: "strict", args: []string{"gofmt"}, want: []string{"gofmt"}},
+	}
+	defer flag.CommandLine.Parse(append([]string{"--"}, flag.Args()...))
+	for _, test := range tests {
+		err := c.useProfile(test.name, test.args)
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("useProfile(%s)=%v, want an error containing %q", test.name, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("useProfile(%s)=%v, want nil", test.name, err)
+		case test.err == "" && !reflect.DeepEqual(flag.Args(), test.want):
+			t.Errorf("useProfile(%s, %q): args are %q, want %q", test.name, test.args, flag.Args(), test.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// progressDelay is how long a formatter runs
+// before its window shows the progress mark.
+const progressDelay = time.Second
+
+// progressMark is added to the tag of a window
+// while a slow formatter runs on it.
+const progressMark = " Fmt…"
+
+// showProgress adds progressMark to the tag of the local window
+// with the given ID, unless the returned function is called
+// within progressDelay. The returned function removes the mark.
+// The tag is written through its own connection to the window,
+// so that it does not disturb the formatter's reading of the body.
+func showProgress(id int) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-done:
+			return
+		case <-time.After(progressDelay):
+		}
+		w, err := acme.Open(id, nil)
+		if err != nil {
+			return
+		}
+		defer w.CloseFiles()
+		if _, err := w.Write("tag", []byte(progressMark)); err != nil {
+			return
+		}
+		<-done
+		if err := removeMark(w); err != nil {
+			eprintf("failed to remove the progress mark from the tag: %s\n", err)
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// removeMark removes progressMark from the tag of w,
+// keeping any other edits made to the tag in the meantime.
+// Acme can only clear the part of the tag after the bar,
+// so that part is cleared and written again without the mark.
+func removeMark(w *acme.Win) error {
+	tag, err := w.ReadAll("tag")
+	if err != nil {
+		return err
+	}
+	i := strings.IndexByte(string(tag), '|')
+	if i < 0 || !strings.Contains(string(tag[i+1:]), progressMark) {
+		return nil
+	}
+	user := strings.Replace(string(tag[i+1:]), progressMark, "", 1)
+	if err := w.Ctl("cleartag"); err != nil {
+		return err
+	}
+	_, err = w.Write("tag", []byte(user))
+	return err
+}
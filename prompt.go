@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// prompt opens a window explaining refusal r, made by format,
+// and offering ways to resolve it:
+// Retry calls format again, Force calls it ignoring refusals,
+// Diff previews the change, and Cancel gives up.
+// It returns once the refusal is resolved or the prompt window is deleted,
+// with whether the body was re-written.
+// If the prompt is cancelled or deleted, the error is the refusal.
+func prompt(win fmtharness.Window, j job, r *fmtharness.RefusalError, format func(fmtharness.Window, job) (bool, error)) (bool, error) {
+	name, err := winName(win)
+	if err != nil {
+		return false, errorf("failed to read the window name: %s", err)
+	}
+	pw, err := acme.New()
+	if err != nil {
+		return false, errorf("failed to open the prompt window: %s", err)
+	}
+	defer pw.CloseFiles()
+	if err := pw.Name("%s+Fmt.prompt", name); err != nil {
+		return false, err
+	}
+	show := func(r *fmtharness.RefusalError) error {
+		if err := pw.Addr(","); err != nil {
+			return err
+		}
+		opts := "Retry Force Diff Cancel\n"
+		if plain {
+			opts = "Retry\nForce\nDiff\nCancel\n"
+		}
+		if _, err := pw.Write("data", []byte(fmt.Sprintf(tr("%s: %s\n\n"), name, r.Reason)+opts)); err != nil {
+			return err
+		}
+		return pw.Ctl("clean")
+	}
+	if err := show(r); err != nil {
+		return false, err
+	}
+	for e := range pw.EventChan() {
+		if e.C2 != 'x' && e.C2 != 'X' {
+			pw.WriteEvent(e)
+			continue
+		}
+		switch string(e.Text) {
+		case "Retry", "Force":
+			k := j
+			k.force = string(e.Text) == "Force"
+			changed, err := format(win, k)
+			if errors.As(err, &r) {
+				if err := show(r); err != nil {
+					return false, err
+				}
+				continue
+			}
+			pw.Del(true)
+			return changed, err
+		case "Diff":
+			if err := preview(win, j); err != nil {
+				return false, err
+			}
+		case "Cancel":
+			pw.Del(true)
+			return false, r
+		default:
+			pw.WriteEvent(e)
+		}
+	}
+	return false, r
+}
@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+
+// splitArgs splits s into arguments at white space, as rc(1) does:
+// text in single quotes is part of one argument, spaces and all,
+// and two single quotes within quotes stand for one,
+// so that '-style={BasedOnStyle: LLVM}' is a single argument.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	// In is whether there is an argument in progress,
+	// which may be empty, as is ''.
+	in := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			in = true
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, errorf("unterminated quote in %s", s)
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						arg.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				arg.WriteByte(s[i])
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if in {
+				args = append(args, arg.String())
+				arg.Reset()
+				in = false
+			}
+		default:
+			in = true
+			arg.WriteByte(c)
+		}
+	}
+	if in {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// quoteArgs joins args with spaces, quoting them as rc(1) does where needed,
+// so that splitArgs returns them.
+func quoteArgs(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && !strings.ContainsAny(a, " \t\n\r'#;&|^$=`{}()<>\\") {
+			q[i] = a
+			continue
+		}
+		q[i] = "'" + strings.ReplaceAll(a, "'", "''") + "'"
+	}
+	return strings.Join(q, " ")
+}
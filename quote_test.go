@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		err  bool
+	}{
+		{s: "", want: nil},
+		{s: "  \t\n", want: nil},
+		{s: "gofmt", want: []string{"gofmt"}},
+		{s: " gofmt  -s\t-l ", want: []string{"gofmt", "-s", "-l"}},
+		{s: "clang-format '-style={BasedOnStyle: LLVM}'", want: []string{"clang-format", "-style={BasedOnStyle: LLVM}"}},
+		{s: "a'b c'd", want: []string{"ab cd"}},
+		{s: "''", want: []string{""}},
+		{s: "a '' b", want: []string{"a", "", "b"}},
+		{s: "'it''s'", want: []string{"it's"}},
+		{s: "''''", want: []string{"'"}},
+		{s: "'α β'", want: []string{"α β"}},
+		{s: "'unterminated", err: true},
+		{s: "a 'b''", err: true},
+	}
+	for _, test := range tests {
+		got, err := splitArgs(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("splitArgs(%q)=%q, nil, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q)=%q, %v, want %q, nil", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestQuoteArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"gofmt", "-s"}, "gofmt -s"},
+		{[]string{""}, "''"},
+		{[]string{"clang-format", "-style={BasedOnStyle: LLVM}"}, "clang-format '-style={BasedOnStyle: LLVM}'"},
+		{[]string{"it's"}, "'it''s'"},
+		{[]string{"a|b", "x=1", "$home"}, "'a|b' 'x=1' '$home'"},
+		{[]string{"α"}, "α"},
+	}
+	for _, test := range tests {
+		got := quoteArgs(test.args)
+		if got != test.want {
+			t.Errorf("quoteArgs(%q)=%q, want %q", test.args, got, test.want)
+		}
+		if args, err := splitArgs(got); err != nil || len(test.args) > 0 && !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs(quoteArgs(%q))=%q, %v", test.args, args, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A report is the result of formatting a window,
+// printed as JSON by the -json flag for scripts and editor wrappers.
+type report struct {
+	Name string `json:"name"`
+	// Changed is whether the body was re-written.
+	Changed bool `json:"changed"`
+	// Hunks, Added, and Deleted count the changed hunks
+	// and the lines added and deleted by the format.
+	Hunks   int `json:"hunks"`
+	Added   int `json:"added"`
+	Deleted int `json:"deleted"`
+	// Status is the exit status of the formatter,
+	// or -1 if it did not run or did not exit normally.
+	Status int `json:"status"`
+	// Duration is the time in seconds that the format took.
+	Duration float64 `json:"duration"`
+	// Diagnostics are the lines of the formatter's standard error.
+	Diagnostics []string `json:"diagnostics"`
+	// Error is the error of the format, if it failed or was refused.
+	Error string `json:"error,omitempty"`
+}
+
+// fmtWinJSON formats the body of win as fmtWin does,
+// and prints a report of the result as JSON to standard output.
+// The returned bool reports whether the body was re-written.
+func fmtWinJSON(win fmtharness.Window, j job) (bool, error) {
+	start := time.Now()
+	j.report = &report{Status: -1, Diagnostics: []string{}}
+	changed, err := fmtWin(win, j)
+	r := j.report
+	r.Duration = time.Since(start).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	data, merr := json.Marshal(r)
+	if merr != nil {
+		return changed, merr
+	}
+	if _, werr := os.Stdout.Write(append(data, '\n')); werr != nil {
+		return changed, errorf("failed to write standard output: %s", werr)
+	}
+	return changed, err
+}
+
+// set fills in r from the result of formatting the window named name
+// and the formatter's standard error.
+func (r *report) set(name string, res *fmtharness.Result, err error, stderr []byte) {
+	r.Name = name
+	if s := strings.TrimRight(string(stderr), "\n"); s != "" {
+		r.Diagnostics = strings.Split(s, "\n")
+	}
+	var ee *exec.ExitError
+	switch {
+	case errors.As(err, &ee):
+		r.Status = ee.ExitCode()
+	case res != nil:
+		r.Status = 0
+	}
+	if res == nil || !res.Changed {
+		return
+	}
+	r.Changed = true
+	if res.Spilled {
+		// The text is not in memory to count the changes.
+		return
+	}
+	a := fmtharness.SplitLines(string(res.Body))
+	b := fmtharness.SplitLines(string(res.Formatted))
+	for _, h := range fmtharness.Diff(a, b) {
+		r.Hunks++
+		r.Deleted += h.A1 - h.A0
+		r.Added += h.B1 - h.B0
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// resident adds Fmt to the tag of aw and formats win, the same window,
+// as described by j each time Fmt is executed in the window,
+// until the window is deleted.
+// The command is given by args, as given to Fmt.
+// Executing Fmt with arguments replaces the command for that and later formats.
+// The command is remembered by window name,
+// so that a later resident Fmt without arguments for the same file repeats it.
+func resident(aw *acme.Win, win fmtharness.Window, j job, args []string) error {
+	name, err := winName(win)
+	if err != nil {
+		return errorf("failed to read the window name: %s", err)
+	}
+	if len(args) == 0 {
+		args = lastCommand(name)
+	} else {
+		remember(name, args)
+	}
+	j.run = j.conf.command(args)
+	j.cache = &fmtCache{}
+	tag, err := win.ReadAll("tag")
+	if err != nil {
+		return errorf("failed to read the tag: %s", err)
+	}
+	if !hasWord(string(tag), "Fmt") {
+		if err := aw.Fprintf("tag", " Fmt"); err != nil {
+			return errorf("failed to write the tag: %s", err)
+		}
+	}
+	for e := range aw.EventChan() {
+		switch e.C2 {
+		case 'x', 'X':
+			args, err := splitArgs(string(e.Text) + " " + string(e.Arg))
+			if err != nil || len(args) == 0 || args[0] != "Fmt" {
+				aw.WriteEvent(e)
+				continue
+			}
+			if args = args[1:]; len(args) > 0 {
+				j.run = j.conf.command(args)
+				if name, err := winName(win); err == nil {
+					remember(name, args)
+				}
+			}
+			_, err = fmtWin(win, j)
+			var r *fmtharness.RefusalError
+			if errors.As(err, &r) {
+				if _, err = prompt(win, j, r, fmtWin); errors.As(err, &r) {
+					// Cancelled; the prompt already showed it.
+					err = nil
+				}
+			}
+			if err != nil {
+				eprintf("%s\n", err)
+			}
+		case 'l', 'L':
+			aw.WriteEvent(e)
+		}
+	}
+	return nil
+}
+
+func hasWord(s, w string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == w {
+			return true
+		}
+	}
+	return false
+}
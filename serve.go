@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"html"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// serveDiff implements Fmt serve-diff, serving the diff that formatting win
+// as described by j would make, as a web page at a local address,
+// so that someone else can review it before it is applied.
+// The diff is computed afresh for each request; the body is never changed.
+func serveDiff(win fmtharness.Window, j job, args []string) error {
+	fs := flag.NewFlagSet("serve-diff", flag.ExitOnError)
+	addr := fs.String("http", "localhost:0", "serve on this address")
+	fs.Usage = func() {
+		eprintf("Usage: Fmt serve-diff [-http addr] [<cmd>]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	j.run = j.conf.command(fs.Args())
+	name, err := winName(win)
+	if err != nil {
+		return errorf("failed to read the window name: %s", err)
+	}
+	if j, err = j.resolved(name); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	eprintf("serving the diff of %s at http://%s/\n", name, l.Addr())
+	var mu sync.Mutex
+	return http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, tr("read only"), http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		body, formatted, err := fmtharness.Formatted(win, j.formatter())
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		writePipeline(&buf, j.dir, j.run)
+		buf.WriteString("\n")
+		a, b := fmtharness.SplitLines(string(body)), fmtharness.SplitLines(string(formatted))
+		if hs := fmtharness.Diff(a, b); len(hs) == 0 {
+			buf.WriteString(tr("no changes\n"))
+		} else {
+			fmtharness.Unified(&buf, name, name+" (formatted)", a, b, hs, 3, fmtharness.PlainSpaceMarks)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<!DOCTYPE html>\n<title>" + html.EscapeString(name) + "</title>\n<pre>"))
+		w.Write([]byte(html.EscapeString(buf.String())))
+		w.Write([]byte("</pre>\n"))
+	}))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// session is the directory of the scratch files of this run of Fmt,
+// or "" if there is none.
+var session string
+
+// scratchRoot, if non-empty, is the directory in which to create
+// the session directory instead of $TMPDIR, as set by the -tmpdir flag.
+var scratchRoot string
+
+// memDir is the memory-backed file system used by -tmpdir mem,
+// so that the text being formatted is never written to a disk.
+const memDir = "/dev/shm"
+
+// setScratchRoot sets the directory of the session directory to dir,
+// or if dir is mem, to memDir, which must exist.
+func setScratchRoot(dir string) error {
+	if dir == "mem" {
+		if fi, err := os.Stat(memDir); err != nil || !fi.IsDir() {
+			return errorf("-tmpdir mem needs %s, which is on Linux", memDir)
+		}
+		dir = memDir
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errorf("%s is not a directory", dir)
+	}
+	scratchRoot = dir
+	// So that the commands that Fmt runs put their temporary files there too.
+	return os.Setenv("TMPDIR", dir)
+}
+
+// stateKey names the Acme whose windows Fmt formats,
+// by its name space directory or the dial string given by -a.
+// It keys the files that Fmt keeps about the windows.
+var stateKey string
+
+// userName returns the name of the current user, for file names.
+func userName() string {
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// root returns the directory of Fmt's files: that given by -tmpdir, or $TMPDIR.
+func root() string {
+	if scratchRoot != "" {
+		return scratchRoot
+	}
+	return os.TempDir()
+}
+
+// sessionPrefix returns the prefix of the names of the session directories
+// of the current user.
+func sessionPrefix() string {
+	return filepath.Join(root(), "Fmt-"+userName()+"-")
+}
+
+// userDir returns the directory, private to the current user,
+// that holds a state directory for each Acme.
+func userDir() string {
+	return filepath.Join(root(), "Fmt-"+userName())
+}
+
+// stateDir returns the directory of the files that Fmt keeps
+// from one run to the next about the windows of the Acme named by stateKey,
+// such as their locks, format histories, and backups,
+// creating it if need be.
+// It is in userDir, so that other users can neither read the files
+// nor take the names, and Acmes on one host do not share files
+// for windows that happen to have the same ID.
+func stateDir() (string, error) {
+	user := userDir()
+	if err := privateDir(user); err != nil {
+		return "", err
+	}
+	key := stateKey
+	if key == "" {
+		key = "default"
+	}
+	dir := filepath.Join(user, url.PathEscape(key))
+	if err := privateDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// stateFile returns the path of the file with the given name in stateDir.
+func stateFile(name string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// privateDir creates the directory dir, readable only by the user,
+// or if it exists, checks that it is such a directory
+// and not, for example, a symbolic link planted by another user.
+func privateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || fi.Mode().Perm()&077 != 0 || ok && int(st.Uid) != os.Getuid() {
+		return errorf("%s is not a private directory of the user", dir)
+	}
+	return nil
+}
+
+// startSession creates the session directory, $TMPDIR/Fmt-<user>-<pid>,
+// and makes it the directory of scratch files.
+// First it removes the session directories left by runs
+// that died without removing their own.
+// If the directory cannot be created, scratch files go in $TMPDIR,
+// or the directory given by -tmpdir.
+func startSession() {
+	sweep()
+	dir := sessionPrefix() + strconv.Itoa(os.Getpid())
+	if err := os.Mkdir(dir, 0700); err != nil {
+		eprintf("failed to create the temporary directory: %s\n", err)
+		fmtharness.TempDir = scratchRoot
+		return
+	}
+	session = dir
+	fmtharness.TempDir = dir
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sigs
+		exit(1)
+	}()
+}
+
+// endSession removes the session directory.
+func endSession() {
+	if session == "" {
+		return
+	}
+	if err := os.RemoveAll(session); err != nil {
+		eprintf("failed to remove the temporary directory: %s\n", err)
+	}
+}
+
+// exit removes the session directory and exits with the given status.
+func exit(code int) {
+	endSession()
+	os.Exit(code)
+}
+
+// sweep removes the session directories of the current user
+// whose process no longer exists.
+func sweep() {
+	prefix := sessionPrefix()
+	dirs, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(strings.TrimPrefix(dir, prefix))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// writePrivate writes data to the file at path, readable only by the user,
+// whatever the umask and the mode of any existing file.
+// It writes a new file and renames it over path,
+// so that a file or symbolic link planted at path by another user
+// in a shared temporary directory is replaced rather than written through.
+func writePrivate(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWritePrivate(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0))
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		// Plant creates whatever is at path before the write.
+		plant func(path string) error
+	}{
+		{
+			name:  "new file",
+			plant: func(string) error { return nil },
+		},
+		{
+			name: "readable file",
+			plant: func(path string) error {
+				return ioutil.WriteFile(path, []byte("old"), 0644)
+			},
+		},
+		{
+			name: "symbolic link",
+			plant: func(path string) error {
+				return os.Symlink(filepath.Join(dir, "target"), path)
+			},
+		},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "state"+string(rune('0'+i)))
+		if err := test.plant(path); err != nil {
+			t.Fatalf("%s: failed to plant: %s", test.name, err)
+		}
+		if err := writePrivate(path, []byte("data")); err != nil {
+			t.Errorf("%s: writePrivate()=%v, want nil", test.name, err)
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode=%s, want a regular file of mode 0600", test.name, fi.Mode())
+		}
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != "data" {
+			t.Errorf("%s: read %q, %v, want %q", test.name, data, err, "data")
+		}
+	}
+	// The link was replaced, not written through.
+	if _, err := os.Stat(filepath.Join(dir, "target")); !os.IsNotExist(err) {
+		t.Errorf("the link target exists: %v", err)
+	}
+	// Nor are any temporary files left.
+	if names, _ := filepath.Glob(filepath.Join(dir, "state*.*")); len(names) > 0 {
+		t.Errorf("temporary files left: %v", names)
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	dir := t.TempDir()
+	priv := filepath.Join(dir, "priv")
+	if err := privateDir(priv); err != nil {
+		t.Fatalf("privateDir()=%v, want nil", err)
+	}
+	// It exists now, and is still fine.
+	if err := privateDir(priv); err != nil {
+		t.Errorf("privateDir() of an existing private directory=%v, want nil", err)
+	}
+
+	open := filepath.Join(dir, "open")
+	if err := os.Mkdir(open, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(open, 0755)
+	if err := privateDir(open); err == nil {
+		t.Errorf("privateDir() of a readable directory=nil, want an error")
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(priv, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(link); err == nil {
+		t.Errorf("privateDir() of a symbolic link=nil, want an error")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A fileStat counts the formats that changed a file.
+type fileStat struct {
+	name string
+	// N is the number of formats, and lines is the number of lines
+	// that they deleted and added, altogether.
+	n, lines int
+}
+
+// A toolStat counts the runs of a formatter that changed a file.
+type toolStat struct {
+	name       string
+	n          int
+	total, max time.Duration
+}
+
+// stats implements Fmt stats, writing to standard output
+// a summary of the format histories of the windows of files in a project:
+// how often each file was reformatted and by how many lines on average,
+// and how long each formatter took, slowest first.
+// It returns the exit status.
+//
+// The histories are those that Fmt keeps for -undo,
+// so they only cover the formats that changed a window,
+// at most maxHistory per window, since the temporary directory was last cleaned.
+func stats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Usage = func() {
+		eprintf("Usage: Fmt stats [<dir>]\n\nThe project is the git repository of <dir>, by default the current directory,\nor if it is not in one, <dir>.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 1
+	}
+	root, err := projectRoot(dir)
+	if err != nil {
+		eprintf("%s\n", err)
+		return 1
+	}
+	// The histories of the windows of every Acme of the user.
+	paths, err := filepath.Glob(filepath.Join(userDir(), "*", "history-*"))
+	if err != nil {
+		eprintf("%s\n", err)
+		return 1
+	}
+	files := make(map[string]*fileStat)
+	tools := make(map[string]*toolStat)
+	var since time.Time
+	for _, p := range paths {
+		if _, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(p), "history-")); err != nil {
+			// A temporary file of writePrivate.
+			continue
+		}
+		hist, err := readHistoryFile(p)
+		if err != nil {
+			eprintf("failed to read %s: %s\n", p, err)
+			continue
+		}
+		for _, a := range hist {
+			rel, err := filepath.Rel(root, a.Name)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			if since.IsZero() || a.Time.Before(since) {
+				since = a.Time
+			}
+			f := files[rel]
+			if f == nil {
+				f = &fileStat{name: rel}
+				files[rel] = f
+			}
+			f.n++
+			for _, e := range a.Edits {
+				f.lines += len(e.Old) + len(e.New)
+			}
+			// Older records have no timing, and nor do formats
+			// applied from a -confirm window, whose formatter ran before.
+			if a.Tool == "" || a.Took == 0 {
+				continue
+			}
+			t := tools[a.Tool]
+			if t == nil {
+				t = &toolStat{name: a.Tool}
+				tools[a.Tool] = t
+			}
+			t.n++
+			t.total += a.Took
+			if a.Took > t.max {
+				t.max = a.Took
+			}
+		}
+	}
+	writeStats(root, since, files, tools)
+	return 0
+}
+
+// writeStats writes the statistics of the project root to standard output.
+// The values are aligned with tabs unless plain is set.
+func writeStats(root string, since time.Time, files map[string]*fileStat, tools map[string]*toolStat) {
+	sep := "\t"
+	if plain {
+		sep = " "
+	}
+	if len(files) == 0 {
+		fmt.Printf(tr("no formats recorded in %s\n"), root)
+		return
+	}
+	var fs []*fileStat
+	n, lines := 0, 0
+	for _, f := range files {
+		fs = append(fs, f)
+		n += f.n
+		lines += f.lines
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		if fs[i].n != fs[j].n {
+			return fs[i].n > fs[j].n
+		}
+		return fs[i].name < fs[j].name
+	})
+	fmt.Printf(tr("Project:%s%s\n"), sep, root)
+	fmt.Printf(tr("Since:%s%s\n"), sep, since.Format(time.RFC3339))
+	fmt.Printf(tr("Formats:%s%d, of %d files, %.1f lines changed on average\n"), sep, n, len(fs), float64(lines)/float64(n))
+	for _, f := range fs {
+		fmt.Printf(tr("File:%s%s%s%d formats%s%.1f lines on average\n"), sep, f.name, sep, f.n, sep, float64(f.lines)/float64(f.n))
+	}
+	var ts []*toolStat
+	for _, t := range tools {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		ai, aj := ts[i].total/time.Duration(ts[i].n), ts[j].total/time.Duration(ts[j].n)
+		if ai != aj {
+			return ai > aj
+		}
+		return ts[i].name < ts[j].name
+	})
+	for _, t := range ts {
+		avg := t.total / time.Duration(t.n)
+		fmt.Printf(tr("Formatter:%s%s%s%d runs%s%s on average%s%s at most\n"), sep, t.name, sep, t.n, sep, avg.Round(time.Millisecond), sep, t.max.Round(time.Millisecond))
+	}
+}
+
+// projectRoot returns the top directory of the git repository of dir,
+// or if dir is not in one, dir itself, as an absolute path.
+func projectRoot(dir string) (string, error) {
+	if root, err := git(dir, "rev-parse", "--show-toplevel"); err == nil {
+		return strings.TrimSpace(root), nil
+	}
+	return filepath.Abs(dir)
+}
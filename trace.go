@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+
+	"9fans.net/go/acme"
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// trace, if non-nil, receives the trace of the operations on windows
+// and of the commands run, as set by the -v and -vv flags.
+var trace io.Writer
+
+// traceVerbose is set by the -vv flag.
+// If set, the trace includes reads of the window files.
+var traceVerbose bool
+
+// edwood is set by the -edwood flag.
+// If set, the windows are of Edwood rather than Acme.
+var edwood bool
+
+// wrapped returns win, traced to trace if it is non-nil,
+// retrying the operations that fail transiently,
+// and adapted to Edwood if edwood is set.
+// Every window that Fmt formats is wrapped.
+func wrapped(win fmtharness.Window) fmtharness.Window {
+	if trace != nil {
+		// Traced inside, so that the trace shows each try.
+		win = &fmtharness.Traced{Window: win, W: trace, Verbose: traceVerbose}
+	}
+	win = &fmtharness.Retrying{Window: win}
+	if edwood {
+		// Outermost, so that ReadAddr sees that it is Edwood's.
+		win = fmtharness.Edwood(win)
+	}
+	return win
+}
+
+// isLocal returns whether win, or the window that it wraps,
+// is a window of the local Acme.
+func isLocal(win fmtharness.Window) bool {
+	for {
+		switch w := win.(type) {
+		case *fmtharness.Retrying:
+			win = w.Window
+		case *fmtharness.Traced:
+			win = w.Window
+		case *acme.Win:
+			return true
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/eaburns/Fmt/fmtharness"
+)
+
+// A trimmed is a Formatter that tidies the output of its Formatter,
+// or if it is nil, the text itself:
+// it strips the trailing white space of each line,
+// removes the blank lines at the end of the text,
+// and ends the last line with a newline.
+type trimmed struct {
+	fmtharness.Formatter
+}
+
+// Format formats the text read from src with t.Formatter, if any,
+// and writes the output, trimmed, to dst.
+func (t trimmed) Format(dst io.Writer, src io.Reader) error {
+	if t.Formatter != nil {
+		var out bytes.Buffer
+		if err := t.Formatter.Format(&out, src); err != nil {
+			return err
+		}
+		src = &out
+	}
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, trim(string(text)))
+	return err
+}
+
+// trim returns text with the trailing white space of each line stripped,
+// the blank lines at its end removed, and its last line ended by a newline,
+// keeping \r\n line endings.
+func trim(text string) string {
+	var b strings.Builder
+	blank := 0
+	eol := "\n"
+	for _, l := range fmtharness.SplitLines(text) {
+		switch {
+		case strings.HasSuffix(l, "\r\n"):
+			eol = "\r\n"
+		case strings.HasSuffix(l, "\n"):
+			eol = "\n"
+		}
+		l = strings.TrimRight(l, " \t\r\n\v\f")
+		if l == "" {
+			blank++
+			continue
+		}
+		b.WriteString(strings.Repeat(eol, blank))
+		blank = 0
+		b.WriteString(l)
+		b.WriteString(eol)
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrim(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"\n\n\n", ""},
+		{"a", "a\n"},
+		{"a\n", "a\n"},
+		{"a  \t\nb \n", "a\nb\n"},
+		{"a\n\n\n", "a\n"},
+		{"a\n \n\t\nb\n", "a\n\n\nb\n"},
+		{"\n\na\n", "\n\na\n"},
+		{"a \r\nb\r\n\r\n", "a\r\nb\r\n"},
+		{"a\r\nb", "a\r\nb\r\n"},
+		{"α  \nβ", "α\nβ\n"},
+	}
+	for _, test := range tests {
+		if got := trim(test.text); got != test.want {
+			t.Errorf("trim(%q)=%q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTrimmed(t *testing.T) {
+	tests := []struct {
+		name string
+		f    trimmed
+		text string
+		want string
+	}{
+		{"alone", trimmed{}, "a \n\n", "a\n"},
+		{"after a formatter", trimmed{formatFunc(strings.ToUpper)}, "a \nb", "A\nB\n"},
+	}
+	for _, test := range tests {
+		got, err := format(test.f, test.text)
+		if err != nil || got != test.want {
+			t.Errorf("%s: Format(%q)=%q, %v, want %q, nil", test.name, test.text, got, err, test.want)
+		}
+	}
+	if _, err := format(trimmed{failFormatter{}}, "a\n"); err == nil {
+		t.Errorf("Format() after a failing formatter=_, nil, want an error")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of the file at src to the file at dst.
+func copyXattrs(dst, src string) error {
+	n, err := syscall.Listxattr(src, nil)
+	if err != nil || n == 0 {
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	list := make([]byte, n)
+	if n, err = syscall.Listxattr(src, list); err != nil {
+		return err
+	}
+	for _, name := range bytes.Split(list[:n], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		m, err := syscall.Getxattr(src, attr, nil)
+		if err != nil {
+			return err
+		}
+		val := make([]byte, m)
+		if m, err = syscall.Getxattr(src, attr, val); err != nil {
+			return err
+		}
+		if err := syscall.Setxattr(dst, attr, val[:m], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
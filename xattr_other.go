@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// copyXattrs does nothing;
+// extended attributes are only copied on Linux.
+func copyXattrs(dst, src string) error { return nil }